@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ HTTP API @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ CI used to scp .dep files into DEPS, now it can call the daemon directly
+ (enabled by API_TOKEN, every request needs "Authorization: Bearer <token>")
+
+ POST /api/v1/deployments                       {"service","namespace","version"} -> 202 + job
+ GET  /api/v1/jobs/{id}                         job state (memory, then history store)
+ GET  /api/v1/jobs/{id}/events                  SSE: state changes + rollout progress until done
+ POST /api/v1/jobs/{id}/cancel                  drop a queued job / stop a running one -> 202 + job
+ GET  /api/v1/services                          deployed version + last attempt per service
+ GET  /api/v1/services/{namespace}/{service}    same plus the recent history
+
+ a POST still writes the .dep (same as the cli) so startup reconcile and
+ drift see the new version, then queues the job itself to hand back its id,
+ the watcher skips that one write. the job runs through DeployService like
+ every other source: lock, approvals, notifications, rollback, history
+*/
+
+type deployRequest struct {
+	Service   string `json:"service"`
+	Namespace string `json:"namespace"`
+	Version   string `json:"version"`
+}
+
+type serviceStatus struct {
+	Service     string             `json:"service"`
+	Namespace   string             `json:"namespace"`
+	Spec        string             `json:"spec,omitempty"`
+	Version     string             `json:"version,omitempty"`
+	Image       string             `json:"image,omitempty"`
+	UpdatedAt   *time.Time         `json:"updatedAt,omitempty"`
+	LastAttempt *deploymentRecord  `json:"lastAttempt,omitempty"`
+	History     []deploymentRecord `json:"history,omitempty"`
+}
+
+func (d *Daemon) registerAPI(mux *http.ServeMux) {
+	mux.Handle("POST /api/v1/deployments", d.authorized(d.handleDeploy))
+	mux.Handle("GET /api/v1/jobs/{id}", d.authorized(d.handleJob))
+	mux.Handle("GET /api/v1/jobs/{id}/events", d.authorized(d.handleJobEvents))
+	mux.Handle("POST /api/v1/jobs/{id}/cancel", d.authorized(d.handleCancel))
+	mux.Handle("GET /api/v1/services", d.authorized(d.handleServices))
+	mux.Handle("GET /api/v1/services/{namespace}/{service}", d.authorized(d.handleService))
+}
+
+func (d *Daemon) authorized(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(d.opts.APIToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (d *Daemon) handleDeploy(w http.ResponseWriter, r *http.Request) {
+
+	var req deployRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// no worker takes it before the next start
+	if d.drain.draining() {
+		writeError(w, http.StatusServiceUnavailable, "shutting down, retry later")
+		return
+	}
+
+	// a follower's queue has no workers
+	if !d.leader.isLeader() {
+		writeError(w, http.StatusServiceUnavailable, d.notLeaderError().Error())
+		return
+	}
+
+	// refused before anything is written, a 503 leaves the .dep as it was
+	if pending, err := d.store.countJobs(QueuePending); err != nil || pending >= d.opts.QueueSize {
+		if err == nil {
+			err = errQueueFull
+		}
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	depFile := filepath.Join(d.opts.DepsPath, req.Service+"_"+req.Namespace+".dep")
+
+	// not the service lock, DeployService holds it for the whole rollout
+	// the rename is atomic and the job reads the file again anyway
+	content, err := withVersion(readFile(depFile), req.Version)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	d.jobStates.expectWrite(depFile, content)
+	if err := writeDepFile(depFile, content); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	job := DeployService{service: depFile, version: content, namespace: req.Namespace, trigger: TriggerAPI}
+	id, err := d.enqueue(job)
+	if err != nil {
+		// somebody took the last slot after the check, the .dep is written so
+		// the watcher's backlog queues it once there is room
+		d.jobStates.forgetWrite(depFile)
+		d.jobStates.holdBack(job)
+		writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("%v, the .dep is written and queued once there is room", err))
+		return
+	}
+	log.Printf("🌐 [%s/%s] %s queued by the api as job %s", req.Namespace, req.Service, req.Version, id)
+
+	state, _ := d.jobStates.get(id)
+	w.Header().Set("Location", "/api/v1/jobs/"+id)
+	writeJSON(w, http.StatusAccepted, state)
+}
+
+func (req deployRequest) validate() error {
+	for name, value := range map[string]string{"service": req.Service, "namespace": req.Namespace, "version": req.Version} {
+		if value == "" {
+			return fmt.Errorf("%s is required", name)
+		}
+	}
+	// the .dep filename is {service}_{namespace}.dep
+	for _, value := range []string{req.Service, req.Namespace} {
+		if strings.ContainsAny(value, "_/\\. ") {
+			return fmt.Errorf("invalid name %q", value)
+		}
+	}
+	return nil
+}
+
+func (d *Daemon) handleJob(w http.ResponseWriter, r *http.Request) {
+
+	job, ok, err := d.lookupJob(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown job")
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (d *Daemon) handleCancel(w http.ResponseWriter, r *http.Request) {
+
+	// jobs only run on the leader
+	if !d.leader.isLeader() {
+		writeError(w, http.StatusServiceUnavailable, d.notLeaderError().Error())
+		return
+	}
+
+	job, err := d.jobStates.cancel(r.PathValue("id"), fmt.Errorf("%w through the api", errCancelled))
+	switch {
+	case errors.Is(err, errUnknownJob):
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		log.Printf("⏹️  [%s/%s] job %s cancelled through the api", job.Namespace, job.Service, job.ID)
+		// a running job reports "cancelled" once DeployService stopped it
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+// server sent events, one "state" / "progress" event per change, closed once the job finished
+func (d *Daemon) handleJobEvents(w http.ResponseWriter, r *http.Request) {
+
+	id := r.PathValue("id")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	// subscribe before the snapshot so nothing in between is lost
+	events, cancel := d.jobStates.subscribe(id)
+	defer cancel()
+
+	job, ok, err := d.lookupJob(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown job")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	writeEvent(w, jobEvent{Type: "state", Job: job})
+	flusher.Flush()
+	last := job
+
+	// proxies drop idle connections
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for !last.finished() {
+		select {
+
+		case event, open := <-events:
+			if !open {
+				// a dropped final event still has to reach the client
+				if final, ok, _ := d.lookupJob(id); ok && !final.UpdatedAt.Equal(last.UpdatedAt) {
+					writeEvent(w, jobEvent{Type: "state", Job: final})
+					flusher.Flush()
+				}
+				return
+			}
+			writeEvent(w, event)
+			flusher.Flush()
+			last = event.Job
+
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event jobEvent) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+}
+
+func (d *Daemon) handleServices(w http.ResponseWriter, r *http.Request) {
+
+	statuses, err := d.serviceStatuses()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if namespace := r.URL.Query().Get("namespace"); namespace != "" {
+		filtered := []serviceStatus{}
+		for _, status := range statuses {
+			if status.Namespace == namespace {
+				filtered = append(filtered, status)
+			}
+		}
+		statuses = filtered
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (d *Daemon) handleService(w http.ResponseWriter, r *http.Request) {
+
+	serviceName, namespace := r.PathValue("service"), r.PathValue("namespace")
+
+	statuses, err := d.serviceStatuses()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, status := range statuses {
+		if status.Service != serviceName || status.Namespace != namespace {
+			continue
+		}
+		status.History, err = d.store.history(historyFilter{Service: serviceName, Namespace: namespace, Limit: 20})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+		return
+	}
+	writeError(w, http.StatusNotFound, "no deployments recorded for "+namespace+"/"+serviceName)
+}
+
+// what is deployed plus the newest attempt, every service the store knows
+func (d *Daemon) serviceStatuses() ([]serviceStatus, error) {
+
+	deployed, err := d.store.services()
+	if err != nil {
+		return nil, err
+	}
+	attempts, err := d.store.latestAttempts()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []serviceStatus{}
+	index := map[string]int{}
+	for _, state := range deployed {
+		updated := state.UpdatedAt
+		index[threadKey(state.Service, state.Namespace)] = len(statuses)
+		statuses = append(statuses, serviceStatus{
+			Service:   state.Service,
+			Namespace: state.Namespace,
+			Spec:      state.Spec,
+			Version:   shortSpec(state.Spec),
+			Image:     state.Image,
+			UpdatedAt: &updated,
+		})
+	}
+	for i := range attempts {
+		key := threadKey(attempts[i].Service, attempts[i].Namespace)
+		if _, ok := index[key]; !ok {
+			// attempted but never succeeded
+			index[key] = len(statuses)
+			statuses = append(statuses, serviceStatus{Service: attempts[i].Service, Namespace: attempts[i].Namespace})
+		}
+		statuses[index[key]].LastAttempt = &attempts[i]
+	}
+	return statuses, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testAPIToken = "s3cret"
+
+func newAPIDaemon(t *testing.T) (*Daemon, *httptest.Server) {
+	t.Helper()
+	d, _ := newTestDaemon(t,
+		testNamespace("default"),
+		testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1),
+	)
+	d.opts.APIToken = testAPIToken
+
+	srv := httptest.NewServer(d.httpHandler())
+	t.Cleanup(srv.Close)
+	return d, srv
+}
+
+func apiRequest(t *testing.T, method string, url string, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAPIToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func decode[T any](t *testing.T, resp *http.Response) T {
+	t.Helper()
+	var value T
+	if err := json.NewDecoder(resp.Body).Decode(&value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestAPIRequiresToken(t *testing.T) {
+	_, srv := newAPIDaemon(t)
+
+	for _, header := range []string{"", "Bearer wrong", testAPIToken} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/services", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%q: expected 401, got %d", header, resp.StatusCode)
+		}
+	}
+}
+
+func TestAPIDeployAndFollowJob(t *testing.T) {
+	d, srv := newAPIDaemon(t)
+
+	resp := apiRequest(t, http.MethodPost, srv.URL+"/api/v1/deployments", `{"service":"nginx-app","namespace":"default","version":"1.1.0"}`)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	job := decode[jobState](t, resp)
+	if job.State != JobQueued || job.Trigger != TriggerAPI || resp.Header.Get("Location") != "/api/v1/jobs/"+job.ID {
+		t.Fatalf("unexpected job: %+v", job)
+	}
+
+	// the .dep is the source of truth for reconcile and drift, it moves too
+	depFile := filepath.Join(d.opts.DepsPath, "nginx-app_default.dep")
+	if version := readFile(depFile); version != "1.1.0" {
+		t.Errorf(".dep not written: %q", version)
+	}
+	// and the watcher does not queue the same write again
+	if !d.jobStates.expectedWrite(depFile, "1.1.0") {
+		t.Errorf("write not marked as queued by the api")
+	}
+
+	// follow it before a worker picks it up
+	events := apiRequest(t, http.MethodGet, srv.URL+"/api/v1/jobs/"+job.ID+"/events", "")
+	if ct := events.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %s", ct)
+	}
+	go d.Worker()
+
+	states := []string{}
+	scanner := bufio.NewScanner(events.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event jobEvent
+		json.Unmarshal([]byte(data), &event)
+		if event.Type == "state" {
+			states = append(states, event.Job.State)
+		}
+	}
+	if len(states) < 2 || states[0] != JobQueued || states[len(states)-1] != OutcomeSucceeded {
+		t.Fatalf("expected queued ... succeeded, got %v", states)
+	}
+
+	got := decode[jobState](t, apiRequest(t, http.MethodGet, srv.URL+"/api/v1/jobs/"+job.ID, ""))
+	if got.State != OutcomeSucceeded || got.DeploymentID == 0 {
+		t.Errorf("job after the rollout: %+v", got)
+	}
+
+	service := decode[serviceStatus](t, apiRequest(t, http.MethodGet, srv.URL+"/api/v1/services/default/nginx-app", ""))
+	if service.Version != "1.1.0" || service.Image != "test.ecr.local/app:1.1.0" || len(service.History) != 1 || service.History[0].JobID != job.ID {
+		t.Errorf("service state: %+v", service)
+	}
+}
+
+// a full queue is refused before the .dep moves, nothing is left behind
+// for the watcher to skip
+func TestAPIDeployQueueFull(t *testing.T) {
+	d, srv := newAPIDaemon(t)
+	d.opts.QueueSize = 1
+	d.enqueue(DeployService{service: "redis_default.dep", version: "7.2.0", namespace: "default"})
+
+	resp := apiRequest(t, http.MethodPost, srv.URL+"/api/v1/deployments", `{"service":"nginx-app","namespace":"default","version":"1.1.0"}`)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", resp.StatusCode)
+	}
+	depFile := filepath.Join(d.opts.DepsPath, "nginx-app_default.dep")
+	if version := readFile(depFile); version != "" {
+		t.Errorf(".dep written for a refused deploy: %q", version)
+	}
+
+	// a write that lost the race for the last slot waits in the backlog
+	os.WriteFile(depFile, []byte("1.1.0"), 0644)
+	d.jobStates.holdBack(DeployService{service: depFile, namespace: "default", trigger: TriggerAPI})
+	d.retryBacklog()
+	if n, _ := d.store.countJobs(QueuePending); n != 1 {
+		t.Fatalf("backlog queued past the limit: %d pending", n)
+	}
+	d.store.claimJob()
+	d.retryBacklog()
+	if jobs, _ := d.store.pendingJobs(); len(jobs) != 1 || jobs[0].job.service != depFile || jobs[0].job.version != "1.1.0" {
+		t.Errorf("backlog not queued once there was room: %+v", jobs)
+	}
+	if len(d.jobStates.heldBack()) != 0 {
+		t.Errorf("backlog not emptied")
+	}
+}
+
+func TestAPIJobFromHistory(t *testing.T) {
+	d, srv := newAPIDaemon(t)
+
+	// finished before a restart, only the history row is left
+	rec := &deploymentRecord{Service: "nginx-app", Namespace: "default", Spec: "1.0.0", Version: "1.0.0", JobID: "feedbeef"}
+	d.store.begin(rec)
+	rec.Outcome, rec.Error = OutcomeFailed, "crash loop"
+	d.store.finish(rec)
+
+	got := decode[jobState](t, apiRequest(t, http.MethodGet, srv.URL+"/api/v1/jobs/feedbeef", ""))
+	if got.State != OutcomeFailed || got.Error != "crash loop" || got.DeploymentID != rec.ID {
+		t.Errorf("job from history: %+v", got)
+	}
+
+	if resp := apiRequest(t, http.MethodGet, srv.URL+"/api/v1/jobs/nope", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown job: %d", resp.StatusCode)
+	}
+}
+
+func TestAPIDeployValidation(t *testing.T) {
+	d, srv := newAPIDaemon(t)
+
+	for _, body := range []string{
+		`{"service":"nginx-app","namespace":"default"}`,
+		`{"service":"nginx_app","namespace":"default","version":"1.1.0"}`,
+		`{"service":"../etc","namespace":"default","version":"1.1.0"}`,
+		`{"service":"nginx-app","namespace":"default","version":"1.1.0 2"}`,
+		`not json`,
+	} {
+		if resp := apiRequest(t, http.MethodPost, srv.URL+"/api/v1/deployments", body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, resp.StatusCode)
+		}
+	}
+	if entries, _ := os.ReadDir(d.opts.DepsPath); len(entries) != 0 {
+		t.Errorf("rejected requests wrote files: %v", entries)
+	}
+}
+
+func TestJobProgressReachesSubscribers(t *testing.T) {
+	r := newJobRegistry()
+	r.add(jobState{ID: "j1", Service: "nginx-app", Namespace: "default", State: JobQueued})
+
+	events, cancel := r.subscribe("j1")
+	defer cancel()
+
+	r.setState("j1", JobRunning, nil)
+	r.progress(threadKey("nginx-app", "default"), "Updated: 1/2")
+	// other services' progress is not ours
+	r.progress(threadKey("api", "default"), "Updated: 0/1")
+	r.setState("j1", OutcomeSucceeded, nil)
+
+	got := []string{}
+	for event := range events {
+		got = append(got, event.Type+":"+event.Job.State+":"+event.Message)
+	}
+	want := "state:running: progress:running:Updated: 1/2 state:succeeded:"
+	if strings.Join(got, " ") != want {
+		t.Errorf("got %v", got)
+	}
+
+	if _, ok := r.running[threadKey("nginx-app", "default")]; ok {
+		t.Errorf("finished job still marked running")
+	}
+}
+
+func TestAPICancelJob(t *testing.T) {
+	d, client := newTestDaemon(t,
+		testNamespace("default"),
+		unhealthy(testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1)),
+		// pending but not failing, only the cancel ends the wait
+		testPod("nginx-app-abc", "default", "nginx-app", corev1.ContainerState{
+			Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"},
+		}),
+	)
+	d.opts.APIToken = testAPIToken
+	d.opts.RolloutTimeout = time.Minute
+	srv := httptest.NewServer(d.httpHandler())
+	defer srv.Close()
+
+	running := decode[jobState](t, apiRequest(t, http.MethodPost, srv.URL+"/api/v1/deployments", `{"service":"nginx-app","namespace":"default","version":"1.1.0"}`))
+	queued := decode[jobState](t, apiRequest(t, http.MethodPost, srv.URL+"/api/v1/deployments", `{"service":"redis","namespace":"default","version":"7.2.0"}`))
+	go d.Worker()
+	waitFor(t, "the rollout to start", func() bool {
+		job, _ := d.jobStates.get(running.ID)
+		return job.State == JobRunning
+	})
+
+	resp := apiRequest(t, http.MethodPost, srv.URL+"/api/v1/jobs/"+queued.ID+"/cancel", "")
+	if got := decode[jobState](t, resp); resp.StatusCode != http.StatusAccepted || got.State != OutcomeCancelled {
+		t.Fatalf("cancel queued: %d %+v", resp.StatusCode, got)
+	}
+
+	if resp := apiRequest(t, http.MethodPost, srv.URL+"/api/v1/jobs/"+running.ID+"/cancel", ""); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("cancel running: %d", resp.StatusCode)
+	}
+	waitFor(t, "the running job to stop", func() bool {
+		job, _ := d.jobStates.get(running.ID)
+		return job.State == OutcomeCancelled
+	})
+
+	rec, _, _ := d.store.byJobID(running.ID)
+	if rec.Outcome != OutcomeCancelled || !strings.Contains(rec.Error, "cancelled through the api") {
+		t.Errorf("attempt: %+v", rec)
+	}
+	// cancelled is not failed, nothing is rolled back
+	dep, _ := client.AppsV1().Deployments("default").Get(context.TODO(), "nginx-app", metav1.GetOptions{})
+	if image := dep.Spec.Template.Spec.Containers[0].Image; image != "test.ecr.local/app:1.1.0" {
+		t.Errorf("image after cancel: %s", image)
+	}
+
+	// no worker claims the cancelled one
+	if q, _, _ := d.store.jobByID(queued.ID); q.state.State != OutcomeCancelled {
+		t.Errorf("queued job row: %+v", q.state)
+	}
+	if _, ok, _ := d.store.byJobID(queued.ID); ok {
+		t.Errorf("cancelled queued job was deployed")
+	}
+
+	if resp := apiRequest(t, http.MethodPost, srv.URL+"/api/v1/jobs/"+running.ID+"/cancel", ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("cancel finished job: %d", resp.StatusCode)
+	}
+	if resp := apiRequest(t, http.MethodPost, srv.URL+"/api/v1/jobs/nope/cancel", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("cancel unknown job: %d", resp.StatusCode)
+	}
+}
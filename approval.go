@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ APPROVALS @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ a .dep write used to roll out right away, for namespaces like prod someone
+ has to say yes first (namespaces.<ns>.approval in ENGINE_CONFIG)
+
+ DeployService (holding the service lock) -> awaitApproval:
+ 1. posts "🔐 Approval needed" with Approve / Reject buttons (slack app, bot token)
+ 2. waits for the click, slack calls POST /slack/interactions on HTTP_ADDR,
+    signed with SLACK_SIGNING_SECRET, anything unsigned / stale is a 401
+ 3. a click from someone not in approvers gets an ephemeral "not allowed"
+    approvers are slack user ids, names can be changed by their owner and
+    are not unique, so they never authorize anything
+ 4. approved -> the deploy continues, rejected / timeout -> message updated,
+    notification sent, job dropped (last good untouched, the next .dep write or
+    a restart asks again)
+
+ pending requests only live in the leader (leader.go), the one running the
+ job. a click routed to a follower gets a 503, not "already decided": slack
+ shows it as failed and the click can be repeated
+*/
+
+const (
+	actionApprove = "approve_deploy"
+	actionReject  = "reject_deploy"
+)
+
+type approvals struct {
+	api           *slack.Client
+	channel       string
+	signingSecret string
+
+	mu      sync.Mutex
+	pending map[string]*approvalRequest
+}
+
+type approvalRequest struct {
+	serviceName string
+	namespace   string
+	policy      ApprovalPolicy
+	decision    chan approvalDecision
+}
+
+type approvalDecision struct {
+	approved bool
+	user     string
+}
+
+// nil unless SLACK_BOT_TOKEN, SLACK_CHANNEL and SLACK_SIGNING_SECRET are set
+func approvalsFromEnv() *approvals {
+
+	token, channel, secret := os.Getenv("SLACK_BOT_TOKEN"), os.Getenv("SLACK_CHANNEL"), os.Getenv("SLACK_SIGNING_SECRET")
+	if token == "" || channel == "" || secret == "" {
+		return nil
+	}
+	return newApprovals(token, channel, secret, "")
+}
+
+// apiURL is for tests, "" is slack.com
+func newApprovals(token string, channel string, signingSecret string, apiURL string) *approvals {
+
+	options := []slack.Option{}
+	if apiURL != "" {
+		options = append(options, slack.OptionAPIURL(apiURL))
+	}
+
+	return &approvals{
+		api:           slack.New(token, options...),
+		channel:       channel,
+		signingSecret: signingSecret,
+		pending:       make(map[string]*approvalRequest),
+	}
+}
+
+// blocks until the deploy is approved, returns who approved it
+// rejected / expired are errors, the notification is already sent
+// ctx ending (cancel, shutdown) drops the request, its cause is returned
+func (d *Daemon) awaitApproval(ctx context.Context, serviceName string, namespace string, spec DepSpec, policy *ApprovalPolicy) (string, error) {
+
+	a := d.opts.Approvals
+	if a == nil {
+		return "", fmt.Errorf("namespace %s requires an approval but the slack app is not configured (SLACK_BOT_TOKEN, SLACK_CHANNEL, SLACK_SIGNING_SECRET)", namespace)
+	}
+
+	timeout := 30 * time.Minute
+	if policy.Timeout != nil {
+		timeout = policy.Timeout.Duration
+	}
+	channel := a.channel
+	if policy.Channel != "" {
+		channel = policy.Channel
+	}
+
+	id := newApprovalID()
+	req := &approvalRequest{serviceName: serviceName, namespace: namespace, policy: *policy, decision: make(chan approvalDecision, 1)}
+
+	a.mu.Lock()
+	a.pending[id] = req
+	a.mu.Unlock()
+
+	defer func() {
+		a.mu.Lock()
+		delete(a.pending, id)
+		a.mu.Unlock()
+	}()
+
+	details := fmt.Sprintf("service:%s\nversion:%s\nnamespace:%s", serviceName, spec, namespace) + spec.details()
+
+	_, ts, err := a.api.PostMessageContext(ctx, channel, approvalBlocks(details, id, policy, timeout)...)
+	if err != nil {
+		return "", fmt.Errorf("failed to post approval request: %w", err)
+	}
+
+	log.Printf("🔐 [%s/%s] waiting up to %s for an approval", namespace, serviceName, timeout)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var outcome Notification
+
+	select {
+
+	case decision := <-req.decision:
+		if decision.approved {
+			a.resolve(ctx, channel, ts, details, fmt.Sprintf("👍 Approved by %s", decision.user))
+			log.Printf("👍 [%s/%s] approved by %s", namespace, serviceName, decision.user)
+			return decision.user, nil
+		}
+		err = fmt.Errorf("rejected by %s", decision.user)
+		a.resolve(ctx, channel, ts, details, "🚫 Rejected by "+decision.user)
+		outcome = Notification{Message: "Deployment Rejected", MessageType: MsgDeploymentRejected}
+
+	case <-timer.C:
+		err = fmt.Errorf("no approval within %s", timeout)
+		a.resolve(ctx, channel, ts, details, fmt.Sprintf("⌛ Expired, nobody approved within %s", timeout))
+		outcome = Notification{Message: "Approval Expired", MessageType: MsgApprovalExpired}
+
+	case <-ctx.Done():
+		// DeployService sends the cancelled / interrupted notification
+		err = context.Cause(ctx)
+		// the buttons still have to go, briefly, shutdown is waiting
+		resolveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		a.resolve(resolveCtx, channel, ts, details, "⏹️ No longer needed: "+err.Error())
+		cancel()
+		log.Printf("⏹️ [%s/%s] approval abandoned: %v", namespace, serviceName, err)
+		return "", err
+	}
+
+	log.Printf("🚫 [%s/%s] not deployed: %v", namespace, serviceName, err)
+
+	outcome.Details = details + "\nreason:" + err.Error()
+	d.notify(outcome)
+	return "", err
+}
+
+// request message with the buttons
+func approvalBlocks(details string, id string, policy *ApprovalPolicy, timeout time.Duration) []slack.MsgOption {
+
+	blocks, fallback := slackBlocks(Notification{Message: "Approval Needed", Details: details, MessageType: MsgApprovalRequested}, "")
+
+	approve := slack.NewButtonBlockElement(actionApprove, id, slack.NewTextBlockObject(slack.PlainTextType, "Approve", false, false))
+	approve.Style = slack.StylePrimary
+	reject := slack.NewButtonBlockElement(actionReject, id, slack.NewTextBlockObject(slack.PlainTextType, "Reject", false, false))
+	reject.Style = slack.StyleDanger
+
+	who := "anyone in the channel"
+	if len(policy.Approvers) > 0 {
+		who = strings.Join(policy.Approvers, ", ")
+	}
+	context := fmt.Sprintf("approvers: %s · expires in %s", who, timeout)
+
+	blocks = append(blocks,
+		slack.NewActionBlock("approval_"+id, approve, reject),
+		slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType, context, false, false)),
+	)
+	return []slack.MsgOption{slack.MsgOptionBlocks(blocks...), slack.MsgOptionText(fallback, false)}
+}
+
+// swaps the buttons for the outcome so nobody clicks an old request
+func (a *approvals) resolve(ctx context.Context, channel string, ts string, details string, outcome string) {
+
+	blocks, fallback := slackBlocks(Notification{Message: "Approval Needed", Details: details, MessageType: MsgApprovalRequested}, outcome)
+
+	if _, _, _, err := a.api.UpdateMessageContext(ctx, channel, ts, slack.MsgOptionBlocks(blocks...), slack.MsgOptionText(fallback, false)); err != nil {
+		log.Printf("⚠️ Could not update approval message: %v", err)
+	}
+}
+
+// POST /slack/interactions, slack's interactivity request url
+func (a *approvals) handleInteraction(w http.ResponseWriter, r *http.Request) {
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "bad body", http.StatusBadRequest)
+		return
+	}
+
+	// signed with the signing secret and not older than 5 minutes
+	verifier, err := slack.NewSecretsVerifier(r.Header, a.signingSecret)
+	if err != nil {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	verifier.Write(body)
+	if err := verifier.Ensure(); err != nil {
+		log.Printf("⚠️ Rejected slack interaction with a bad signature from %s", r.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+
+	var callback slack.InteractionCallback
+	if err := json.Unmarshal([]byte(form.Get("payload")), &callback); err != nil {
+		http.Error(w, "bad payload", http.StatusBadRequest)
+		return
+	}
+
+	if callback.Type == slack.InteractionTypeBlockActions {
+		for _, action := range callback.ActionCallback.BlockActions {
+			if action.ActionID == actionApprove || action.ActionID == actionReject {
+				a.decide(action.Value, callback.User, action.ActionID == actionApprove, callback.Channel.ID)
+			}
+		}
+	}
+
+	// slack only wants a 200 within 3s
+	w.WriteHeader(http.StatusOK)
+}
+
+// the interactions endpoint, only the leader holds the pending requests
+func (d *Daemon) handleSlackInteraction(w http.ResponseWriter, r *http.Request) {
+	if !d.leader.isLeader() {
+		log.Printf("⚠️ Slack interaction reached a follower: %v", d.notLeaderError())
+		w.Header().Set("Retry-After", "2")
+		http.Error(w, d.notLeaderError().Error(), http.StatusServiceUnavailable)
+		return
+	}
+	d.opts.Approvals.handleInteraction(w, r)
+}
+
+func (a *approvals) decide(id string, user slack.User, approved bool, channel string) {
+
+	a.mu.Lock()
+	req := a.pending[id]
+	allowed := req != nil && a.allowed(req.policy, user.ID)
+	if allowed {
+		delete(a.pending, id)
+	}
+	a.mu.Unlock()
+
+	// only for people to read, the id decided
+	name := user.Name
+	if name == "" {
+		name = user.ID
+	}
+
+	switch {
+	case req == nil:
+		a.tell(channel, user.ID, "This approval request was already decided or has expired.")
+	case !allowed:
+		log.Printf("⚠️ [%s/%s] %s is not an approver", req.namespace, req.serviceName, name)
+		a.tell(channel, user.ID, fmt.Sprintf("You are not an approver for %s.", req.namespace))
+	default:
+		req.decision <- approvalDecision{approved: approved, user: name}
+	}
+}
+
+func (a *approvals) allowed(policy ApprovalPolicy, userID string) bool {
+	if len(policy.Approvers) == 0 {
+		return true
+	}
+	return userID != "" && slices.Contains(policy.Approvers, userID)
+}
+
+// ephemeral, only the clicking user sees it
+func (a *approvals) tell(channel string, userID string, text string) {
+	if channel == "" || userID == "" {
+		return
+	}
+	go func() {
+		if _, err := a.api.PostEphemeral(channel, userID, slack.MsgOptionText(text, false)); err != nil {
+			log.Printf("⚠️ Could not answer slack user %s: %v", userID, err)
+		}
+	}()
+}
+
+func newApprovalID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
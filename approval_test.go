@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testSigningSecret = "8f742231b10e8888abcd99yyyzzz85a5"
+
+// block_actions callback, signed like slack does at the given time
+func interaction(t *testing.T, secret string, at time.Time, user slack.User, actionID string, id string) *http.Request {
+	t.Helper()
+
+	callback := slack.InteractionCallback{
+		Type:    slack.InteractionTypeBlockActions,
+		User:    user,
+		Channel: slack.Channel{GroupConversation: slack.GroupConversation{Conversation: slack.Conversation{ID: "C123"}}},
+		ActionCallback: slack.ActionCallbacks{
+			BlockActions: []*slack.BlockAction{{ActionID: actionID, Value: id}},
+		},
+	}
+	payload, err := json.Marshal(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := url.Values{"payload": {string(payload)}}.Encode()
+
+	ts := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + ts + ":" + body))
+
+	req := httptest.NewRequest(http.MethodPost, "/slack/interactions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Slack-Request-Timestamp", ts)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+// daemon whose prod namespace needs an approval, slack api is a local fake
+func newApprovalDaemon(t *testing.T, policy ApprovalPolicy) (*Daemon, func() []slackCall) {
+	t.Helper()
+
+	apiURL, calls := fakeSlackAPI(t)
+	d, _ := newTestDaemon(t)
+	d.opts.Approvals = newApprovals("xoxb-test", "C123", testSigningSecret, apiURL)
+	d.config.Namespaces = map[string]NamespaceConfig{"prod": {Approval: &policy}}
+	return d, calls
+}
+
+// the id of the single pending request, once it is posted
+func pendingApproval(t *testing.T, a *approvals) string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		a.mu.Lock()
+		for id := range a.pending {
+			a.mu.Unlock()
+			return id
+		}
+		a.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("no approval request posted")
+	return ""
+}
+
+func TestApprovalApprovedByApprover(t *testing.T) {
+	d, calls := newApprovalDaemon(t, ApprovalPolicy{Approvers: []string{"U_ALICE"}})
+	handler := d.httpHandler()
+
+	type result struct {
+		user string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		user, err := d.awaitApproval(context.TODO(), "nginx-app", "prod", DepSpec{Version: "1.1.0"}, d.config.approval("prod"))
+		done <- result{user, err}
+	}()
+
+	id := pendingApproval(t, d.opts.Approvals)
+
+	// bob is not an approver, naming himself after one does not help
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, interaction(t, testSigningSecret, time.Now(), slack.User{ID: "U_BOB", Name: "U_ALICE"}, actionApprove, id))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("bob's click: %d", rec.Code)
+	}
+	select {
+	case r := <-done:
+		t.Fatalf("decided by a non approver: %+v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, interaction(t, testSigningSecret, time.Now(), slack.User{ID: "U_ALICE", Name: "alice"}, actionApprove, id))
+
+	r := <-done
+	if r.err != nil || r.user != "alice" {
+		t.Fatalf("expected approval by alice, got %+v", r)
+	}
+
+	methods := map[string]string{}
+	for _, call := range calls() {
+		methods[call.method] += call.blocks
+	}
+	if !strings.Contains(methods["chat.postMessage"], actionApprove) || !strings.Contains(methods["chat.postMessage"], actionReject) {
+		t.Errorf("request without buttons: %s", methods["chat.postMessage"])
+	}
+	if !strings.Contains(methods["chat.update"], "Approved by alice") {
+		t.Errorf("request not resolved: %s", methods["chat.update"])
+	}
+	// the ephemeral for bob is sent in the background
+	deadline := time.Now().Add(time.Second)
+	for !called(calls(), "chat.postEphemeral") {
+		if time.Now().After(deadline) {
+			t.Fatal("non approver got no ephemeral answer")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func called(calls []slackCall, method string) bool {
+	for _, call := range calls {
+		if call.method == method {
+			return true
+		}
+	}
+	return false
+}
+
+func TestApprovalRejected(t *testing.T) {
+	d, _ := newApprovalDaemon(t, ApprovalPolicy{})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.awaitApproval(context.TODO(), "nginx-app", "prod", DepSpec{Version: "1.1.0"}, d.config.approval("prod"))
+		done <- err
+	}()
+
+	id := pendingApproval(t, d.opts.Approvals)
+	d.httpHandler().ServeHTTP(httptest.NewRecorder(), interaction(t, testSigningSecret, time.Now(), slack.User{ID: "U_BOB", Name: "bob"}, actionReject, id))
+
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "rejected by bob") {
+		t.Fatalf("expected rejection, got %v", err)
+	}
+}
+
+func TestApprovalExpires(t *testing.T) {
+	d, calls := newApprovalDaemon(t, ApprovalPolicy{Timeout: &metav1.Duration{Duration: 50 * time.Millisecond}})
+
+	hookURL, hook := captureServer(t, http.StatusOK)
+	d.outbox = testOutbox(t, t.TempDir(), newWebhookNotifier(hookURL))
+
+	_, err := d.awaitApproval(context.TODO(), "nginx-app", "prod", DepSpec{Version: "1.1.0"}, d.config.approval("prod"))
+	if err == nil || !strings.Contains(err.Error(), "no approval within") {
+		t.Fatalf("expected expiry, got %v", err)
+	}
+
+	last := calls()[len(calls())-1]
+	if last.method != "chat.update" || !strings.Contains(last.blocks, "Expired") {
+		t.Errorf("request not marked expired: %+v", last)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.FlushNotifications(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if body := string(<-hook); !strings.Contains(body, MsgApprovalExpired) {
+		t.Errorf("expiry not notified: %s", body)
+	}
+}
+
+func TestInteractionSignature(t *testing.T) {
+	d, _ := newApprovalDaemon(t, ApprovalPolicy{})
+	handler := d.httpHandler()
+	alice := slack.User{ID: "U_ALICE", Name: "alice"}
+
+	tests := []struct {
+		name string
+		req  *http.Request
+	}{
+		{"wrong secret", interaction(t, "not-the-secret", time.Now(), alice, actionApprove, "x")},
+		{"replayed", interaction(t, testSigningSecret, time.Now().Add(-10*time.Minute), alice, actionApprove, "x")},
+		{"unsigned", httptest.NewRequest(http.MethodPost, "/slack/interactions", strings.NewReader("payload={}"))},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, tt.req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", tt.name, rec.Code)
+		}
+	}
+}
+
+// the request lives in the leader, a follower must not call it decided
+func TestInteractionOnFollower(t *testing.T) {
+	d, calls := newApprovalDaemon(t, ApprovalPolicy{})
+	d.leader = &leaderState{enabled: true, identity: "engine-b"}
+	d.leader.leader = "engine-a"
+
+	rec := httptest.NewRecorder()
+	d.httpHandler().ServeHTTP(rec, interaction(t, testSigningSecret, time.Now(), slack.User{ID: "U_ALICE"}, actionApprove, "x"))
+
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "engine-a") {
+		t.Errorf("expected 503 naming the leader, got %d %s", rec.Code, rec.Body)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if called(calls(), "chat.postEphemeral") {
+		t.Errorf("follower answered the click")
+	}
+}
+
+func TestDeployServiceNeedsApproval(t *testing.T) {
+	d, client := newTestDaemon(t,
+		testNamespace("prod"),
+		testDeployment("nginx-app", "prod", "test.ecr.local/app:1.0.0", 1),
+	)
+	// approval required, no slack app configured -> never deployed
+	d.config.Namespaces = map[string]NamespaceConfig{"prod": {Approval: &ApprovalPolicy{}}}
+
+	depFile := filepath.Join(d.opts.DepsPath, "nginx-app_prod.dep")
+	os.WriteFile(depFile, []byte("1.1.0"), 0644)
+
+	d.DeployService(DeployService{service: depFile, version: "1.1.0", namespace: "prod"})
+
+	dep, _ := client.AppsV1().Deployments("prod").Get(context.TODO(), "nginx-app", metav1.GetOptions{})
+	if image := dep.Spec.Template.Spec.Containers[0].Image; image != "test.ecr.local/app:1.0.0" {
+		t.Errorf("deployed without approval: %s", image)
+	}
+	if last, _ := d.store.lastGood("nginx-app", "prod"); last != "" {
+		t.Errorf("recorded as deployed without approval: %s", last)
+	}
+	if records, _ := d.store.history(historyFilter{}); len(records) != 1 || records[0].Outcome != OutcomeRejected {
+		t.Errorf("rejection not recorded: %+v", records)
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ CLI @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ during an incident people used to ssh in and hand edit .dep files, now:
+
+ engine run                                   the daemon (also: no subcommand)
+ engine status [namespace]                    deployed version + last attempt per service
+ engine history <service> <ns> [-n 20]        past attempts, newest first
+ engine deploy <service> <ns> <version>       roll out a version
+ engine rollback <service> <ns> [--to v]      back to the previous good version
+ engine cancel <job-id | service ns>          stop a queued or running job
+
+ deploy / rollback do not talk to the cluster themselves, they write the .dep
+ file (tmp + rename) so the running daemon picks it up through the normal
+ watcher -> queue -> DeployService path: service lock, approvals,
+ notifications, rollback and history all apply
+
+ then they follow the history store until the daemon recorded the outcome
+ (--wait, 0 = fire and forget), exit code 0 only when it succeeded
+
+ cancel can't go through a file, it calls the daemon's api instead
+ (ENGINE_URL, default http://localhost{HTTP_ADDR}, with API_TOKEN)
+*/
+
+type cli struct {
+	out      io.Writer
+	depsPath string
+	store    *historyStore
+	// how often deploy / rollback look at the store while waiting
+	pollInterval time.Duration
+	// the daemon's api, cancel only
+	apiURL   string
+	apiToken string
+}
+
+const cliUsage = `usage: engine <command> [arguments]
+
+  run                                      run the daemon (default)
+  status [namespace]                       deployed version and last attempt per service
+  history <service> <namespace> [-n 20]    past deployment attempts
+  deploy <service> <namespace> <version>   deploy a version through the daemon [--wait 10m]
+  rollback <service> <namespace>           back to the previous good version [--to version] [--wait 10m]
+  cancel <job-id> | <service> <namespace>  stop a queued job or the running deployment
+`
+
+// returns the exit code
+func runCLI(command string, args []string, out io.Writer) int {
+
+	if command == "help" || command == "-h" || command == "--help" {
+		fmt.Fprint(out, cliUsage)
+		return 0
+	}
+
+	commands := map[string]func(*cli, []string) error{
+		"status":   (*cli).status,
+		"history":  (*cli).history,
+		"deploy":   (*cli).deploy,
+		"rollback": (*cli).rollback,
+		"cancel":   (*cli).cancel,
+	}
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprintf(out, "unknown command %q\n\n%s", command, cliUsage)
+		return 2
+	}
+
+	path, err := getPATH()
+	if err != nil {
+		return 1
+	}
+
+	store, err := openStore(filepath.Join(getStateDir(), "engine.db"))
+	if err != nil {
+		fmt.Fprintf(out, "Error opening history store: %v\n", err)
+		return 1
+	}
+	defer store.close()
+
+	c := &cli{out: out, depsPath: path, store: store, pollInterval: time.Second, apiURL: engineURL(), apiToken: os.Getenv("API_TOKEN")}
+	if err := run(c, args); err != nil {
+		fmt.Fprintf(out, "❌ %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// flag.Parse stops at the first positional argument,
+// this lets `rollback nginx-app default --to 1.0.0` work too
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func (c *cli) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.out)
+	return fs
+}
+
+// engine status [namespace]
+func (c *cli) status(args []string) error {
+
+	fs := c.flags("status")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	namespace := ""
+	if len(positional) > 0 {
+		namespace = positional[0]
+	}
+
+	deployed, err := c.store.services()
+	if err != nil {
+		return err
+	}
+	attempts, err := c.store.latestAttempts()
+	if err != nil {
+		return err
+	}
+
+	type row struct {
+		state   serviceState
+		attempt *deploymentRecord
+	}
+	rows := map[string]*row{}
+	keys := []string{}
+	get := func(serviceName string, ns string) *row {
+		key := threadKey(serviceName, ns)
+		if rows[key] == nil {
+			rows[key] = &row{state: serviceState{Service: serviceName, Namespace: ns}}
+			keys = append(keys, key)
+		}
+		return rows[key]
+	}
+	for _, state := range deployed {
+		get(state.Service, state.Namespace).state = state
+	}
+	for i := range attempts {
+		get(attempts[i].Service, attempts[i].Namespace).attempt = &attempts[i]
+	}
+
+	// only recorded with LEADER_ELECT
+	if leader, err := c.store.meta(metaLeader); err == nil && leader != "" {
+		fmt.Fprintf(c.out, "leader: %s\n\n", leader)
+	}
+	if pending, err := c.store.countJobs(QueuePending); err == nil && pending > 0 {
+		fmt.Fprintf(c.out, "queue: %d job(s) waiting for a worker\n\n", pending)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tSERVICE\tDEPLOYED\tIMAGE\tLAST ATTEMPT\tOUTCOME\tWHEN\tPENDING")
+
+	slices.Sort(keys)
+	for _, key := range keys {
+		r := rows[key]
+		if namespace != "" && r.state.Namespace != namespace {
+			continue
+		}
+
+		deployedVersion := shortSpec(r.state.Spec)
+		attempt, outcome, when := "-", "-", "-"
+		if r.attempt != nil {
+			attempt, outcome, when = r.attempt.Version, r.attempt.Outcome, ago(r.attempt.StartedAt)
+		}
+
+		// a .dep that differs from what is deployed: queued, failed or the daemon is down
+		pending := "-"
+		depFile := filepath.Join(c.depsPath, r.state.Service+"_"+r.state.Namespace+".dep")
+		if content := readFile(depFile); content != "" && content != r.state.Spec {
+			pending = shortSpec(content)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.state.Namespace, r.state.Service,
+			dash(deployedVersion), dash(r.state.Image), dash(attempt), outcome, when, pending)
+	}
+	return w.Flush()
+}
+
+// engine history <service> <namespace> [-n 20]
+func (c *cli) history(args []string) error {
+
+	fs := c.flags("history")
+	limit := fs.Int("n", 20, "number of attempts to show")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return fmt.Errorf("usage: engine history <service> <namespace> [-n 20]")
+	}
+
+	records, err := c.store.history(historyFilter{Service: positional[0], Namespace: positional[1], Limit: *limit})
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		fmt.Fprintf(c.out, "no deployments recorded for %s in %s\n", positional[0], positional[1])
+		return nil
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTARTED\tDURATION\tVERSION\tOUTCOME\tTRIGGER\tIMAGE\tERROR")
+	for _, rec := range records {
+		duration := "-"
+		if !rec.FinishedAt.IsZero() {
+			duration = rec.FinishedAt.Sub(rec.StartedAt).Round(time.Second).String()
+		}
+		image := rec.NewImage
+		if rec.OldImage != "" && rec.OldImage != rec.NewImage {
+			image = rec.OldImage + " → " + rec.NewImage
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", rec.ID, rec.StartedAt.Local().Format("2006-01-02 15:04:05"),
+			duration, rec.Version, rec.Outcome, dash(rec.Trigger), dash(image), dash(clip(firstLine(rec.Error), 80)))
+	}
+	return w.Flush()
+}
+
+// engine deploy <service> <namespace> <version>
+func (c *cli) deploy(args []string) error {
+
+	fs := c.flags("deploy")
+	wait := fs.Duration("wait", 10*time.Minute, "how long to wait for the outcome, 0 to not wait")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 3 {
+		return fmt.Errorf("usage: engine deploy <service> <namespace> <version> [--wait 10m]")
+	}
+	serviceName, namespace, version := positional[0], positional[1], positional[2]
+
+	depFile := c.depFile(serviceName, namespace)
+	content, err := withVersion(readFile(depFile), version)
+	if err != nil {
+		return err
+	}
+	return c.submit(serviceName, namespace, depFile, content, *wait)
+}
+
+// engine rollback <service> <namespace> [--to version]
+func (c *cli) rollback(args []string) error {
+
+	fs := c.flags("rollback")
+	to := fs.String("to", "", "version to go back to, default the one before the current")
+	wait := fs.Duration("wait", 10*time.Minute, "how long to wait for the outcome, 0 to not wait")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return fmt.Errorf("usage: engine rollback <service> <namespace> [--to version] [--wait 10m]")
+	}
+	serviceName, namespace := positional[0], positional[1]
+
+	current, err := c.store.lastGood(serviceName, namespace)
+	if err != nil {
+		return err
+	}
+	records, err := c.store.history(historyFilter{Service: serviceName, Namespace: namespace, Limit: 500})
+	if err != nil {
+		return err
+	}
+
+	// the whole .dep of a good attempt comes back, not just its version
+	target := ""
+	for _, rec := range records {
+		if rec.Outcome != OutcomeSucceeded || rec.Spec == current {
+			continue
+		}
+		if *to == "" || rec.Version == *to || rec.Spec == *to {
+			target = rec.Spec
+			break
+		}
+	}
+	if target == "" {
+		if *to != "" {
+			return fmt.Errorf("%s was never deployed successfully to %s/%s, use `engine deploy` for a new version", *to, namespace, serviceName)
+		}
+		return fmt.Errorf("no earlier successful deployment of %s/%s to go back to", namespace, serviceName)
+	}
+
+	fmt.Fprintf(c.out, "⏪ rolling %s/%s back from %s to %s\n", namespace, serviceName, dash(shortSpec(current)), shortSpec(target))
+	return c.submit(serviceName, namespace, c.depFile(serviceName, namespace), target, *wait)
+}
+
+// engine cancel <job-id> | <service> <namespace>
+func (c *cli) cancel(args []string) error {
+
+	positional, err := parseArgs(c.flags("cancel"), args)
+	if err != nil {
+		return err
+	}
+
+	var id string
+	switch len(positional) {
+	case 1:
+		id = positional[0]
+	case 2:
+		// the running attempt of that service knows its job
+		records, err := c.store.history(historyFilter{Service: positional[0], Namespace: positional[1], Limit: 1})
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 || records[0].Outcome != OutcomeRunning || records[0].JobID == "" {
+			return fmt.Errorf("nothing running for %s/%s, queued jobs are cancelled by id", positional[1], positional[0])
+		}
+		id = records[0].JobID
+	default:
+		return fmt.Errorf("usage: engine cancel <job-id> | <service> <namespace>")
+	}
+
+	if c.apiURL == "" || c.apiToken == "" {
+		return fmt.Errorf("cancel needs the daemon's api: set API_TOKEN (and ENGINE_URL unless it is on this host)")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.apiURL+"/api/v1/jobs/"+url.PathEscape(id)+"/cancel", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiToken)
+
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return fmt.Errorf("daemon not reachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return fmt.Errorf("job %s: %s", id, dash(body.Error))
+	}
+
+	var job jobState
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return err
+	}
+	if job.State == OutcomeCancelled {
+		fmt.Fprintf(c.out, "⏹️  job %s (%s/%s %s) cancelled before it started\n", id, job.Namespace, job.Service, job.Version)
+	} else {
+		fmt.Fprintf(c.out, "⏹️  job %s (%s/%s %s) is being stopped, see `engine history %s %s`\n", id, job.Namespace, job.Service, job.Version, job.Service, job.Namespace)
+	}
+	return nil
+}
+
+// ENGINE_URL, else the daemon's own HTTP_ADDR on this host
+func engineURL() string {
+	if u := os.Getenv("ENGINE_URL"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	addr := httpAddr()
+	if addr == "" {
+		return ""
+	}
+	if strings.HasPrefix(addr, ":") {
+		return "http://localhost" + addr
+	}
+	return "http://" + addr
+}
+
+func (c *cli) depFile(serviceName string, namespace string) string {
+	return filepath.Join(c.depsPath, serviceName+"_"+namespace+".dep")
+}
+
+// writes the .dep for the daemon and follows the history until the outcome
+func (c *cli) submit(serviceName string, namespace string, depFile string, content string, wait time.Duration) error {
+
+	if _, err := parseDepSpec(content); err != nil {
+		return err
+	}
+
+	current, err := c.store.lastGood(serviceName, namespace)
+	if err != nil {
+		return err
+	}
+	if current == content {
+		fmt.Fprintf(c.out, "✅ %s/%s already runs %s\n", namespace, serviceName, shortSpec(content))
+		return nil
+	}
+
+	// anything newer than this is ours
+	since := int64(0)
+	if records, err := c.store.history(historyFilter{Service: serviceName, Namespace: namespace, Limit: 1}); err == nil && len(records) > 0 {
+		since = records[0].ID
+	}
+
+	if err := writeDepFile(depFile, content); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "📝 wrote %s\n", filepath.Base(depFile))
+
+	if wait == 0 {
+		return nil
+	}
+
+	rec, err := c.waitForOutcome(serviceName, namespace, since, wait)
+	if err != nil {
+		return err
+	}
+
+	if rec.Outcome != OutcomeSucceeded {
+		return fmt.Errorf("deployment #%d %s: %s", rec.ID, rec.Outcome, firstLine(rec.Error))
+	}
+	fmt.Fprintf(c.out, "✅ deployment #%d succeeded: %s\n", rec.ID, dash(rec.NewImage))
+	return nil
+}
+
+// first attempt after `since` that is no longer running
+func (c *cli) waitForOutcome(serviceName string, namespace string, since int64, wait time.Duration) (deploymentRecord, error) {
+
+	deadline := time.Now().Add(wait)
+	announced := false
+
+	for {
+		records, err := c.store.history(historyFilter{Service: serviceName, Namespace: namespace, Limit: 1})
+		if err != nil {
+			return deploymentRecord{}, err
+		}
+
+		if len(records) > 0 && records[0].ID > since {
+			rec := records[0]
+			if rec.Outcome != OutcomeRunning {
+				// a failed attempt may come back, its job says whether it does
+				job := c.jobOf(rec)
+				switch job.State {
+				case JobRunning:
+					// the daemon has not decided yet
+				case JobRetrying:
+					fmt.Fprintf(c.out, "🔁 deployment #%d %s, retry scheduled at %s\n", rec.ID, rec.Outcome, job.RetryAt.Local().Format(time.TimeOnly))
+					since, announced = rec.ID, false
+					deadline = time.Now().Add(wait + time.Until(job.RetryAt))
+					continue
+				default:
+					return rec, nil
+				}
+			}
+			if !announced {
+				fmt.Fprintf(c.out, "🚀 deployment #%d started, waiting for the rollout\n", rec.ID)
+				announced = true
+			}
+		}
+
+		if time.Now().After(deadline) {
+			if !announced {
+				return deploymentRecord{}, fmt.Errorf("no deployment started within %s, is the daemon running and watching %s? (approvals also wait here)", wait, c.depsPath)
+			}
+			return deploymentRecord{}, fmt.Errorf("still running after %s, follow it with `engine history %s %s`", wait, serviceName, namespace)
+		}
+		time.Sleep(c.pollInterval)
+	}
+}
+
+// the queued job behind a finished attempt, empty for direct runs and rows
+// the queue dropped
+func (c *cli) jobOf(rec deploymentRecord) jobState {
+	if rec.JobID == "" || rec.Outcome == OutcomeSucceeded {
+		return jobState{}
+	}
+	q, ok, err := c.store.jobByID(rec.JobID)
+	if err != nil || !ok {
+		return jobState{}
+	}
+	return q.state
+}
+
+// replaces the version of an existing .dep, keeping the rest of a yaml spec
+func withVersion(current string, version string) (string, error) {
+
+	spec, err := parseDepSpec(version)
+	if err != nil || spec.Version != strings.TrimSpace(version) {
+		return "", fmt.Errorf("invalid version %q", version)
+	}
+	version = spec.Version
+
+	current = strings.TrimSpace(current)
+	if current == "" || !strings.ContainsAny(current, " \t\r\n{") {
+		return version, nil
+	}
+
+	spec, err = parseDepSpec(current)
+	if err != nil {
+		return "", fmt.Errorf("current .dep is invalid, fix it by hand: %w", err)
+	}
+	if spec.Version == "" {
+		return "", errors.New("current .dep only pins containers by name, edit it by hand")
+	}
+	spec.Version = version
+
+	out, err := yaml.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	// the daemon trims what it reads, same here so the store compares equal
+	return strings.TrimSpace(string(out)), nil
+}
+
+// tmp + rename so the watcher never reads a half written file
+func writeDepFile(depFile string, content string) error {
+
+	tmp := filepath.Join(filepath.Dir(depFile), "."+filepath.Base(depFile)+".tmp")
+	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, depFile); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// one line form of a .dep for tables
+func shortSpec(content string) string {
+	if content == "" {
+		return ""
+	}
+	spec, err := parseDepSpec(content)
+	if err != nil {
+		return "invalid .dep"
+	}
+	return spec.String()
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func ago(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testCLI(t *testing.T, d *Daemon) (*cli, *bytes.Buffer) {
+	t.Helper()
+	out := &bytes.Buffer{}
+	return &cli{out: out, depsPath: d.opts.DepsPath, store: d.store, pollInterval: 10 * time.Millisecond}, out
+}
+
+// stands in for the watcher: once the .dep changes it runs the normal job
+func watchOnce(t *testing.T, d *Daemon, depFile string, before string) {
+	t.Helper()
+	go func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if version := readFile(depFile); version != before {
+				_, namespace, _ := extractServiceName(depFile)
+				d.DeployService(DeployService{service: depFile, version: version, namespace: namespace, trigger: TriggerWatch})
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+}
+
+func TestParseArgs(t *testing.T) {
+	fs := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	to := fs.String("to", "", "")
+
+	positional, err := parseArgs(fs, []string{"nginx-app", "--to", "1.0.0", "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(positional, []string{"nginx-app", "default"}) || *to != "1.0.0" {
+		t.Errorf("got %v to=%s", positional, *to)
+	}
+}
+
+func TestWithVersion(t *testing.T) {
+	if got, err := withVersion("1.0.0", "1.1.0"); err != nil || got != "1.1.0" {
+		t.Errorf("plain: %q %v", got, err)
+	}
+	if got, err := withVersion("", "1.1.0"); err != nil || got != "1.1.0" {
+		t.Errorf("new service: %q %v", got, err)
+	}
+
+	// yaml spec keeps everything but the version
+	got, err := withVersion("version: 1.0.0\nkind: StatefulSet\nreplicas: 3\nenv:\n  LOG_LEVEL: debug", "1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := parseDepSpec(got)
+	if err != nil || spec.Version != "1.1.0" || spec.Kind != "StatefulSet" || *spec.Replicas != 3 || spec.Env["LOG_LEVEL"] != "debug" {
+		t.Errorf("spec not preserved: %q %v", got, err)
+	}
+
+	if _, err := withVersion("1.0.0", "1.1.0 --force"); err == nil {
+		t.Errorf("version with spaces accepted")
+	}
+}
+
+func TestCLIDeployGoesThroughDaemon(t *testing.T) {
+	d, client := newTestDaemon(t,
+		testNamespace("default"),
+		testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1),
+	)
+	c, out := testCLI(t, d)
+
+	depFile := filepath.Join(d.opts.DepsPath, "nginx-app_default.dep")
+	os.WriteFile(depFile, []byte("1.0.0"), 0644)
+	d.store.setLastGood("nginx-app", "default", "1.0.0", "test.ecr.local/app:1.0.0", 0)
+	watchOnce(t, d, depFile, "1.0.0")
+
+	if err := c.deploy([]string{"nginx-app", "default", "1.1.0", "--wait", "5s"}); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	dep, _ := client.AppsV1().Deployments("default").Get(context.TODO(), "nginx-app", metav1.GetOptions{})
+	if image := dep.Spec.Template.Spec.Containers[0].Image; image != "test.ecr.local/app:1.1.0" {
+		t.Errorf("not deployed: %s", image)
+	}
+	if !strings.Contains(out.String(), "succeeded: test.ecr.local/app:1.1.0") {
+		t.Errorf("outcome not reported:\n%s", out)
+	}
+
+	// deploying what already runs is a no-op
+	out.Reset()
+	if err := c.deploy([]string{"nginx-app", "default", "1.1.0"}); err != nil || !strings.Contains(out.String(), "already runs") {
+		t.Errorf("expected no-op, got %v\n%s", err, out)
+	}
+}
+
+func TestCLIDeployWithoutDaemon(t *testing.T) {
+	d, _ := newTestDaemon(t)
+	c, _ := testCLI(t, d)
+
+	err := c.deploy([]string{"nginx-app", "default", "1.1.0", "--wait", "50ms"})
+	if err == nil || !strings.Contains(err.Error(), "is the daemon running") {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	// the .dep is still written, a daemon started later deploys it
+	if version := readFile(filepath.Join(d.opts.DepsPath, "nginx-app_default.dep")); version != "1.1.0" {
+		t.Errorf(".dep not written: %q", version)
+	}
+}
+
+func TestCLIRollbackRestoresPreviousSpec(t *testing.T) {
+	d, _ := newTestDaemon(t)
+	c, out := testCLI(t, d)
+
+	previous := "version: 1.0.0\nreplicas: 2"
+	for _, spec := range []string{previous, "1.1.0", "1.2.0"} {
+		rec := &deploymentRecord{Service: "nginx-app", Namespace: "default", Spec: spec, Version: shortSpec(spec)}
+		d.store.begin(rec)
+		rec.Outcome = OutcomeSucceeded
+		if spec == "1.1.0" {
+			rec.Outcome = OutcomeFailed
+		}
+		d.store.finish(rec)
+	}
+	d.store.setLastGood("nginx-app", "default", "1.2.0", "", 0)
+
+	if err := c.rollback([]string{"nginx-app", "default", "--wait", "0"}); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	// 1.1.0 failed, the whole 1.0.0 spec comes back
+	if content := readFile(filepath.Join(d.opts.DepsPath, "nginx-app_default.dep")); content != previous {
+		t.Errorf("expected the 1.0.0 spec, got %q", content)
+	}
+
+	if err := c.rollback([]string{"nginx-app", "default", "--to", "1.1.0"}); err == nil {
+		t.Errorf("rolled back to a version that never succeeded")
+	}
+}
+
+func TestCLIStatusAndHistory(t *testing.T) {
+	d, _ := newTestDaemon(t)
+	c, out := testCLI(t, d)
+
+	rec := &deploymentRecord{Service: "nginx-app", Namespace: "default", Spec: "1.0.0", Version: "1.0.0", Trigger: TriggerWatch}
+	d.store.begin(rec)
+	rec.Outcome, rec.NewImage = OutcomeSucceeded, "test.ecr.local/app:1.0.0"
+	d.store.finish(rec)
+	d.store.setLastGood("nginx-app", "default", "1.0.0", rec.NewImage, rec.ID)
+
+	failed := &deploymentRecord{Service: "api", Namespace: "prod", Spec: "2.0.0", Version: "2.0.0"}
+	d.store.begin(failed)
+	failed.Outcome, failed.Error = OutcomeFailed, "crash loop\nmore"
+	d.store.finish(failed)
+	os.WriteFile(filepath.Join(d.opts.DepsPath, "api_prod.dep"), []byte("2.0.0"), 0644)
+
+	if err := c.status(nil); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected header + 2 services:\n%s", out)
+	}
+	if !strings.Contains(lines[1], "nginx-app") || !strings.Contains(lines[1], "succeeded") {
+		t.Errorf("nginx-app row: %s", lines[1])
+	}
+	// never deployed, the .dep is still waiting
+	if !strings.Contains(lines[2], "api") || !strings.Contains(lines[2], "failed") || !strings.HasSuffix(lines[2], "2.0.0") {
+		t.Errorf("api row: %s", lines[2])
+	}
+
+	out.Reset()
+	c.history([]string{"api", "prod"})
+	if !strings.Contains(out.String(), "crash loop") || strings.Contains(out.String(), "more") {
+		t.Errorf("history:\n%s", out)
+	}
+}
+
+func TestRunCLIUnknownCommand(t *testing.T) {
+	out := &bytes.Buffer{}
+	if code := runCLI("deplyo", nil, out); code != 2 || !strings.Contains(out.String(), "usage") {
+		t.Errorf("expected usage and exit 2, got %d\n%s", code, out)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// per service knobs live in an optional yaml file pointed to by ENGINE_CONFIG
+//
+//	services:
+//	  nginx-app_default:      # {service}_{namespace}, same as the .dep name
+//	    driftPolicy: heal
+//	  postgres:
+//	    kind: StatefulSet     # Deployment (default), StatefulSet, DaemonSet, CronJob
+//	    rolloutTimeout: 15m   # replaces the default 4m wait
+//	  nginx-app:              # or just {service} for every namespace
+//	    driftPolicy: report
+//	    supersede: preempt    # a newer .dep stops the running rollout, default finish
+//	    retry:                # failed attempts, see retry.go
+//	      maxAttempts: 5
+//	      backoff: 30s
+//	      retryOn: [api, conflict, timeout]
+//	namespaces:
+//	  prod:
+//	    approval:             # deploys wait for an Approve click in slack
+//	      approvers: [U012ABCDEF, U034GHIJKL]   # slack user ids, empty = anyone
+//	      timeout: 30m                     # expires (and notifies) after this
+//	      channel: C0PRODAPPROVE           # default SLACK_CHANNEL
+type EngineConfig struct {
+	Services   map[string]ServiceConfig   `json:"services"`
+	Namespaces map[string]NamespaceConfig `json:"namespaces"`
+}
+
+type NamespaceConfig struct {
+	// set -> every deploy into the namespace needs an approval first
+	Approval *ApprovalPolicy `json:"approval"`
+}
+
+type ApprovalPolicy struct {
+	Approvers []string         `json:"approvers"`
+	Timeout   *metav1.Duration `json:"timeout"`
+	Channel   string           `json:"channel"`
+}
+
+type ServiceConfig struct {
+	// what the periodic reconciler does when the live image drifted
+	// "heal" re-applies the .dep version, "report" only notifies
+	DriftPolicy string `json:"driftPolicy"`
+	// workload kind to update, a `kind:` in the .dep itself wins over this
+	Kind string `json:"kind"`
+	// how long to wait for the rollout, e.g. "15m"
+	RolloutTimeout *metav1.Duration `json:"rolloutTimeout"`
+	// what a newer version does to a rollout still running
+	// "finish" lets it complete first, "preempt" cancels it
+	Supersede string `json:"supersede"`
+	// which failures are tried again, how often and how far apart
+	Retry *RetryPolicy `json:"retry"`
+}
+
+const (
+	DriftPolicyHeal   = "heal"
+	DriftPolicyReport = "report"
+
+	SupersedeFinish  = "finish"
+	SupersedePreempt = "preempt"
+)
+
+func loadConfig() (*EngineConfig, error) {
+
+	cfg := &EngineConfig{Services: map[string]ServiceConfig{}}
+
+	path := os.Getenv("ENGINE_CONFIG")
+	if path == "" {
+		return cfg, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read engine config %s: %w", path, err)
+	}
+
+	if err := yaml.Unmarshal(content, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse engine config %s: %w", path, err)
+	}
+
+	for name, svc := range cfg.Services {
+		switch svc.DriftPolicy {
+		case "", DriftPolicyHeal, DriftPolicyReport:
+		default:
+			return nil, fmt.Errorf("service %s: unknown driftPolicy %q", name, svc.DriftPolicy)
+		}
+		switch svc.Supersede {
+		case "", SupersedeFinish, SupersedePreempt:
+		default:
+			return nil, fmt.Errorf("service %s: unknown supersede policy %q", name, svc.Supersede)
+		}
+		if svc.Retry != nil {
+			if err := svc.Retry.validate(); err != nil {
+				return nil, fmt.Errorf("service %s: %w", name, err)
+			}
+		}
+		if _, err := normalizeKind(svc.Kind); err != nil {
+			return nil, fmt.Errorf("service %s: %w", name, err)
+		}
+	}
+
+	for name, ns := range cfg.Namespaces {
+		if ns.Approval != nil && ns.Approval.Timeout != nil && ns.Approval.Timeout.Duration <= 0 {
+			return nil, fmt.Errorf("namespace %s: approval timeout must be positive", name)
+		}
+	}
+
+	log.Printf("📄 Loaded engine config %s (%d services, %d namespaces)", path, len(cfg.Services), len(cfg.Namespaces))
+	return cfg, nil
+}
+
+// most specific entry wins: {service}_{namespace} -> {service} -> defaults
+func (c *EngineConfig) service(serviceName string, namespace string) ServiceConfig {
+
+	svc, ok := c.Services[serviceName+"_"+namespace]
+	if !ok {
+		svc = c.Services[serviceName]
+	}
+
+	if svc.DriftPolicy == "" {
+		svc.DriftPolicy = getDriftPolicy()
+	}
+	if svc.Supersede == "" {
+		svc.Supersede = getSupersedePolicy()
+	}
+	svc.Retry = svc.Retry.withDefaults()
+	return svc
+}
+
+// nil when deploys into namespace need no approval
+func (c *EngineConfig) approval(namespace string) *ApprovalPolicy {
+	return c.Namespaces[namespace].Approval
+}
+
+func getDriftPolicy() string {
+	policy := os.Getenv("DRIFT_POLICY")
+
+	if policy != DriftPolicyHeal {
+		return DriftPolicyReport
+	}
+	return policy
+}
+
+// SUPERSEDE_POLICY, finish unless it says preempt
+func getSupersedePolicy() string {
+	if os.Getenv("SUPERSEDE_POLICY") == SupersedePreempt {
+		return SupersedePreempt
+	}
+	return SupersedeFinish
+}
+
+// how often the drift reconciler runs, DRIFT_INTERVAL=0 turns it off
+func getDriftInterval() time.Duration {
+	value := os.Getenv("DRIFT_INTERVAL")
+
+	if value == "" {
+		return 5 * time.Minute
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("⚠️ Invalid DRIFT_INTERVAL %q, using 5m", value)
+		return 5 * time.Minute
+	}
+	return interval
+}
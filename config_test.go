@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writes content as the ENGINE_CONFIG of this test
+func withConfig(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "engine.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ENGINE_CONFIG", path)
+}
+
+func TestLoadConfig(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"valid", `
+services:
+  nginx-app_default:
+    driftPolicy: heal
+  postgres:
+    kind: StatefulSet
+    rolloutTimeout: 15m
+  nginx-app:
+    driftPolicy: report
+    supersede: preempt
+    retry:
+      maxAttempts: 5
+      backoff: 30s
+      retryOn: [api, conflict, timeout]
+namespaces:
+  prod:
+    approval:
+      approvers: [U012ABCDEF]
+      timeout: 30m
+`, ""},
+		{"drift policy", "services:\n  app:\n    driftPolicy: ignore\n", `unknown driftPolicy "ignore"`},
+		{"supersede", "services:\n  app:\n    supersede: always\n", `unknown supersede policy "always"`},
+		{"kind", "services:\n  app:\n    kind: ReplicaSet\n", "service app:"},
+		{"approval timeout", "namespaces:\n  prod:\n    approval:\n      timeout: -1m\n", "approval timeout must be positive"},
+		{"retry attempts", "services:\n  app:\n    retry:\n      maxAttempts: -1\n", "maxAttempts can not be negative"},
+		{"retry backoff", "services:\n  app:\n    retry:\n      backoff: 0s\n", "backoff must be positive"},
+		{"retry class", "services:\n  app:\n    retry:\n      retryOn: [flaky]\n", `unknown retryOn class "flaky"`},
+		{"not yaml", "services: [", "failed to parse engine config"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, tt.content)
+
+			cfg, err := loadConfig()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(cfg.Services) != 3 || cfg.approval("prod") == nil {
+					t.Errorf("config not loaded: %+v", cfg)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigWithoutFile(t *testing.T) {
+	t.Setenv("ENGINE_CONFIG", "")
+
+	cfg, err := loadConfig()
+	if err != nil || cfg.Services == nil {
+		t.Fatalf("expected an empty config, got %+v, %v", cfg, err)
+	}
+
+	t.Setenv("ENGINE_CONFIG", filepath.Join(t.TempDir(), "missing.yaml"))
+	if _, err := loadConfig(); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+// {service}_{namespace} -> {service} -> env defaults
+func TestServiceConfigDefaults(t *testing.T) {
+	t.Setenv("DRIFT_POLICY", "")
+	t.Setenv("SUPERSEDE_POLICY", "")
+	t.Setenv("RETRY_MAX_ATTEMPTS", "4")
+	t.Setenv("RETRY_BACKOFF", "")
+	t.Setenv("RETRY_MAX_BACKOFF", "")
+	withConfig(t, `
+services:
+  nginx-app_prod:
+    driftPolicy: heal
+  nginx-app:
+    supersede: preempt
+    retry:
+      maxAttempts: 2
+      retryOn: [image]
+`)
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		service, namespace string
+		drift, supersede   string
+		attempts           int
+		retryOn            string
+	}{
+		// the namespaced entry wins, and does not inherit from the plain one
+		{"nginx-app", "prod", DriftPolicyHeal, SupersedeFinish, 4, "api,conflict,timeout"},
+		{"nginx-app", "default", DriftPolicyReport, SupersedePreempt, 2, "image"},
+		{"postgres", "default", DriftPolicyReport, SupersedeFinish, 4, "api,conflict,timeout"},
+	}
+
+	for _, tt := range tests {
+		svc := cfg.service(tt.service, tt.namespace)
+		if svc.DriftPolicy != tt.drift || svc.Supersede != tt.supersede {
+			t.Errorf("%s/%s: drift %s, supersede %s", tt.namespace, tt.service, svc.DriftPolicy, svc.Supersede)
+		}
+		if svc.Retry.MaxAttempts != tt.attempts || strings.Join(svc.Retry.RetryOn, ",") != tt.retryOn {
+			t.Errorf("%s/%s: retry %+v", tt.namespace, tt.service, svc.Retry)
+		}
+		if svc.Retry.Backoff.Duration != 30*time.Second || svc.Retry.MaxBackoff.Duration != 10*time.Minute {
+			t.Errorf("%s/%s: backoff %s, max %s", tt.namespace, tt.service, svc.Retry.Backoff, svc.Retry.MaxBackoff)
+		}
+	}
+}
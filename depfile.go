@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ .dep FORMAT @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ a .dep file is either the old plain version string
+
+	1.24.3
+
+ or a yaml/json document (detected by content: plain versions never contain
+ whitespace or start with '{')
+
+	version: 1.24.3              # first container, same as the plain format
+	kind: StatefulSet            # Deployment (default), StatefulSet, DaemonSet, CronJob
+	registry: my.registry/app    # overrides ECR_REPO
+	replicas: 3
+	env:                         # env changes on the first container
+	  LOG_LEVEL: debug
+	containers:                  # per container, matched by name
+	  - name: envoy
+	    image: envoyproxy/envoy:v1.29.0   # full image, used as is
+	  - name: worker
+	    version: 1.24.3                   # registry:version
+	initContainers:
+	  - name: migrate
+	    version: 1.24.3
+	annotations:                 # free form, lands on the workload metadata
+	  commit: 3f9c2ab
+	  triggeredBy: alice
+*/
+
+type DepSpec struct {
+	Version        string            `json:"version,omitempty"`
+	Kind           string            `json:"kind,omitempty"`
+	Registry       string            `json:"registry,omitempty"`
+	Replicas       *int32            `json:"replicas,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	Containers     []ContainerSpec   `json:"containers,omitempty"`
+	InitContainers []ContainerSpec   `json:"initContainers,omitempty"`
+	Annotations    map[string]string `json:"annotations,omitempty"`
+}
+
+type ContainerSpec struct {
+	Name    string            `json:"name"`
+	Version string            `json:"version,omitempty"`
+	Image   string            `json:"image,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+}
+
+func parseDepSpec(content string) (DepSpec, error) {
+
+	content = strings.TrimSpace(content)
+
+	if content == "" {
+		return DepSpec{}, fmt.Errorf("empty .dep file")
+	}
+
+	// plain version, the format every existing .dep uses
+	if !strings.ContainsAny(content, " \t\r\n{") {
+		return DepSpec{Version: content}, nil
+	}
+
+	var spec DepSpec
+	if err := yaml.UnmarshalStrict([]byte(content), &spec); err != nil {
+		return DepSpec{}, fmt.Errorf("invalid .dep content: %w", err)
+	}
+
+	if _, err := normalizeKind(spec.Kind); err != nil {
+		return DepSpec{}, fmt.Errorf("invalid .dep content: %w", err)
+	}
+
+	if spec.Version == "" && len(spec.Containers) == 0 && len(spec.InitContainers) == 0 {
+		return DepSpec{}, fmt.Errorf("invalid .dep content: needs a version or containers")
+	}
+
+	for _, c := range append(append([]ContainerSpec{}, spec.Containers...), spec.InitContainers...) {
+		if c.Name == "" {
+			return DepSpec{}, fmt.Errorf("invalid .dep content: container without a name")
+		}
+		if c.Version == "" && c.Image == "" {
+			return DepSpec{}, fmt.Errorf("invalid .dep content: container %s needs a version or image", c.Name)
+		}
+	}
+
+	return spec, nil
+}
+
+// short human readable version for logs and notifications
+func (s DepSpec) String() string {
+
+	parts := []string{}
+	if s.Version != "" {
+		parts = append(parts, s.Version)
+	}
+	for _, c := range append(append([]ContainerSpec{}, s.Containers...), s.InitContainers...) {
+		v := c.Version
+		if c.Image != "" {
+			v = c.Image
+		}
+		parts = append(parts, c.Name+"="+v)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// annotations as "key:value" lines for the notification details
+func (s DepSpec) details() string {
+
+	keys := make([]string, 0, len(s.Annotations))
+	for k := range s.Annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\n%s:%s", k, s.Annotations[k])
+	}
+	return b.String()
+}
+
+// full image for a version, spec registry first then ECR_REPO
+func (s DepSpec) image(version string) (string, error) {
+	if s.Registry != "" {
+		return fmt.Sprintf("%s:%s", s.Registry, version), nil
+	}
+	return buildImage(version)
+}
+
+func (s DepSpec) containerImage(c ContainerSpec) (string, error) {
+	if c.Image != "" {
+		return c.Image, nil
+	}
+	return s.image(c.Version)
+}
+
+// applies images, env and replicas to a pod template
+// returns one "name: old → new" line per changed image for the logs
+func (s DepSpec) apply(template *corev1.PodTemplateSpec) ([]string, error) {
+
+	podSpec := &template.Spec
+	if len(podSpec.Containers) == 0 {
+		return nil, fmt.Errorf("no containers found in pod template")
+	}
+
+	changes := []string{}
+
+	setImage := func(c *corev1.Container, image string) {
+		if c.Image != image {
+			changes = append(changes, fmt.Sprintf("%s: %s → %s", c.Name, c.Image, image))
+			c.Image = image
+		}
+	}
+
+	if s.Version != "" {
+		image, err := s.image(s.Version)
+		if err != nil {
+			return nil, err
+		}
+		setImage(&podSpec.Containers[0], image)
+	}
+	setEnv(&podSpec.Containers[0], s.Env)
+
+	for _, want := range s.Containers {
+		c := findContainer(podSpec.Containers, want.Name)
+		if c == nil {
+			return nil, fmt.Errorf("container %s not found", want.Name)
+		}
+		image, err := s.containerImage(want)
+		if err != nil {
+			return nil, err
+		}
+		setImage(c, image)
+		setEnv(c, want.Env)
+	}
+
+	for _, want := range s.InitContainers {
+		c := findContainer(podSpec.InitContainers, want.Name)
+		if c == nil {
+			return nil, fmt.Errorf("init container %s not found", want.Name)
+		}
+		image, err := s.containerImage(want)
+		if err != nil {
+			return nil, err
+		}
+		setImage(c, image)
+		setEnv(c, want.Env)
+	}
+
+	return changes, nil
+}
+
+// first container whose live image is not what the spec asks for
+// returns live, desired and "" when everything matches
+func (s DepSpec) drift(podSpec corev1.PodSpec) (string, string, error) {
+
+	if len(podSpec.Containers) == 0 {
+		return "", "", fmt.Errorf("no containers found in pod template")
+	}
+
+	if s.Version != "" {
+		desired, err := s.image(s.Version)
+		if err != nil {
+			return "", "", err
+		}
+		if live := podSpec.Containers[0].Image; live != desired {
+			return live, desired, nil
+		}
+	}
+
+	check := func(live []corev1.Container, wanted []ContainerSpec) (string, string, error) {
+		for _, want := range wanted {
+			desired, err := s.containerImage(want)
+			if err != nil {
+				return "", "", err
+			}
+			c := findContainer(live, want.Name)
+			if c == nil {
+				return "", "", fmt.Errorf("container %s not found", want.Name)
+			}
+			if c.Image != desired {
+				return c.Image, desired, nil
+			}
+		}
+		return "", "", nil
+	}
+
+	live, desired, err := check(podSpec.Containers, s.Containers)
+	if err != nil || live != "" {
+		return live, desired, err
+	}
+	return check(podSpec.InitContainers, s.InitContainers)
+}
+
+func findContainer(containers []corev1.Container, name string) *corev1.Container {
+	for i := range containers {
+		if containers[i].Name == name {
+			return &containers[i]
+		}
+	}
+	return nil
+}
+
+func setEnv(c *corev1.Container, env map[string]string) {
+
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	// stable order, otherwise every apply looks like a template change
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		found := false
+		for i := range c.Env {
+			if c.Env[i].Name == k {
+				c.Env[i].Value = env[k]
+				c.Env[i].ValueFrom = nil
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.Env = append(c.Env, corev1.EnvVar{Name: k, Value: env[k]})
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestParseDepSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{"plain version", "1.24.3\n", "1.24.3", false},
+		{"plain image with tag", "nginx:1.24.3", "nginx:1.24.3", false},
+		{"yaml", "version: 1.24.3\ncontainers:\n  - name: envoy\n    image: envoy:v1.29\n", "1.24.3, envoy=envoy:v1.29", false},
+		{"json", `{"containers":[{"name":"worker","version":"2.0.0"}]}`, "worker=2.0.0", false},
+		{"yaml without version", "replicas: 3", "", true},
+		{"container without name", "containers:\n  - version: 1.0.0", "", true},
+		{"unknown field", "version: 1.0.0\nimgae: typo", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := parseDepSpec(tt.content)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spec.String() != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, spec.String())
+			}
+		})
+	}
+}
+
+func TestDepSpecApply(t *testing.T) {
+	t.Setenv("ECR_REPO", "test.ecr.local/app")
+
+	spec, err := parseDepSpec(`
+version: 1.1.0
+env:
+  LOG_LEVEL: debug
+containers:
+  - name: envoy
+    image: envoyproxy/envoy:v1.29.0
+initContainers:
+  - name: migrate
+    version: 1.1.0
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "migrate", Image: "test.ecr.local/app:1.0.0"}},
+		Containers: []corev1.Container{
+			{Name: "app", Image: "test.ecr.local/app:1.0.0", Env: []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}}},
+			{Name: "envoy", Image: "envoyproxy/envoy:v1.28.0"},
+		},
+	}}
+
+	live, _, _ := spec.drift(template.Spec)
+	if live == "" {
+		t.Fatal("expected drift before apply")
+	}
+
+	changes, err := spec.apply(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Errorf("expected 3 image changes, got %v", changes)
+	}
+
+	pod := template.Spec
+	if pod.Containers[0].Image != "test.ecr.local/app:1.1.0" || pod.InitContainers[0].Image != "test.ecr.local/app:1.1.0" {
+		t.Errorf("app images not updated: %+v", pod)
+	}
+	if pod.Containers[1].Image != "envoyproxy/envoy:v1.29.0" {
+		t.Errorf("sidecar image not updated: %s", pod.Containers[1].Image)
+	}
+	if env := pod.Containers[0].Env; len(env) != 1 || env[0].Value != "debug" {
+		t.Errorf("env not updated: %+v", env)
+	}
+
+	if live, desired, err := spec.drift(pod); err != nil || live != "" {
+		t.Errorf("expected no drift after apply, got %s vs %s (%v)", live, desired, err)
+	}
+}
+
+func TestDepSpecUnknownContainer(t *testing.T) {
+	spec := DepSpec{Containers: []ContainerSpec{{Name: "ghost", Image: "busybox"}}}
+	template := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "app", Image: "busybox"}},
+	}}
+
+	if _, err := spec.apply(template); err == nil {
+		t.Fatal("expected an error for a container that does not exist")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ FAILURE DIAGNOSTICS @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ "crash loop: back-off restarting failed container" tells on-call nothing
+
+ when a rollout fails, before any rollback replaces the pods, we grab for the
+ failing pods of the new revision (at most diagMaxPods of them):
+ - exit code / reason of the last termination of every container
+ - the last DIAG_LOG_LINES lines of the previous container logs (current
+   logs when the container never restarted)
+ - the events of the pod and of the ReplicaSet / workload that owns it
+
+ the full text goes to {STATE_DIR}/reports/{service}_{namespace}_{time}.log,
+ a truncated copy rides along in the failure notification
+*/
+
+const (
+	diagMaxPods = 3
+	// slack cuts attachment text somewhere around 8000 chars
+	diagMaxNotifyChars = 2500
+)
+
+func getDiagLogLines() int64 {
+	lines, err := strconv.ParseInt(os.Getenv("DIAG_LOG_LINES"), 10, 64)
+	if err != nil || lines <= 0 {
+		return 20
+	}
+	return lines
+}
+
+// collects diagnostics and writes the report file, returns the text and the file path
+func (d *Daemon) reportFailure(ctx context.Context, serviceName string, namespace string, target workload, rolloutErr error) (string, string) {
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s %s/%s rollout failed at %s\n", target.kind(), namespace, serviceName, time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&b, "error: %v\n", rolloutErr)
+
+	if err := d.tracker.ensure(ctx, ""); err != nil {
+		fmt.Fprintf(&b, "\ncould not inspect pods: %v\n", err)
+	} else {
+		d.writePodDiagnostics(ctx, &b, namespace, target)
+	}
+
+	// events of the workload itself (FailedCreate, quota, ...)
+	d.writeEvents(ctx, &b, namespace, target.kind(), target.meta().Name)
+
+	text := b.String()
+
+	path, err := d.writeReport(serviceName, namespace, text)
+	if err != nil {
+		log.Printf("⚠️ Could not write failure report: %v", err)
+	} else {
+		log.Printf("📝 Failure report written to %s", path)
+	}
+	return text, path
+}
+
+func (d *Daemon) writePodDiagnostics(ctx context.Context, b *strings.Builder, namespace string, target workload) {
+
+	pods, err := d.tracker.pods(namespace, d.tracker.rolloutSelector(target))
+	if err != nil {
+		fmt.Fprintf(b, "\ncould not list pods: %v\n", err)
+		return
+	}
+
+	// most restarts first, those are the interesting ones
+	sort.Slice(pods, func(i, j int) bool { return restarts(pods[i]) > restarts(pods[j]) })
+
+	inspected := 0
+	owners := map[string]bool{}
+
+	for _, pod := range pods {
+		if inspected == diagMaxPods {
+			break
+		}
+		if !podFailing(pod) {
+			continue
+		}
+		inspected++
+
+		fmt.Fprintf(b, "\n=== pod %s (phase %s, node %s)\n", pod.Name, pod.Status.Phase, pod.Spec.NodeName)
+
+		for _, cs := range pod.Status.ContainerStatuses {
+			fmt.Fprintf(b, "--- container %s: %s (restarts %d)\n", cs.Name, containerState(cs), cs.RestartCount)
+			d.writeLogs(ctx, b, pod, cs)
+		}
+
+		d.writeEvents(ctx, b, namespace, "Pod", pod.Name)
+
+		if owner := metav1.GetControllerOf(pod); owner != nil && !owners[owner.Name] {
+			owners[owner.Name] = true
+			d.writeEvents(ctx, b, namespace, owner.Kind, owner.Name)
+		}
+	}
+
+	if inspected == 0 {
+		fmt.Fprintf(b, "\nno failing pods found for the new revision\n")
+	}
+}
+
+func (d *Daemon) writeLogs(ctx context.Context, b *strings.Builder, pod *corev1.Pod, cs corev1.ContainerStatus) {
+
+	lines := getDiagLogLines()
+	opts := &corev1.PodLogOptions{Container: cs.Name, TailLines: &lines, Previous: cs.RestartCount > 0}
+
+	stream, err := d.k8sClient.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, opts).Stream(ctx)
+	if err != nil && opts.Previous {
+		// previous instance already gone, current is better than nothing
+		opts.Previous = false
+		stream, err = d.k8sClient.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, opts).Stream(ctx)
+	}
+	if err != nil {
+		fmt.Fprintf(b, "(no logs: %v)\n", err)
+		return
+	}
+	defer stream.Close()
+
+	content, err := io.ReadAll(io.LimitReader(stream, 64*1024))
+	if err != nil {
+		fmt.Fprintf(b, "(log read failed: %v)\n", err)
+		return
+	}
+
+	which := "current"
+	if opts.Previous {
+		which = "previous"
+	}
+	fmt.Fprintf(b, "last %d lines (%s):\n%s\n", lines, which, strings.TrimRight(string(content), "\n"))
+}
+
+func (d *Daemon) writeEvents(ctx context.Context, b *strings.Builder, namespace string, kind string, name string) {
+
+	selector := fields.Set{"involvedObject.kind": kind, "involvedObject.name": name}.AsSelector().String()
+
+	events, err := d.k8sClient.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{FieldSelector: selector})
+	if err != nil {
+		fmt.Fprintf(b, "(no events for %s %s: %v)\n", kind, name, err)
+		return
+	}
+
+	matched := []corev1.Event{}
+	for _, event := range events.Items {
+		// field selectors are best effort on some clients, double check
+		if event.InvolvedObject.Kind == kind && event.InvolvedObject.Name == name {
+			matched = append(matched, event)
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+
+	sort.Slice(matched, func(i, j int) bool { return eventTime(matched[i]).Before(eventTime(matched[j])) })
+
+	fmt.Fprintf(b, "events of %s %s:\n", kind, name)
+	for _, event := range matched {
+		fmt.Fprintf(b, "  %s %s (x%d): %s\n", event.Type, event.Reason, max(event.Count, 1), strings.TrimSpace(event.Message))
+	}
+}
+
+func (d *Daemon) writeReport(serviceName string, namespace string, text string) (string, error) {
+
+	dir := filepath.Join(d.opts.StateDir, "reports")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s_%s_%s.log", serviceName, namespace, time.Now().Format("20060102-150405"))
+	path := filepath.Join(dir, name)
+
+	return path, os.WriteFile(path, []byte(text), 0644)
+}
+
+func podFailing(pod *corev1.Pod) bool {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if !cs.Ready || cs.RestartCount > 0 {
+			return true
+		}
+	}
+	return pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodPending
+}
+
+func restarts(pod *corev1.Pod) int32 {
+	total := int32(0)
+	for _, cs := range pod.Status.ContainerStatuses {
+		total += cs.RestartCount
+	}
+	return total
+}
+
+// "waiting CrashLoopBackOff, last exit 1 (Error)"
+func containerState(cs corev1.ContainerStatus) string {
+
+	state := "running"
+	switch {
+	case cs.State.Waiting != nil:
+		state = "waiting " + cs.State.Waiting.Reason
+	case cs.State.Terminated != nil:
+		state = fmt.Sprintf("terminated exit %d (%s)", cs.State.Terminated.ExitCode, cs.State.Terminated.Reason)
+	}
+
+	if last := cs.LastTerminationState.Terminated; last != nil {
+		state += fmt.Sprintf(", last exit %d (%s)", last.ExitCode, last.Reason)
+	}
+	return state
+}
+
+func eventTime(event corev1.Event) time.Time {
+	if !event.LastTimestamp.IsZero() {
+		return event.LastTimestamp.Time
+	}
+	if !event.EventTime.IsZero() {
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
+
+// keeps the head, the pod with the most restarts comes first
+func truncateForNotify(text string) string {
+	if len(text) <= diagMaxNotifyChars {
+		return text
+	}
+	return strings.ToValidUTF8(text[:diagMaxNotifyChars], "") + "\n… (see the report file)"
+}
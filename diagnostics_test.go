@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDeployTok8sFailureReport(t *testing.T) {
+	pod := testPod("nginx-app-abc", "default", "nginx-app", corev1.ContainerState{
+		Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff", Message: "back-off restarting failed container"},
+	})
+	pod.Status.ContainerStatuses[0].RestartCount = 4
+	pod.Status.ContainerStatuses[0].LastTerminationState = corev1.ContainerState{
+		Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Reason: "Error"},
+	}
+
+	event := &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "nginx-app-abc.1", Namespace: "default"},
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "nginx-app-abc", Namespace: "default"},
+		Type:           corev1.EventTypeWarning,
+		Reason:         "BackOff",
+		Message:        "Back-off restarting failed container",
+		Count:          7,
+	}
+
+	d, _ := newTestDaemon(t,
+		testNamespace("default"),
+		unhealthy(testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1)),
+		pod,
+		event,
+	)
+
+	result, err := d.DeployTok8s(context.TODO(), "nginx-app", DepSpec{Version: "1.1.0"}, "default")
+	if err == nil {
+		t.Fatal("expected rollout failure")
+	}
+	if result.Report == "" {
+		t.Fatal("expected a report file")
+	}
+
+	content, err := os.ReadFile(result.Report)
+	if err != nil {
+		t.Fatalf("report not written: %v", err)
+	}
+
+	for _, want := range []string{
+		"=== pod nginx-app-abc",
+		"waiting CrashLoopBackOff, last exit 1 (Error)",
+		"fake logs", // the fake clientset answers every log request with this
+		"(previous)",
+		"Warning BackOff (x7): Back-off restarting failed container",
+	} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("report missing %q:\n%s", want, content)
+		}
+	}
+	if result.Diagnostics != string(content) {
+		t.Errorf("diagnostics and report file differ")
+	}
+	if !strings.Contains(result.details(), "report:"+result.Report) {
+		t.Errorf("details missing report path: %q", result.details())
+	}
+}
+
+func TestTruncateForNotify(t *testing.T) {
+	if got := truncateForNotify("short"); got != "short" {
+		t.Errorf("short text changed: %q", got)
+	}
+
+	got := truncateForNotify(strings.Repeat("x", diagMaxNotifyChars*2))
+	if !strings.HasPrefix(got, strings.Repeat("x", diagMaxNotifyChars)) || !strings.HasSuffix(got, "(see the report file)") {
+		t.Errorf("unexpected truncation: %q", got[len(got)-40:])
+	}
+}
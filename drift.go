@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ DRIFT RECONCILER @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ DeployService only compares .dep with the last good version, so a manual
+ `kubectl set image` goes unnoticed forever
+
+ every DRIFT_INTERVAL the live image of each service is compared with the
+ image the .dep asks for (same ECR_REPO:version DeployTok8s builds)
+ heal   -> forced job, the .dep version gets re-applied
+ report -> slack message, sent once per drifted image so we dont spam
+
+ services whose .dep != last good are skipped, a deploy is pending/failed there
+ and that is not drift
+*/
+
+func (d *Daemon) watchDrift() {
+
+	interval := getDriftInterval()
+	if interval <= 0 {
+		log.Printf("⏸️  Drift reconciler disabled")
+		return
+	}
+
+	path := d.opts.DepsPath
+
+	log.Printf("🔭 Drift reconciler running every %v", interval)
+
+	// {depFile} -> live image we already reported
+	reported := make(map[string]string)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.checkDrift(d.drain.stopping, path, reported)
+		case <-d.drain.stopping.Done():
+			return
+		}
+	}
+}
+
+func (d *Daemon) checkDrift(ctx context.Context, path string, reported map[string]string) {
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		log.Printf("⚠️ Drift reconciler could not read %s: %v", path, err)
+		return
+	}
+
+	for _, entry := range entries {
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".dep") {
+			continue
+		}
+
+		depFile := filepath.Join(path, entry.Name())
+
+		serviceName, namespace, err := extractServiceName(depFile)
+		if err != nil {
+			continue
+		}
+
+		version := readFile(depFile)
+		if version == "" || version != d.lastGood(depFile, serviceName, namespace) {
+			continue
+		}
+
+		live, desired, err := d.compareLiveImage(ctx, serviceName, namespace, version)
+		if err != nil {
+			log.Printf("⚠️ [%s/%s] drift check failed: %v", namespace, serviceName, err)
+			continue
+		}
+
+		if live == desired {
+			delete(reported, depFile)
+			continue
+		}
+
+		policy := d.config.service(serviceName, namespace).DriftPolicy
+		log.Printf("🔀 [%s/%s] drift detected: live %s, expected %s (policy: %s)", namespace, serviceName, live, desired, policy)
+
+		if policy == DriftPolicyHeal {
+			// a full queue: the next check still sees the drift
+			if _, err := d.enqueue(DeployService{service: depFile, version: version, namespace: namespace, force: true, trigger: TriggerDrift}); err != nil {
+				log.Printf("⚠️ [%s/%s] could not queue the heal: %v", namespace, serviceName, err)
+			}
+			continue
+		}
+
+		if reported[depFile] == live {
+			continue
+		}
+		reported[depFile] = live
+
+		d.notify(Notification{
+			Message: "Drift Detected",
+			Details: fmt.Sprintf(
+				"service:%s\nnamespace:%s\nexpected:%s\nlive:%s",
+				serviceName,
+				namespace,
+				desired,
+				live,
+			),
+			MessageType: MsgDriftDetected,
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// deployed 1.0.0, then `kubectl set image` to a hotfix
+func driftedDaemon(t *testing.T) (*Daemon, string) {
+	t.Helper()
+
+	d, client := newTestDaemon(t, testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1))
+	url, _ := captureServer(t, http.StatusOK)
+	d.outbox = newOutbox(t.TempDir(), []Notifier{newWebhookNotifier(url)})
+
+	depFile := filepath.Join(d.opts.DepsPath, "nginx-app_default.dep")
+	os.WriteFile(depFile, []byte("1.0.0"), 0644)
+	d.store.setLastGood("nginx-app", "default", "1.0.0", "test.ecr.local/app:1.0.0", 0)
+
+	dep, _ := client.AppsV1().Deployments("default").Get(context.TODO(), "nginx-app", metav1.GetOptions{})
+	dep.Spec.Template.Spec.Containers[0].Image = "test.ecr.local/app:hotfix"
+	client.AppsV1().Deployments("default").Update(context.TODO(), dep, metav1.UpdateOptions{})
+
+	return d, depFile
+}
+
+func TestDriftReportedOnce(t *testing.T) {
+
+	d, depFile := driftedDaemon(t)
+	d.config.Services["nginx-app"] = ServiceConfig{DriftPolicy: DriftPolicyReport}
+
+	reported := map[string]string{}
+	d.checkDrift(context.TODO(), d.opts.DepsPath, reported)
+	d.checkDrift(context.TODO(), d.opts.DepsPath, reported)
+
+	if n := d.outbox.pending(); n != 1 {
+		t.Errorf("expected 1 drift notification, got %d", n)
+	}
+	if reported[depFile] != "test.ecr.local/app:hotfix" {
+		t.Errorf("reported = %v", reported)
+	}
+	if n, _ := d.store.countJobs(QueuePending); n != 0 {
+		t.Errorf("report policy queued %d job(s)", n)
+	}
+}
+
+// a .dep that is not deployed yet is a pending deploy, not drift
+func TestDriftSkipsUndeployedDep(t *testing.T) {
+
+	d, depFile := driftedDaemon(t)
+	os.WriteFile(depFile, []byte("1.1.0"), 0644)
+
+	d.checkDrift(context.TODO(), d.opts.DepsPath, map[string]string{})
+
+	if n := d.outbox.pending(); n != 0 {
+		t.Errorf("expected no drift notification, got %d", n)
+	}
+}
+
+// the ticker loop heals on its own and stops with the daemon
+func TestWatchDriftHeals(t *testing.T) {
+
+	d, _ := driftedDaemon(t)
+	d.config.Services["nginx-app"] = ServiceConfig{DriftPolicy: DriftPolicyHeal}
+	t.Setenv("DRIFT_INTERVAL", "10ms")
+
+	done := make(chan struct{})
+	go func() {
+		d.watchDrift()
+		close(done)
+	}()
+
+	waitFor(t, "the heal to be queued", func() bool {
+		n, _ := d.store.countJobs(QueuePending)
+		return n > 0
+	})
+	d.Shutdown(0)
+	<-done
+
+	jobs, _ := d.store.pendingJobs()
+	if q := jobs[0]; !q.job.force || q.job.trigger != TriggerDrift || q.job.version != "1.0.0" {
+		t.Errorf("heal job: %+v", q.job)
+	}
+}
@@ -4,37 +4,28 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 // needs the to crete a clientset which needs a kubeconfig
 func Newk8sclient() (*kubernetes.Clientset, error) {
 
-	home, err := os.UserHomeDir()
-
+	config, source, err := kubeConfig()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get the home Dir")
-
-	}
-
-	// now get the k8s config file
-	kubeconfigPath := filepath.Join(home, ".kube", "config")
-
-	//loading the k8s config file
-
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
-
-	if err != nil {
-		return nil, fmt.Errorf("Failed to load the k8s config file")
+		return nil, err
 	}
+	log.Printf("☸️  Kubernetes config: %s", source)
 
 	// ///////////////////////////////////////
 	// ==== INCREASE RATE LIMITS ====
@@ -42,6 +33,11 @@ func Newk8sclient() (*kubernetes.Clientset, error) {
 	config.QPS = 50.0  //default 5
 	config.Burst = 100 // default 10
 
+	// counts every request, see tracker.go
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &countingTransport{next: rt}
+	})
+
 	//a collection of clients for k8s API groups ->CoreV1(),APPSV1(),BATCHV1()
 	//create a clientset-> a wrapper for k8sapi call + brings in
 	// http client + load certs + rate limits
@@ -53,6 +49,42 @@ func Newk8sclient() (*kubernetes.Clientset, error) {
 
 }
 
+// where the cluster config comes from, first match wins:
+//  1. KUBECONFIG (and KUBE_CONTEXT) set explicitly
+//  2. running in a Pod -> the service account (rest.InClusterConfig)
+//  3. ~/.kube/config, KUBE_CONTEXT or its current context
+func kubeConfig() (*rest.Config, string, error) {
+
+	explicit := os.Getenv("KUBECONFIG") != ""
+	kubeContext := os.Getenv("KUBE_CONTEXT")
+
+	if !explicit && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		config, err := rest.InClusterConfig()
+		if err == nil {
+			if kubeContext != "" {
+				log.Printf("⚠️ KUBE_CONTEXT=%s ignored in-cluster, set KUBECONFIG to use a kubeconfig", kubeContext)
+			}
+			return config, "in-cluster service account", nil
+		}
+		log.Printf("⚠️ In-cluster config failed, trying ~/.kube/config: %v", err)
+	}
+
+	// honours KUBECONFIG (a : separated list) and falls back to ~/.kube/config
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to load the k8s config file: %w", err)
+	}
+
+	source := "kubeconfig " + strings.Join(rules.GetLoadingPrecedence(), string(filepath.ListSeparator))
+	if kubeContext != "" {
+		source += ", context " + kubeContext
+	}
+	return config, source, nil
+}
+
 func getECR() (string, error) {
 	ecr := os.Getenv("ECR_REPO")
 
@@ -62,115 +94,213 @@ func getECR() (string, error) {
 	return ecr, nil
 }
 
-// complete file path | docker version | namespace
-func (d *Daemon) DeployTok8s(serviceName string, dockerImageVersion string, namespace string) error {
-
-	//1 get image name -> get deploys for ns + create a context -> get current dep -> update dep in spec
-	//  ->  apply -> health checks
-
-	//core k8s api's
-	// fmt.Printf(">>> WOULD DEPLOY: %s in namespace %s\n", dockerImageVersion, namespace)
+// the image a .dep version should end up as in the cluster, ECR_REPO:version
+func buildImage(dockerImageVersion string) (string, error) {
 
 	ecrRepo, err := getECR()
 
 	if err != nil {
-		log.Printf(" ECR REPO LINK ERROR in extractor.go \n ")
-		return err
+		return "", err
 	}
 
-	// fmt.Printf(">>> ECR REPO LINK IS %s", ecrRepo)
-
 	//!!!!!!!! note now since filename is changed we have to change image extraction
 
-	var fullImage string
-
 	if ecrRepo != "" {
-		fullImage = fmt.Sprintf("%s:%s", ecrRepo, dockerImageVersion)
-	} else {
-		fullImage = dockerImageVersion // Use as-is if no ECR
+		return fmt.Sprintf("%s:%s", ecrRepo, dockerImageVersion), nil
+	}
+	// Use as-is if no ECR
+	return dockerImageVersion, nil
+}
+
+// what DeployTok8s replaced, enough to put it back on failure
+type rollbackPoint struct {
+	Kind string
+	// first container image, for logs and notifications
+	Image    string
+	Template corev1.PodTemplateSpec
+}
+
+type deployResult struct {
+	// nil when nothing was applied or the template did not change
+	Rollback *rollbackPoint
+	// 409s we retried through while patching
+	Conflicts int
+	// what was patched, first container image before and after (history)
+	Kind     string
+	OldImage string
+	NewImage string
+	// pod logs/events of a failed rollout and the report file they were written to
+	Diagnostics string
+	Report      string
+}
+
+// extra "key:value" lines for the notification details
+func (r deployResult) details() string {
+	details := ""
+	if r.Conflicts > 0 {
+		details += fmt.Sprintf("\nconflicts retried:%d", r.Conflicts)
+	}
+	if r.Report != "" {
+		details += fmt.Sprintf("\nreport:%s", r.Report)
 	}
+	return details
+}
 
-	log.Printf(" Full image : %s", fullImage)
+// complete file path | .dep spec | namespace
+// result.Rollback holds the previous pod template, but only once the new one
+// has actually been applied, so callers know whether there is anything to roll back
+// ctx ends the whole thing (cancel, supersede, shutdown), see jobs.go
+func (d *Daemon) DeployTok8s(ctx context.Context, serviceName string, spec DepSpec, namespace string) (deployResult, error) {
+
+	//1 get image name -> get workload for ns + create a context -> get current workload -> update pod template
+	//  ->  apply -> health checks
+
+	//core k8s api's
+	// fmt.Printf(">>> WOULD DEPLOY: %s in namespace %s\n", dockerImageVersion, namespace)
+
+	kind, err := d.workloadKind(serviceName, namespace, spec)
+	if err != nil {
+		return deployResult{}, err
+	}
+
+	log.Printf(" Deploying %s : %s", kind, spec)
+
+	ctx, apiCalls := withAPICounter(ctx)
+	defer func() {
+		log.Printf("📡 [%s] %d API request(s) for this rollout", serviceName, apiCalls.Load())
+	}()
 
 	//2 ensure the ns exists and if not create a new
 
-	err1 := d.ensureNs(namespace)
+	createdNs, err1 := d.ensureNs(ctx, namespace)
 	if err1 != nil {
 		log.Printf(" namespace error  in extractor.go \n ")
-		return err1
+		return deployResult{}, err1
 	}
 
-	//3 get deps for this ns
+	//3 curr workload from this ns
 
-	deploymentsClient := d.k8sClient.AppsV1().Deployments(namespace)
-	ctx := context.TODO()
-
-	//4 curr dep from this ns
-
-	deployment, err := deploymentsClient.Get(ctx, serviceName, metav1.GetOptions{})
+	target, err := getWorkload(ctx, d.k8sClient, kind, serviceName, namespace)
 	if err != nil {
 
-		if err1 == nil {
+		if createdNs {
 			log.Printf("New NameSpace created Kindly create a deployment file in the same ns\n")
 
-			return fmt.Errorf("New NameSpace created Kindly create a deployment file in the same ns\n")
+			return deployResult{}, fmt.Errorf("New NameSpace created Kindly create a deployment file in the same ns\n")
 		} else {
-			log.Printf(" failed to get deployements error  in extractor.go \n ")
+			log.Printf(" failed to get %s error  in extractor.go \n ", kind)
 
-			return fmt.Errorf("Failed Deployment in Namespace %s for service%s", namespace, serviceName)
+			return deployResult{}, fmt.Errorf("Failed %s in Namespace %s for service%s: %w", kind, namespace, serviceName, err)
 
 		}
 	}
 
-	//5 update the dep in spec
+	//4 update the pod template, only the diff is patched, see patch.go
 
-	if len(deployment.Spec.Template.Spec.Containers) == 0 {
-		return fmt.Errorf("no containers found in deployment %s", serviceName)
-	}
+	var previous *rollbackPoint
+	var oldImage, newImage string
 
-	//update
-	oldImage := deployment.Spec.Template.Spec.Containers[0].Image
-	deployment.Spec.Template.Spec.Containers[0].Image = fullImage
+	mutate := func(target workload) error {
 
-	log.Printf("🔄 Updating image: %s → %s", oldImage, fullImage)
+		template := target.template()
+
+		if len(template.Spec.Containers) == 0 {
+			return fmt.Errorf("no containers found in %s %s", kind, serviceName)
+		}
+
+		previous = &rollbackPoint{
+			Kind:     kind,
+			Image:    template.Spec.Containers[0].Image,
+			Template: *template.DeepCopy(),
+		}
+
+		//update
+		changes, err := spec.apply(template)
+		if err != nil {
+			log.Printf(" ECR REPO LINK / container error in extractor.go \n ")
+			return err
+		}
+		oldImage, newImage = previous.Image, template.Spec.Containers[0].Image
+
+		for _, change := range changes {
+			log.Printf("🔄 Updating image: %s", change)
+		}
+
+		if spec.Replicas != nil {
+			if err := target.setReplicas(*spec.Replicas); err != nil {
+				return err
+			}
+		}
+
+		if len(spec.Annotations) > 0 {
+			meta := target.meta()
+			if meta.Annotations == nil {
+				meta.Annotations = map[string]string{}
+			}
+			for k, v := range spec.Annotations {
+				meta.Annotations[k] = v
+			}
+		}
+
+		// same template as before (forced re-apply), nothing older to go back to
+		if equality.Semantic.DeepEqual(previous.Template, *template) {
+			previous = nil
+		}
+		return nil
+	}
 
 	// now apply
 
-	_, err = deploymentsClient.Update(ctx, deployment, metav1.UpdateOptions{})
+	conflicts, err := patchWorkload(ctx, target, mutate)
+	result := deployResult{Conflicts: conflicts, Kind: kind, OldImage: oldImage, NewImage: newImage}
 
 	if err != nil {
-		log.Printf(" deployment error  in extractor.go \n ")
-		return fmt.Errorf("Erroe while deploying in engine\n")
+		log.Printf(" deployment error  in extractor.go: %v \n ", err)
+		if apierrors.IsConflict(err) {
+			return result, classed(ErrorConflict, fmt.Errorf("gave up after %d conflicts updating %s %s", conflicts, kind, serviceName))
+		}
+		return result, fmt.Errorf("Erroe while deploying in engine: %w", err)
+	}
+
+	if conflicts > 0 {
+		log.Printf("⚔️  [%s] applied after %d conflict(s)", serviceName, conflicts)
 	}
 
+	result.Rollback = previous
+
 	//!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!HEALTH CHECKS!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!
 
-	err = d.WaitForRollout(deploymentsClient, serviceName, namespace, 4*time.Minute)
+	err = d.WaitForRollout(ctx, target, serviceName, namespace, d.rolloutTimeout(serviceName, namespace, target))
 
+	if ctx.Err() != nil {
+		// stopped, nothing failed, the pods may still be coming up
+		return result, err
+	}
 	if err != nil {
-		return err
+		// grab logs/events now, a rollback is about to replace these pods
+		result.Diagnostics, result.Report = d.reportFailure(ctx, serviceName, namespace, target, err)
+		return result, err
 	}
 
-	return nil
+	return result, nil
 }
 
 //k8s will not check for health we have to create a service for hat
 
 // k8s has to create a namepsace if it is not present
-func (d *Daemon) ensureNs(namespace string) error {
-
-	ctx := context.TODO()
+// the bool reports whether we just created it
+func (d *Daemon) ensureNs(ctx context.Context, namespace string) (bool, error) {
 
 	_, err := d.k8sClient.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
 
 	if err == nil {
 		// Namespace exists
-		return nil
+		return false, nil
 	}
 
-	if !strings.Contains(err.Error(), "not found") {
+	if !apierrors.IsNotFound(err) {
 		log.Printf(" system error  in extractor.go \n ")
-		return fmt.Errorf("System Error\n")
+		return false, fmt.Errorf("System Error: %w", err)
 	}
 
 	ns := &corev1.Namespace{
@@ -183,9 +313,9 @@ func (d *Daemon) ensureNs(namespace string) error {
 
 	if err != nil {
 		log.Printf(" namespace creation error  in extractor.go \n ")
-		return fmt.Errorf("Failed to create namespace %s: %v", namespace, err)
+		return false, fmt.Errorf("Failed to create namespace %s: %v", namespace, err)
 	}
 
-	return nil
+	return true, nil
 
 }
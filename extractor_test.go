@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// daemon backed by a fake clientset, no workers, fast polling
+func newTestDaemon(t *testing.T, objects ...runtime.Object) (*Daemon, *fake.Clientset) {
+	t.Helper()
+	t.Setenv("ECR_REPO", "test.ecr.local/app")
+
+	client := fake.NewClientset(objects...)
+	d := NewDaemon(client, Options{
+		DepsPath:       t.TempDir(),
+		StateDir:       t.TempDir(),
+		PollInterval:   10 * time.Millisecond,
+		RolloutTimeout: 300 * time.Millisecond,
+	})
+	t.Cleanup(func() { d.store.close() })
+	return d, client
+}
+
+func testNamespace(name string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+}
+
+// deployment whose status already reports a healthy rollout of `replicas`
+func testDeployment(name, namespace, image string, replicas int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": name}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: name, Image: image}},
+				},
+			},
+		},
+		Status: appsv1.DeploymentStatus{
+			Replicas:          replicas,
+			UpdatedReplicas:   replicas,
+			ReadyReplicas:     replicas,
+			AvailableReplicas: replicas,
+		},
+	}
+}
+
+func testPod(name, namespace, app string, state corev1.ContainerState) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{"app": app}},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{Name: app, State: state}},
+		},
+	}
+}
+
+// stuck rollout: one replica unavailable
+func unhealthy(dep *appsv1.Deployment) *appsv1.Deployment {
+	dep.Status.ReadyReplicas = 0
+	dep.Status.AvailableReplicas = 0
+	dep.Status.UnavailableReplicas = *dep.Spec.Replicas
+	return dep
+}
+
+func TestDeployTok8sSuccess(t *testing.T) {
+	d, client := newTestDaemon(t,
+		testNamespace("default"),
+		testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 2),
+	)
+
+	if _, err := d.DeployTok8s(context.TODO(), "nginx-app", DepSpec{Version: "1.1.0"}, "default"); err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+
+	dep, err := client.AppsV1().Deployments("default").Get(context.TODO(), "nginx-app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image := dep.Spec.Template.Spec.Containers[0].Image; image != "test.ecr.local/app:1.1.0" {
+		t.Errorf("image not updated, got %s", image)
+	}
+}
+
+func TestDeployTok8sMissingDeployment(t *testing.T) {
+	d, _ := newTestDaemon(t, testNamespace("default"))
+
+	result, err := d.DeployTok8s(context.TODO(), "ghost", DepSpec{Version: "1.0.0"}, "default")
+	if err == nil || !strings.Contains(err.Error(), "Failed Deployment") {
+		t.Fatalf("expected missing deployment error, got %v", err)
+	}
+	if result.Rollback != nil {
+		t.Errorf("nothing was applied, expected no rollback point, got %+v", result.Rollback)
+	}
+}
+
+func TestDeployTok8sNewNamespace(t *testing.T) {
+	d, client := newTestDaemon(t)
+
+	_, err := d.DeployTok8s(context.TODO(), "nginx-app", DepSpec{Version: "1.0.0"}, "qa-env")
+	if err == nil || !strings.Contains(err.Error(), "New NameSpace created") {
+		t.Fatalf("expected new namespace error, got %v", err)
+	}
+
+	if _, err := client.CoreV1().Namespaces().Get(context.TODO(), "qa-env", metav1.GetOptions{}); err != nil {
+		t.Errorf("namespace qa-env was not created: %v", err)
+	}
+}
+
+func TestDeployTok8sImagePullFailure(t *testing.T) {
+	d, _ := newTestDaemon(t,
+		testNamespace("default"),
+		unhealthy(testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1)),
+		testPod("nginx-app-abc", "default", "nginx-app", corev1.ContainerState{
+			Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "tag not found"},
+		}),
+	)
+
+	result, err := d.DeployTok8s(context.TODO(), "nginx-app", DepSpec{Version: "9.9.9"}, "default")
+	if err == nil || !strings.Contains(err.Error(), "image pull failed") {
+		t.Fatalf("expected image pull error, got %v", err)
+	}
+	if result.Rollback == nil || result.Rollback.Image != "test.ecr.local/app:1.0.0" {
+		t.Errorf("expected previous image for rollback, got %+v", result.Rollback)
+	}
+}
+
+func TestDeployTok8sCrashLoop(t *testing.T) {
+	d, _ := newTestDaemon(t,
+		testNamespace("default"),
+		unhealthy(testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1)),
+		testPod("nginx-app-abc", "default", "nginx-app", corev1.ContainerState{
+			Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff", Message: "back-off restarting failed container"},
+		}),
+	)
+
+	_, err := d.DeployTok8s(context.TODO(), "nginx-app", DepSpec{Version: "1.1.0"}, "default")
+	if err == nil || !strings.Contains(err.Error(), "crash loop") {
+		t.Fatalf("expected crash loop error, got %v", err)
+	}
+}
+
+func TestDeployTok8sRolloutTimeout(t *testing.T) {
+	d, _ := newTestDaemon(t,
+		testNamespace("default"),
+		unhealthy(testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1)),
+		// pending but not failing, so only the timeout can end the wait
+		testPod("nginx-app-abc", "default", "nginx-app", corev1.ContainerState{
+			Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"},
+		}),
+	)
+
+	_, err := d.DeployTok8s(context.TODO(), "nginx-app", DepSpec{Version: "1.1.0"}, "default")
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+}
+
+func TestEnsureNs(t *testing.T) {
+	d, _ := newTestDaemon(t, testNamespace("default"))
+
+	created, err := d.ensureNs(context.TODO(), "default")
+	if err != nil || created {
+		t.Errorf("existing namespace: created=%v err=%v", created, err)
+	}
+
+	created, err = d.ensureNs(context.TODO(), "fresh")
+	if err != nil || !created {
+		t.Errorf("missing namespace: created=%v err=%v", created, err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ HEALTH @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ for running the daemon as a Pod (no token, same server as /metrics)
+
+ GET /healthz  liveness, a failure means restart us
+               watcher   watchFiles is running and its loop ticks
+               workers   the queue moves: jobs waiting and nothing taken off
+                         it for StallTimeout means every worker is stuck
+ GET /readyz   readiness, a failure means not ready (yet)
+               kubernetes  the API answers a version request
+               watch       the DEPS folder is watched
+               reconcile   the startup reconcile finished
+
+ both answer {"status":"ok|failing","checks":{...}} with 200 / 503, with
+ LEADER_ELECT also "leader" and "leading", followers pass watch / reconcile
+*/
+
+// watchFiles ticks this often even without events
+const watcherBeatEvery = 10 * time.Second
+
+type healthState struct {
+	watching   atomic.Bool
+	reconciled atomic.Bool
+	// unix nanos, 0 = never
+	watcherBeat atomic.Int64
+	lastDequeue atomic.Int64
+}
+
+func (h *healthState) beat() {
+	h.watcherBeat.Store(time.Now().UnixNano())
+}
+
+func (h *healthState) dequeued() {
+	h.lastDequeue.Store(time.Now().UnixNano())
+}
+
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+func (d *Daemon) livenessChecks() []healthCheck {
+	return []healthCheck{
+		{"watcher", d.checkWatcher},
+		{"workers", d.checkWorkers},
+	}
+}
+
+func (d *Daemon) readinessChecks() []healthCheck {
+	return []healthCheck{
+		{"kubernetes", d.checkKubernetes},
+		{"watch", func() error {
+			// followers only serve http, they are ready as they are
+			if !d.health.watching.Load() && d.leader.isLeader() {
+				return fmt.Errorf("%s is not watched", d.opts.DepsPath)
+			}
+			return nil
+		}},
+		{"reconcile", func() error {
+			if !d.health.reconciled.Load() && d.leader.isLeader() {
+				return fmt.Errorf("startup reconcile still running")
+			}
+			return nil
+		}},
+	}
+}
+
+func (d *Daemon) checkWatcher() error {
+	if !d.health.watching.Load() {
+		// not started yet is fine, readyz covers that, stopped is not
+		// unless Shutdown stopped it, a restart now would cut the drain short
+		if d.health.watcherBeat.Load() != 0 && !d.drain.draining() {
+			return fmt.Errorf("watcher stopped")
+		}
+		return nil
+	}
+	if since := time.Since(time.Unix(0, d.health.watcherBeat.Load())); since > 3*watcherBeatEvery {
+		return fmt.Errorf("watcher loop silent for %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+func (d *Daemon) checkWorkers() error {
+	// the queue is in the store, a follower sees the leader's jobs
+	if !d.leader.isLeader() {
+		return nil
+	}
+	// retries waiting for their backoff are not stuck
+	pending, err := d.store.countDue()
+	if err != nil {
+		return fmt.Errorf("job queue: %w", err)
+	}
+	if pending == 0 {
+		return nil
+	}
+	last := d.health.lastDequeue.Load()
+	if last == 0 {
+		// nothing taken yet, count from the start
+		last = d.started.UnixNano()
+	}
+	if since := time.Since(time.Unix(0, last)); since > d.opts.StallTimeout {
+		return fmt.Errorf("%d job(s) queued, no worker took one for %s", pending, since.Round(time.Second))
+	}
+	return nil
+}
+
+func (d *Daemon) checkKubernetes() error {
+
+	// ServerVersion takes no context, don't let a hung API hang the probe
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.k8sClient.Discovery().ServerVersion()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("kubernetes API: %w", err)
+		}
+		return nil
+	case <-time.After(3 * time.Second):
+		return fmt.Errorf("kubernetes API did not answer within 3s")
+	}
+}
+
+func (d *Daemon) healthHandler(checks func() []healthCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		status, code := "ok", http.StatusOK
+		results := map[string]string{}
+
+		for _, c := range checks() {
+			if err := c.check(); err != nil {
+				results[c.name] = err.Error()
+				status, code = "failing", http.StatusServiceUnavailable
+				continue
+			}
+			results[c.name] = "ok"
+		}
+
+		body := map[string]interface{}{"status": status, "checks": results}
+		if d.leader.enabled {
+			body["leader"], body["leading"] = d.leader.current(), d.leader.isLeader()
+		}
+		writeJSON(w, code, body)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func probe(t *testing.T, d *Daemon, path string) (int, map[string]string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	d.httpHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+	var body struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, body.Checks
+}
+
+func TestReadyOnceWatchingAndReconciled(t *testing.T) {
+	d, _ := newTestDaemon(t)
+
+	code, checks := probe(t, d, "/readyz")
+	if code != http.StatusServiceUnavailable || checks["watch"] == "ok" || checks["reconcile"] == "ok" || checks["kubernetes"] != "ok" {
+		t.Fatalf("expected not ready before the watcher, got %d %v", code, checks)
+	}
+	// not started yet is not a reason to restart
+	if code, checks := probe(t, d, "/healthz"); code != http.StatusOK {
+		t.Errorf("healthz before the watcher: %d %v", code, checks)
+	}
+
+	go d.watchFiles()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		code, checks = probe(t, d, "/readyz")
+		if code == http.StatusOK || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code != http.StatusOK {
+		t.Errorf("expected ready, got %d %v", code, checks)
+	}
+}
+
+func TestNotReadyWithoutKubernetes(t *testing.T) {
+	d, client := newTestDaemon(t)
+	client.PrependReactor("get", "version", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+
+	if code, checks := probe(t, d, "/readyz"); code != http.StatusServiceUnavailable || checks["kubernetes"] == "ok" {
+		t.Errorf("expected kubernetes failing, got %d %v", code, checks)
+	}
+}
+
+func TestLivenessFailsWhenWorkersStall(t *testing.T) {
+	d, _ := newTestDaemon(t)
+	d.opts.StallTimeout = 20 * time.Millisecond
+
+	// no worker running, the job just sits there
+	d.enqueue(DeployService{service: "nginx-app_default.dep"})
+	time.Sleep(30 * time.Millisecond)
+
+	if code, checks := probe(t, d, "/healthz"); code != http.StatusServiceUnavailable || checks["workers"] == "ok" {
+		t.Errorf("expected workers failing, got %d %v", code, checks)
+	}
+
+	// a worker takes it, healthy again
+	d.store.claimJob()
+	d.health.dequeued()
+	if code, checks := probe(t, d, "/healthz"); code != http.StatusOK {
+		t.Errorf("expected healthy, got %d %v", code, checks)
+	}
+}
+
+func TestKubeConfigContext(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	os.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+current-context: dev
+clusters:
+- name: dev
+  cluster: {server: https://dev.example.com}
+- name: prod
+  cluster: {server: https://prod.example.com}
+contexts:
+- name: dev
+  context: {cluster: dev, user: me}
+- name: prod
+  context: {cluster: prod, user: me}
+users:
+- name: me
+  user: {token: abc}
+`), 0600)
+
+	t.Setenv("KUBECONFIG", kubeconfig)
+	// explicit KUBECONFIG wins over the in-cluster service account
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+
+	t.Setenv("KUBE_CONTEXT", "")
+	config, _, err := kubeConfig()
+	if err != nil || config.Host != "https://dev.example.com" {
+		t.Fatalf("current context: %v %v", config, err)
+	}
+
+	t.Setenv("KUBE_CONTEXT", "prod")
+	config, source, err := kubeConfig()
+	if err != nil || config.Host != "https://prod.example.com" {
+		t.Fatalf("KUBE_CONTEXT=prod: %v %v", config, err)
+	}
+	if source != "kubeconfig "+kubeconfig+", context prod" {
+		t.Errorf("source: %s", source)
+	}
+}
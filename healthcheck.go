@@ -4,18 +4,18 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
-	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
-	v1 "k8s.io/client-go/kubernetes/typed/apps/v1"
 )
 
 //@@@@@@@@@@@@@@@@@@@@@@@@@@@@ FLOW @@@@@@@@@@@@@@@@@@@@@@@@
 /*
- waitForRollout waits for a Kubernetes deployment to complete its rollout
-  polls the deployment status every 2 seconds until:
+ waitForRollout waits for a Kubernetes workload to complete its rollout
+  (same rules as `kubectl rollout status`, see workload.go)
+  status comes from the shared informer cache (see tracker.go), we wake up on
+  every change in the namespace and on the PollInterval safety tick until:
  all replicas are updated with new version
  all replicas are ready and healthy
  no unavailable replicas
@@ -27,151 +27,138 @@ import (
 
 */
 
-func (d *Daemon) WaitForRollout(deplyementClients v1.DeploymentInterface, serviceName string, namespace string, timeout time.Duration) error {
+// at most one progress notification per rollout this often
+const progressNotifyEvery = 5 * time.Second
+
+// returns context.Cause(ctx) when ctx ends first, the timeout is on top of it
+func (d *Daemon) WaitForRollout(ctx context.Context, target workload, serviceName string, namespace string, timeout time.Duration) (err error) {
+
+	started := time.Now()
+	defer func() { d.metrics.rollout(serviceName, namespace, time.Since(started), err) }()
 
 	//1 context
-	// withtimeout/with cancel always need a parent so wee pass the root context i.e background
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	// the job's context is the parent, cancelling the job ends the wait too
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	ticker := time.NewTicker(3 * time.Second)
+	if err := d.tracker.ensure(waitCtx, target.kind()); err != nil {
+		return err
+	}
+
+	changed, release := d.tracker.subscribe(namespace)
+	defer release()
+
+	// the cache can still hold the object from before our patch
+	generation := target.meta().Generation
+
+	ticker := time.NewTicker(d.opts.PollInterval)
 	defer ticker.Stop()
-	tickCount := 0
-	//polling
+	lastLog := time.Now()
+	lastProgress, lastNotify := "", time.Time{}
 
 	for {
 		// check for any two cases either ticker has done or it has ticked
 		select {
 
-		case <-ctx.Done():
-			log.Printf("timeout waiting for deployment rollout")
-			return fmt.Errorf("timeout waiting for deployment rollout", timeout)
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				// cancelled / superseded / shutdown, not a failed rollout
+				return context.Cause(ctx)
+			}
+			log.Printf("timeout waiting for %s rollout", target.kind())
+			return classed(ErrorTimeout, fmt.Errorf("timeout waiting for %s rollout after %v", strings.ToLower(target.kind()), timeout))
 
+		case <-changed:
 		case <-ticker.C:
-			// inside channel time to check if a new tick is delivered
-			tickCount++
-			deployment, err := deplyementClients.Get(ctx, serviceName, metav1.GetOptions{})
-			if err != nil {
-				log.Printf("failed to get deployement")
-				return fmt.Errorf("failed to get deployment: %w", err)
-			}
+		}
 
-			status := deployment.Status
-			desired := *deployment.Spec.Replicas
-			// Log status every 10 seconds
-			if tickCount%5 == 0 {
-				log.Printf(" [%s] Waiting... Updated: %d/%d | Ready: %d/%d | Unavail: %d",
-					serviceName, status.UpdatedReplicas, desired, status.ReadyReplicas, desired, status.UnavailableReplicas)
-			}
-			if status.UpdatedReplicas == desired && status.ReadyReplicas == desired && status.UnavailableReplicas == 0 {
-				// all are upated, all are ready and unavailvble =0
-				return nil
-			}
+		err := target.fromCache(d.tracker)
+		if err != nil {
+			log.Printf("failed to get %s", target.kind())
+			return fmt.Errorf("failed to get %s: %w", strings.ToLower(target.kind()), err)
+		}
 
-			if status.UnavailableReplicas > 0 {
-				// i.e some replica are failing
-				podErr := d.checkPodErrors(namespace, deployment.Spec.Selector)
-				if podErr != nil {
-					return fmt.Errorf("rollout failed: %w", podErr)
-				}
+		if target.meta().Generation < generation {
+			continue
+		}
+
+		done, failing, progress, statusErr := target.rolloutStatus()
+		// Log status every 10 seconds
+		if time.Since(lastLog) >= 10*time.Second {
+			log.Printf(" [%s] Waiting... %s", serviceName, progress)
+			lastLog = time.Now()
+		}
+		// the slack app updates its started message with it, keep chat.update calls low
+		if progress != lastProgress && time.Since(lastNotify) >= progressNotifyEvery {
+			d.notify(Notification{
+				Message:     progress,
+				MessageType: MsgDeploymentProgress,
+				Thread:      threadKey(serviceName, namespace),
+			})
+			lastProgress, lastNotify = progress, time.Now()
+		}
+		if done {
+			return nil
+		}
+
+		if statusErr != nil {
+			// the controller gave up, the pods usually know the real reason
+			if podErr := d.checkPodErrors(waitCtx, namespace, d.tracker.rolloutSelector(target)); podErr != nil {
+				return fmt.Errorf("rollout failed: %w (%v)", podErr, statusErr)
 			}
+			return fmt.Errorf("rollout failed: %w", statusErr)
+		}
 
+		if failing {
+			// i.e some replica are failing
+			podErr := d.checkPodErrors(waitCtx, namespace, d.tracker.rolloutSelector(target))
+			if podErr != nil {
+				return fmt.Errorf("rollout failed: %w", podErr)
+			}
 		}
 	}
 }
 
-// pods -> pod-> pod.status.ContainerStatus (containerStatus)-> containerStaus.Status has many states (terminated, waiting )
-// func (d *Daemon) checkPodErrors(serviceName string, namespace string) error {
-
-// 	ctx := context.Background()
-
-// 	pods, err := d.k8sClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
-// 		LabelSelector: fmt.Sprintf("app=%s", serviceName),
-// 	})
+// how long WaitForRollout waits for this service
+// rolloutTimeout in ENGINE_CONFIG wins, otherwise the default but never less
+// than the deployment's own progressDeadlineSeconds, the controller reporting
+// ProgressDeadlineExceeded is a better failure than our timeout
+func (d *Daemon) rolloutTimeout(serviceName string, namespace string, target workload) time.Duration {
 
-// 	if err != nil {
-// 		// we dont exit might be temporary
-// 		log.Printf(" Could not list pods: %v", err)
-// 		return nil
-// 	}
-
-// 	for _, pod := range pods.Items {
-
-// 		for _, containerStatus := range pod.Status.ContainerStatuses {
-
-// 			if containerStatus.State.Waiting != nil {
-// 				reason := containerStatus.State.Waiting.Reason
-// 				message := containerStatus.State.Waiting.Message
-
-// 				// image doesn't exist or auth failed
-// 				if reason == "ImagePullBackOff" || reason == "ErrImagePull" {
-// 					log.Printf("timeout waiting for deployment rollout")
-// 					return fmt.Errorf("image pull failed: %s - %s", reason, message)
-// 				}
-
-// 				// Invalid image format
-// 				if reason == "InvalidImageName" {
-// 					return fmt.Errorf("invalid image name: %s", message)
-// 				}
-
-// 				// Container keeps crashing on startup
-// 				if reason == "CrashLoopBackOff" {
-// 					return fmt.Errorf("container crashing repeatedly: %s", message)
-// 				}
-
-// 				// Container waiting for other reasons (resources, etc)
-// 			}
-
-// 			//!nil ie crashed
-// 			if containerStatus.State.Terminated != nil {
-// 				exitCode := containerStatus.State.Terminated.ExitCode
-
-// 				if exitCode != 0 {
-// 					return fmt.Errorf("Container Terminated with Code %d: %s,", exitCode, containerStatus.State.Terminated.Message)
-// 				}
-
-// 			}
-
-// 		}
+	if override := d.config.service(serviceName, namespace).RolloutTimeout; override != nil && override.Duration > 0 {
+		return override.Duration
+	}
 
-// 	}
+	timeout := d.opts.RolloutTimeout
 
-// 	return nil
+	if w, ok := target.(*deploymentWorkload); ok && w.obj.Spec.ProgressDeadlineSeconds != nil {
+		deadline := time.Duration(*w.obj.Spec.ProgressDeadlineSeconds)*time.Second + 30*time.Second
+		if deadline > timeout {
+			timeout = deadline
+		}
+	}
+	return timeout
+}
 
-// }
-// checkPodErrors now uses the Official Selector from the deployment
-func (d *Daemon) checkPodErrors(namespace string, labelSelector *metav1.LabelSelector) error {
-	ctx := context.Background()
+// pods -> pod-> pod.status.ContainerStatus (containerStatus)-> containerStaus.Status has many states (terminated, waiting )
+// checkPodErrors uses the Official Selector from the workload and reads pods from the informer cache
+func (d *Daemon) checkPodErrors(ctx context.Context, namespace string, labelSelector *metav1.LabelSelector) error {
 
-	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
-	if err != nil {
-		return fmt.Errorf("invalid label selector: %v", err)
+	if err := d.tracker.ensure(ctx, ""); err != nil {
+		return err
 	}
-	targetString := selector.String()
 
-	allpods, err := d.k8sClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	matchedPods, err := d.tracker.pods(namespace, labelSelector)
 	if err != nil {
 		log.Printf("❌ CRITICAL: Could not list pods in namespace '%s': %v", namespace, err)
 		return nil
 	}
 
-	if len(allpods.Items) == 0 {
-		log.Printf(" Namespace appears empty to GoClient %s", namespace)
+	if len(matchedPods) == 0 {
+		log.Printf(" No pods matching the selector yet in %s", namespace)
 		return nil
 	}
 
-	// we find 0 pods, something is very wrong (Deployment exists but no pods?)
-	var matchedPods []corev1.Pod
-
-	for _, pod := range allpods.Items {
-		podLabel := labels.Set(pod.Labels)
-		if selector.Matches(podLabel) {
-			matchedPods = append(matchedPods, pod)
-		} else {
-			log.Printf("   [MISMATCH] Pod: %s | Has: %v | Wants: %s", pod.Name, pod.Labels, targetString)
-		}
-	}
-
 	for _, pod := range matchedPods {
 
 		for _, containerStatus := range pod.Status.ContainerStatuses {
@@ -180,21 +167,21 @@ func (d *Daemon) checkPodErrors(namespace string, labelSelector *metav1.LabelSel
 				message := containerStatus.State.Waiting.Message
 
 				if reason == "ImagePullBackOff" || reason == "ErrImagePull" {
-					return fmt.Errorf("image pull failed: %s - %s", reason, message)
+					return classed(ErrorImage, fmt.Errorf("image pull failed: %s - %s", reason, message))
 				}
 				if reason == "CrashLoopBackOff" {
-					return fmt.Errorf("crash loop: %s", message)
+					return classed(ErrorCrash, fmt.Errorf("crash loop: %s", message))
 				}
 				if reason == "InvalidImageName" {
-					return fmt.Errorf("invalid image name: %s", message)
+					return classed(ErrorImage, fmt.Errorf("invalid image name: %s", message))
 				}
-				if containerStatus.State.Terminated != nil {
-					exitCode := containerStatus.State.Terminated.ExitCode
-
-					if exitCode != 0 {
-						return fmt.Errorf("Container Terminated with Code %d: %s,", exitCode, containerStatus.State.Terminated.Message)
-					}
+			}
+			// a container is either waiting or terminated, never both
+			if containerStatus.State.Terminated != nil {
+				exitCode := containerStatus.State.Terminated.ExitCode
 
+				if exitCode != 0 {
+					return classed(ErrorCrash, fmt.Errorf("Container Terminated with Code %d: %s,", exitCode, containerStatus.State.Terminated.Message))
 				}
 
 			}
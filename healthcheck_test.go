@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCheckPodErrors(t *testing.T) {
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nginx-app"}}
+
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		wantErr string
+	}{
+		{
+			"terminated with exit code",
+			testPod("nginx-app-1", "default", "nginx-app", corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{ExitCode: 137, Message: "OOMKilled"},
+			}),
+			"Terminated with Code 137",
+		},
+		{
+			"invalid image name",
+			testPod("nginx-app-1", "default", "nginx-app", corev1.ContainerState{
+				Waiting: &corev1.ContainerStateWaiting{Reason: "InvalidImageName"},
+			}),
+			"invalid image name",
+		},
+		{
+			"failing pod of another app is ignored",
+			testPod("other-1", "default", "other", corev1.ContainerState{
+				Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"},
+			}),
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDaemon(t, tt.pod)
+
+			err := d.checkPodErrors(context.TODO(), "default", selector)
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
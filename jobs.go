@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ JOBS @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ the queue used to be fire and forget, nobody could ask "what happened to
+ the deploy I triggered". every job now gets an id when it is enqueued
+ (watcher, startup reconcile, drift, requeue, http api) and its state is kept
+ here while the daemon runs:
+
+ queued -> [awaiting-approval] -> running -> succeeded / failed / rolled-back / ...
+        -> skipped (the .dep already matches what is deployed)
+ running -> retrying (retryable failure, see retry.go) -> running ... -> dead-letter
+
+ every job is a row of the durable queue too (queue.go), so a restart picks up
+ what was still queued and finds finished jobs for a week
+
+ running attempts are also in the history store with the job id, so a job
+ whose state fell out of memory (restart, pruned) can still be looked up there
+
+ subscribers (the SSE endpoint) get every state change plus the rollout
+ progress lines of the service the job is deploying
+
+ cancel (POST /api/v1/jobs/{id}/cancel, engine cancel): a queued job is
+ dropped before it starts, a running one has its context cancelled, every
+ stage of DeployService takes that context, the attempt ends as "cancelled"
+
+ supersede: only the newest job of a .dep matters (DeployService reads the
+ file anyway), so enqueue cancels the older ones of the same service:
+ queued / awaiting-approval   always, nothing was deployed yet
+ running                      only with the preempt policy (supersede in
+                              ENGINE_CONFIG / SUPERSEDE_POLICY), "finish"
+                              lets it complete first
+ v1 -> v2 -> v3 written quickly is one rollout of v3 (plus the one already
+ running with "finish"), a forced (drift) job passes force on to its successor
+*/
+
+const (
+	JobQueued           = "queued"
+	JobAwaitingApproval = "awaiting-approval"
+	JobRunning          = "running"
+	JobSkipped          = "skipped"
+	// an attempt failed, the next one is queued for RetryAt
+	JobRetrying = "retrying"
+	// failed every attempt its retry policy allowed
+	JobDeadLetter = "dead-letter"
+	// everything else is one of the Outcome* values of the history store
+)
+
+// finished jobs stay queryable in memory this long
+const jobRetention = time.Hour
+
+type jobState struct {
+	ID        string `json:"id"`
+	Service   string `json:"service"`
+	Namespace string `json:"namespace"`
+	Version   string `json:"version"`
+	Trigger   string `json:"trigger"`
+	State     string `json:"state"`
+	// deploy even when the .dep matches the last good (drift)
+	Force bool `json:"force,omitempty"`
+	// times a worker took it off the queue
+	Attempts int `json:"attempts"`
+	// queued for another attempt, not before then
+	RetryAt time.Time `json:"retryAt,omitempty"`
+	// history row of the attempt, 0 until it started
+	DeploymentID int64     `json:"deploymentId,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Progress     string    `json:"progress,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+func (j jobState) finished() bool {
+	switch j.State {
+	case JobQueued, JobAwaitingApproval, JobRunning, JobRetrying:
+		return false
+	}
+	return true
+}
+
+type jobEvent struct {
+	// "state" or "progress"
+	Type    string   `json:"type"`
+	Job     jobState `json:"job"`
+	Message string   `json:"message,omitempty"`
+}
+
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*jobState
+	// thread key (ns/svc) -> job running there, for progress lines
+	running     map[string]string
+	subscribers map[string][]chan jobEvent
+	// .dep content the api wrote itself, the watcher must not queue it twice
+	expected map[string]expectedWrite
+	// .dep writes a full queue refused, the watcher tries them again on its beat
+	backlog map[string]DeployService
+	// context of every job inside DeployService
+	cancels map[string]context.CancelCauseFunc
+	// writes every state change to the job's queue row, nil in tests
+	persist func(jobState)
+}
+
+// cause of a job's context when someone stopped it on purpose
+var errCancelled = errors.New("cancelled")
+
+type expectedWrite struct {
+	content string
+	until   time.Time
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{
+		jobs:        make(map[string]*jobState),
+		running:     make(map[string]string),
+		subscribers: make(map[string][]chan jobEvent),
+		expected:    make(map[string]expectedWrite),
+		backlog:     make(map[string]DeployService),
+		cancels:     make(map[string]context.CancelCauseFunc),
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// every job source goes through here, returns the job id
+// errQueueFull when QueueSize jobs are already pending, it never blocks
+func (d *Daemon) enqueue(job DeployService) (string, error) {
+
+	if job.id == "" {
+		job.id = newJobID()
+	}
+
+	serviceName, namespace, nameErr := extractServiceName(job.service)
+	state := jobState{
+		ID:        job.id,
+		Service:   serviceName,
+		Namespace: namespace,
+		Version:   shortSpec(job.version),
+		Trigger:   job.trigger,
+		State:     JobQueued,
+		Force:     job.force,
+	}
+
+	// known to the registry before its row exists, a worker claiming the row
+	// right after the insert (poll, another worker's wake) must find it
+	d.jobStates.add(state)
+
+	if nameErr == nil {
+		// older jobs of this .dep are obsolete now
+		preempt := d.config.service(serviceName, namespace).Supersede == SupersedePreempt
+		if d.jobStates.supersede(state, preempt) {
+			job.force, state.Force = true, true
+			d.jobStates.update(job.id, func(j *jobState) { j.Force = true })
+		}
+	}
+
+	if err := d.store.insertJob(job, state, d.opts.QueueSize); err != nil {
+		d.jobStates.remove(job.id)
+		if errors.Is(err, errQueueFull) {
+			return "", err
+		}
+		return "", fmt.Errorf("job queue: %w", err)
+	}
+
+	// while draining it just waits in the store for the next start
+	if !d.drain.draining() {
+		d.wakeWorker()
+	}
+	return job.id, nil
+}
+
+func (r *jobRegistry) add(job jobState) {
+
+	now := time.Now()
+	if job.CreatedAt.IsZero() {
+		// resumed jobs keep theirs
+		job.CreatedAt, job.UpdatedAt = now, now
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// drop what finished long ago, nobody polls a job for hours
+	for id, old := range r.jobs {
+		if old.finished() && now.Sub(old.UpdatedAt) > jobRetention {
+			delete(r.jobs, id)
+		}
+	}
+	r.jobs[job.ID] = &job
+	r.publish(job.ID, jobEvent{Type: "state", Job: job})
+}
+
+// a job that never made it into the queue
+func (r *jobRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.jobs, id)
+	r.closeSubscribers(id)
+}
+
+func (r *jobRegistry) get(id string) (jobState, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[id]
+	if !ok {
+		return jobState{}, false
+	}
+	return *job, true
+}
+
+// changes a job and tells its subscribers, unknown ids are ignored
+func (r *jobRegistry) update(id string, change func(*jobState)) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job := r.jobs[id]
+	if job == nil {
+		return
+	}
+	change(job)
+	job.UpdatedAt = time.Now()
+	r.save(*job)
+
+	thread := threadKey(job.Service, job.Namespace)
+	if job.State == JobRunning {
+		r.running[thread] = id
+	} else if r.running[thread] == id {
+		delete(r.running, thread)
+	}
+
+	r.publish(id, jobEvent{Type: "state", Job: *job})
+	if job.finished() {
+		r.closeSubscribers(id)
+	}
+}
+
+// a worker took it off the queue, its row already says so
+func (r *jobRegistry) claimed(id string, attempts int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if job := r.jobs[id]; job != nil {
+		job.Attempts = attempts
+	}
+}
+
+func (r *jobRegistry) setState(id string, state string, err error) {
+	r.update(id, func(job *jobState) {
+		job.State = state
+		if err != nil {
+			job.Error = err.Error()
+		}
+	})
+}
+
+// rollout progress of whatever job is running on that thread
+func (r *jobRegistry) progress(thread string, message string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, ok := r.running[thread]
+	if !ok {
+		return
+	}
+	job := r.jobs[id]
+	job.Progress = message
+	job.UpdatedAt = time.Now()
+	r.publish(id, jobEvent{Type: "progress", Job: *job, Message: message})
+}
+
+// events of one job until it finished, cancel to stop early
+func (r *jobRegistry) subscribe(id string) (<-chan jobEvent, func()) {
+
+	ch := make(chan jobEvent, 32)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if job, ok := r.jobs[id]; !ok || job.finished() {
+		close(ch)
+		return ch, func() {}
+	}
+	r.subscribers[id] = append(r.subscribers[id], ch)
+
+	return ch, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		subs := r.subscribers[id]
+		for i, sub := range subs {
+			if sub == ch {
+				r.subscribers[id] = append(subs[:i], subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+	}
+}
+
+// callers hold r.mu
+func (r *jobRegistry) save(job jobState) {
+	if r.persist != nil {
+		r.persist(job)
+	}
+}
+
+// callers hold r.mu
+func (r *jobRegistry) publish(id string, event jobEvent) {
+	for _, ch := range r.subscribers[id] {
+		select {
+		case ch <- event:
+		default:
+			// slow reader, the SSE handler sends the final state again once the channel closes
+			log.Printf("⚠️ Dropped an event of job %s for a slow subscriber", id)
+		}
+	}
+}
+
+func (r *jobRegistry) closeSubscribers(id string) {
+	for _, ch := range r.subscribers[id] {
+		close(ch)
+	}
+	delete(r.subscribers, id)
+}
+
+// DeployService took the job, false when it was cancelled while queued
+func (r *jobRegistry) run(id string, cancel context.CancelCauseFunc) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if job, ok := r.jobs[id]; ok && job.State == OutcomeCancelled {
+		return false
+	}
+	r.cancels[id] = cancel
+	return true
+}
+
+// DeployService returned
+func (r *jobRegistry) stopped(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.cancels, id)
+}
+
+// stops a job, queued ones never start, running ones see their context end
+func (r *jobRegistry) cancel(id string, reason error) (jobState, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cancelLocked(id, reason)
+}
+
+// callers hold r.mu, the same lock as run so a worker can't take it in between
+func (r *jobRegistry) cancelLocked(id string, reason error) (jobState, error) {
+
+	job, ok := r.jobs[id]
+	if !ok {
+		return jobState{}, errUnknownJob
+	}
+	if job.finished() {
+		return *job, fmt.Errorf("job already %s", job.State)
+	}
+
+	if cancel, running := r.cancels[id]; running {
+		// DeployService records the outcome
+		cancel(reason)
+		return *job, nil
+	}
+
+	job.State, job.Error, job.UpdatedAt = OutcomeCancelled, reason.Error(), time.Now()
+	r.save(*job)
+	r.publish(id, jobEvent{Type: "state", Job: *job})
+	r.closeSubscribers(id)
+	return *job, nil
+}
+
+// cancels the unfinished jobs of newer's service, the running one only with
+// preempt, true when one of them was forced
+func (r *jobRegistry) supersede(newer jobState, preempt bool) bool {
+
+	reason := fmt.Errorf("%w, superseded by job %s (%s)", errCancelled, newer.ID, newer.Version)
+	force := false
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, job := range r.jobs {
+		if id == newer.ID || job.finished() || job.Service != newer.Service || job.Namespace != newer.Namespace {
+			continue
+		}
+		if job.State == JobRunning && !preempt {
+			continue
+		}
+		force = force || job.Force
+		if _, err := r.cancelLocked(id, reason); err == nil {
+			log.Printf("⏭️  [%s/%s] job %s (%s) superseded by job %s (%s)", job.Namespace, job.Service, id, job.Version, newer.ID, newer.Version)
+		}
+	}
+	return force
+}
+
+// a newer job of that service is waiting, no need to queue another one
+func (r *jobRegistry) pendingFor(serviceName string, namespace string, except string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, job := range r.jobs {
+		if id != except && !job.finished() && job.State != JobRunning && job.Service == serviceName && job.Namespace == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+var errUnknownJob = errors.New("unknown job")
+
+// the api writes the .dep and queues the job itself, the watcher sees the same
+// write a moment later and must not queue a second one
+func (r *jobRegistry) expectWrite(depFile string, content string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expected[depFile] = expectedWrite{content: content, until: time.Now().Add(5 * time.Second)}
+}
+
+// the api could not queue what it wrote, the watcher has to
+func (r *jobRegistry) forgetWrite(depFile string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.expected, depFile)
+}
+
+// one entry per .dep, the job reads the file again when it runs
+func (r *jobRegistry) holdBack(job DeployService) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.backlog[job.service] = job
+}
+
+func (r *jobRegistry) heldBack() []DeployService {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	jobs := make([]DeployService, 0, len(r.backlog))
+	for _, job := range r.backlog {
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+func (r *jobRegistry) release(depFile string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.backlog, depFile)
+}
+
+func (r *jobRegistry) expectedWrite(depFile string, content string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.expected[depFile]
+	if !ok || time.Now().After(w.until) {
+		delete(r.expected, depFile)
+		return false
+	}
+	return w.content == content
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestSupersedeKeepsOnlyTheNewestJob(t *testing.T) {
+	r := newJobRegistry()
+
+	r.add(jobState{ID: "v1", Service: "nginx-app", Namespace: "default", Version: "1.1.0", State: JobRunning})
+	ctx, cancel := context.WithCancelCause(context.Background())
+	r.run("v1", cancel)
+	r.add(jobState{ID: "v2", Service: "nginx-app", Namespace: "default", Version: "1.2.0", State: JobQueued, Force: true})
+	r.add(jobState{ID: "other", Service: "redis", Namespace: "default", State: JobQueued})
+
+	// finish: the running one stays, the queued one goes and hands on force
+	if force := r.supersede(jobState{ID: "v3", Service: "nginx-app", Namespace: "default", Version: "1.3.0"}, false); !force {
+		t.Errorf("force of the superseded drift job not passed on")
+	}
+	if job, _ := r.get("v2"); job.State != OutcomeCancelled || !strings.Contains(job.Error, "superseded by job v3 (1.3.0)") {
+		t.Errorf("queued job: %+v", job)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("finish policy stopped the running rollout")
+	}
+	if job, _ := r.get("other"); job.State != JobQueued {
+		t.Errorf("another service's job was touched: %+v", job)
+	}
+
+	// preempt: the running one is stopped too
+	r.supersede(jobState{ID: "v4", Service: "nginx-app", Namespace: "default", Version: "1.4.0"}, true)
+	if !errors.Is(context.Cause(ctx), errCancelled) {
+		t.Errorf("running job not cancelled: %v", context.Cause(ctx))
+	}
+}
+
+// v1.1.0 is rolling out when 1.2.0 is written, preempt stops it and deploys 1.2.0
+func TestPreemptStopsObsoleteRollout(t *testing.T) {
+	d, _ := newTestDaemon(t,
+		testNamespace("default"),
+		unhealthy(testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1)),
+		testPod("nginx-app-abc", "default", "nginx-app", corev1.ContainerState{
+			Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"},
+		}),
+	)
+	d.config.Services["nginx-app"] = ServiceConfig{Supersede: SupersedePreempt}
+	d.opts.Workers = 2
+	d.opts.RolloutTimeout = time.Minute
+	d.Start()
+	defer d.Shutdown(0)
+
+	depFile := filepath.Join(d.opts.DepsPath, "nginx-app_default.dep")
+	os.WriteFile(depFile, []byte("1.1.0"), 0644)
+	first, _ := d.enqueue(DeployService{service: depFile, version: "1.1.0", namespace: "default", trigger: TriggerWatch})
+	waitFor(t, "the first rollout", func() bool {
+		job, _ := d.jobStates.get(first)
+		return job.State == JobRunning
+	})
+
+	os.WriteFile(depFile, []byte("1.2.0"), 0644)
+	second, _ := d.enqueue(DeployService{service: depFile, version: "1.2.0", namespace: "default", trigger: TriggerWatch})
+
+	waitFor(t, "the newer rollout", func() bool {
+		job, _ := d.jobStates.get(second)
+		return job.State == JobRunning
+	})
+	rec, _, _ := d.store.byJobID(first)
+	if rec.Outcome != OutcomeCancelled || !strings.Contains(rec.Error, "superseded") {
+		t.Errorf("obsolete attempt: %+v", rec)
+	}
+	if rec, _, _ := d.store.byJobID(second); rec.Version != "1.2.0" {
+		t.Errorf("newer attempt: %+v", rec)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ LEADER ELECTION @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ serviceLocks only protect one process, two replicas on the same DEPS volume
+ would both deploy every .dep. with LEADER_ELECT=true the replicas compete
+ for a coordination.k8s.io Lease and only the holder works:
+
+ leader    workers + watcher (startup reconcile) + drift check
+ followers http only: /healthz, /readyz, /metrics and the read-only api,
+           POST /api/v1/deployments answers 503 naming the leader
+
+ failover: the lease is 15s, renewed every 2s. a SIGTERM drains first
+ (shutdown.go) and then releases it (ReleaseOnCancel) so a rolling update hands
+ over in ~2s after the drain, a crashed leader is replaced once the lease runs out
+
+ in-flight jobs are not handed over, a rollout can't be moved between processes:
+ - a leader that loses the lease (could not renew, API partition) stops at
+   once: intake closes, running rollouts are interrupted (abandon in
+   shutdown.go), then it exits and kubernetes restarts it as a follower
+ - its jobs stay in the durable queue (queue.go): queued ones as pending
+   rows, the interrupted attempt back to pending too. a crash leaves that
+   one "running", the new leader's recoverJobs turns it pending
+ - the new leader marks the history rows of such attempts interrupted,
+   resumeQueued loads the pending rows under their ids before any worker
+   starts and they run again in order (patching the same image twice is
+   harmless)
+ that needs STATE_DIR (history, last good, job queue) on the volume shared
+ with DEPS. engine.db is sqlite in WAL mode, its shared memory index only works
+ between processes on one machine, over NFS / RWX volumes across nodes the
+ queue gets corrupted. so every replica has to run on the leader's node
+ (pod affinity, a ReadWriteOnce volume): NODE_NAME (downward api,
+ spec.nodeName) is required and a replica that finds a live lease held from
+ another node refuses to start. only the leader flushes the shared outbox
+*/
+
+type LeaderElectionConfig struct {
+	// Lease name / namespace and who we are
+	LeaseName      string
+	LeaseNamespace string
+	Identity       string
+	// where we run, every replica must share it, see above
+	Node string
+
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// nil unless LEADER_ELECT=true
+func leaderElectionFromEnv() *LeaderElectionConfig {
+
+	if os.Getenv("LEADER_ELECT") != "true" {
+		return nil
+	}
+
+	config := &LeaderElectionConfig{
+		LeaseName:      os.Getenv("LEADER_ELECTION_LEASE"),
+		LeaseNamespace: os.Getenv("LEADER_ELECTION_NAMESPACE"),
+		// downward api, the pod name is unique among the replicas
+		Identity: os.Getenv("POD_NAME"),
+		Node:     os.Getenv("NODE_NAME"),
+	}
+	if config.LeaseNamespace == "" {
+		config.LeaseNamespace = os.Getenv("POD_NAMESPACE")
+	}
+	if config.Identity == "" {
+		host, _ := os.Hostname()
+		config.Identity = host + "_" + newJobID()[:6]
+	}
+	return config
+}
+
+func (c *LeaderElectionConfig) withDefaults() {
+	if c.LeaseName == "" {
+		c.LeaseName = "deploy-engine"
+	}
+	if c.LeaseNamespace == "" {
+		c.LeaseNamespace = "default"
+	}
+	if c.LeaseDuration <= 0 {
+		c.LeaseDuration = 15 * time.Second
+	}
+	if c.RenewDeadline <= 0 {
+		c.RenewDeadline = 10 * time.Second
+	}
+	if c.RetryPeriod <= 0 {
+		c.RetryPeriod = 2 * time.Second
+	}
+}
+
+// who leads, always us without election
+type leaderState struct {
+	enabled  bool
+	identity string
+	leading  atomic.Bool
+
+	mu     sync.Mutex
+	leader string
+}
+
+func (l *leaderState) isLeader() bool {
+	return !l.enabled || l.leading.Load()
+}
+
+func (l *leaderState) current() string {
+	if !l.enabled {
+		return ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader
+}
+
+// leader -> runs lead once it holds the lease, follower -> waits
+// returns when ctx is done (lease released) or the lease was lost
+// lost is true only in the second case
+func (d *Daemon) runElection(ctx context.Context, lead func(ctx context.Context)) (lost bool) {
+
+	config := d.opts.LeaderElection
+	config.withDefaults()
+	d.leader.identity = config.Identity
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: config.LeaseName, Namespace: config.LeaseNamespace},
+		Client:     d.k8sClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: config.Identity},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   config.LeaseDuration,
+		RenewDeadline:   config.RenewDeadline,
+		RetryPeriod:     config.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            config.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Printf("👑 %s is the leader now (lease %s/%s)", config.Identity, config.LeaseNamespace, config.LeaseName)
+				d.leader.leading.Store(true)
+				lead(ctx)
+			},
+			OnStoppedLeading: func() {
+				// also called when we never led
+				if d.leader.leading.Swap(false) && ctx.Err() == nil {
+					lost = true
+					// before runElection returns, nothing of ours may still
+					// claim or patch once the new leader starts
+					log.Printf("❌ Lost the leader lease, stopping every job")
+					d.abandon(errLeaseLost)
+				}
+			},
+			OnNewLeader: func(identity string) {
+				d.leader.mu.Lock()
+				d.leader.leader = identity
+				d.leader.mu.Unlock()
+				d.metrics.setLeader(identity)
+				if identity != config.Identity {
+					log.Printf("👥 following %s", identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		log.Fatal("Invalid leader election config:", err)
+	}
+
+	log.Printf("🗳️  %s waiting for the lease %s/%s", config.Identity, config.LeaseNamespace, config.LeaseName)
+	elector.Run(ctx)
+	return lost
+}
+
+// everything only the leader does, ctx ends when the lease is gone
+// workers, watcher and drift all stop on d.drain.stopping, Shutdown closes it
+// before the lease is released and OnStoppedLeading (abandon) when it was lost
+func (d *Daemon) lead(ctx context.Context) {
+
+	// attempts a previous leader (or this process before a crash) left running
+	if n, err := d.store.markInterrupted(); err == nil && n > 0 {
+		log.Printf("⚠️ %d deployment(s) were interrupted by the last shutdown / failover, the reconcile redoes them", n)
+	}
+	if d.leader.enabled {
+		// engine status shows it
+		if err := d.store.setMeta(metaLeader, d.leader.identity+" since "+formatTime(time.Now())); err != nil {
+			log.Printf("⚠️ Could not record the leader: %v", err)
+		}
+		if err := d.store.setMeta(metaLeaderNode, d.opts.LeaderElection.Node); err != nil {
+			log.Printf("⚠️ Could not record the leader's node: %v", err)
+		}
+	}
+
+	// before any worker runs, it puts the jobs left running back to pending
+	// ahead of the reconcile, the jobs it queues for the same .dep supersede them
+	d.resumeQueued()
+	d.Start()
+	// periodic drift check against manual kubectl edits
+	go d.watchDrift()
+	// watches the folder and fills the queue
+	go d.watchFiles()
+}
+
+// engine.db can't be shared across nodes, fails when we'd open it next to a
+// live leader on another one
+func (d *Daemon) checkSameNode(ctx context.Context) error {
+
+	config := d.opts.LeaderElection
+	config.withDefaults()
+
+	if config.Node == "" {
+		return fmt.Errorf("LEADER_ELECT=true needs NODE_NAME (downward api spec.nodeName), replicas share engine.db and must run on one node")
+	}
+
+	lease, err := d.k8sClient.CoordinationV1().Leases(config.LeaseNamespace).Get(ctx, config.LeaseName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the lease %s/%s: %w", config.LeaseNamespace, config.LeaseName, err)
+	}
+
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || *spec.HolderIdentity == config.Identity ||
+		spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return nil
+	}
+	if time.Since(spec.RenewTime.Time) > time.Duration(*spec.LeaseDurationSeconds)*time.Second {
+		// expired, whoever held it is gone
+		return nil
+	}
+
+	node, err := d.store.meta(metaLeaderNode)
+	if err != nil {
+		return err
+	}
+	if node != "" && node != config.Node {
+		return fmt.Errorf("leader %s runs on node %s, this replica on %s: engine.db can't be shared across nodes, schedule every replica on one node",
+			*spec.HolderIdentity, node, config.Node)
+	}
+	return nil
+}
+
+// 503 text for work a follower can't take
+func (d *Daemon) notLeaderError() error {
+	if leader := d.leader.current(); leader != "" {
+		return fmt.Errorf("not the leader, send it to %s", leader)
+	}
+	return fmt.Errorf("not the leader, no leader elected yet")
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// daemon on a shared clientset competing for the same lease
+func newElectingDaemon(t *testing.T, client *fake.Clientset, identity string) *Daemon {
+	t.Helper()
+	d := NewDaemon(client, Options{
+		DepsPath: t.TempDir(),
+		StateDir: t.TempDir(),
+		APIToken: testAPIToken,
+		LeaderElection: &LeaderElectionConfig{
+			Identity:      identity,
+			LeaseDuration: time.Second,
+			RenewDeadline: 500 * time.Millisecond,
+			RetryPeriod:   100 * time.Millisecond,
+		},
+	})
+	t.Cleanup(func() { d.store.close() })
+	return d
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestLeaderElectionHandover(t *testing.T) {
+
+	client := fake.NewClientset()
+	first := newElectingDaemon(t, client, "engine-a")
+	second := newElectingDaemon(t, client, "engine-b")
+
+	led := make(chan string, 2)
+	lead := func(name string) func(context.Context) {
+		return func(ctx context.Context) { led <- name }
+	}
+
+	firstCtx, stopFirst := context.WithCancel(context.Background())
+	firstDone := make(chan bool)
+	go func() { firstDone <- first.runElection(firstCtx, lead("engine-a")) }()
+
+	if name := <-led; name != "engine-a" {
+		t.Fatalf("%s led first", name)
+	}
+
+	secondCtx, stopSecond := context.WithCancel(context.Background())
+	defer stopSecond()
+	go second.runElection(secondCtx, lead("engine-b"))
+
+	waitFor(t, "the follower to see the leader", func() bool { return second.leader.current() == "engine-a" })
+	if second.leader.isLeader() {
+		t.Fatal("both replicas lead")
+	}
+
+	// a follower can't take deployments
+	srv := httptest.NewServer(second.httpHandler())
+	defer srv.Close()
+	resp := apiRequest(t, "POST", srv.URL+"/api/v1/deployments", `{"service":"nginx-app","namespace":"default","version":"1.1.0"}`)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("follower answered %d", resp.StatusCode)
+	}
+	if body := decode[map[string]string](t, resp); body["error"] != "not the leader, send it to engine-a" {
+		t.Fatalf("error = %q", body["error"])
+	}
+
+	// shutdown releases the lease, well before it would run out
+	stopFirst()
+	if lost := <-firstDone; lost {
+		t.Fatal("a released lease counted as lost")
+	}
+	select {
+	case name := <-led:
+		if name != "engine-b" {
+			t.Fatalf("%s took over", name)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the follower did not take over")
+	}
+	if !second.leader.isLeader() || first.leader.isLeader() {
+		t.Fatal("leading flags not handed over")
+	}
+}
+
+func TestWithoutElectionAlwaysLeader(t *testing.T) {
+	d, _ := newTestDaemon(t)
+	if !d.leader.isLeader() || d.leader.current() != "" {
+		t.Fatal("a single replica must always lead")
+	}
+}
+
+// a leader that can't renew its lease stops its rollout at once instead of
+// deploying next to the replica that takes over
+func TestLostLeaseStopsRunningJobs(t *testing.T) {
+	t.Setenv("ECR_REPO", "test.ecr.local/app")
+
+	client := fake.NewClientset(
+		testNamespace("default"),
+		unhealthy(testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1)),
+		// pending but not failing, only losing the lease ends the wait
+		testPod("nginx-app-abc", "default", "nginx-app", corev1.ContainerState{
+			Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"},
+		}),
+	)
+	d := newElectingDaemon(t, client, "engine-a")
+	d.opts.Workers = 1
+	d.opts.PollInterval = 10 * time.Millisecond
+	d.opts.RolloutTimeout = time.Minute
+	os.WriteFile(filepath.Join(d.opts.DepsPath, "nginx-app_default.dep"), []byte("1.1.0"), 0644)
+
+	// installed before anything uses the client, flipped once the rollout runs
+	var unreachable atomic.Bool
+	client.PrependReactor("update", "leases", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if !unreachable.Load() {
+			return false, nil, nil
+		}
+		return true, nil, errors.New("apiserver unreachable")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan bool)
+	go func() { done <- d.runElection(ctx, d.lead) }()
+
+	waitFor(t, "the reconcile's rollout to start", func() bool {
+		attempts, _ := d.store.latestAttempts()
+		return len(attempts) == 1 && attempts[0].Outcome == OutcomeRunning
+	})
+
+	// the API server stops taking our renewals
+	unreachable.Store(true)
+
+	select {
+	case lost := <-done:
+		if !lost {
+			t.Fatal("a lost lease was not reported")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the election did not give up the lease")
+	}
+
+	if !d.drain.draining() {
+		t.Error("intake still open after losing the lease")
+	}
+	attempts, _ := d.store.latestAttempts()
+	if attempts[0].Outcome != OutcomeInterrupted {
+		t.Errorf("rollout after the lease was lost: %s", attempts[0].Outcome)
+	}
+	if pending, _ := d.store.countJobs(QueuePending); pending != 1 {
+		t.Errorf("the interrupted job is not pending for the next leader: %d", pending)
+	}
+}
+
+// engine.db is sqlite, a replica on another node than the live leader must not open it
+func TestReplicaOnAnotherNodeRefusesToStart(t *testing.T) {
+
+	holder, seconds := "engine-a", int32(15)
+	client := fake.NewClientset(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "deploy-engine", Namespace: "default"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &seconds,
+			RenewTime:            &metav1.MicroTime{Time: time.Now()},
+		},
+	})
+	d := newElectingDaemon(t, client, "engine-b")
+	d.store.setMeta(metaLeaderNode, "node-1")
+
+	for node, ok := range map[string]bool{"node-1": true, "node-2": false, "": false} {
+		d.opts.LeaderElection.Node = node
+		if err := d.checkSameNode(context.TODO()); (err == nil) != ok {
+			t.Errorf("node %q: %v", node, err)
+		}
+	}
+
+	// an expired lease has no live leader to collide with
+	client.CoordinationV1().Leases("default").Delete(context.TODO(), "deploy-engine", metav1.DeleteOptions{})
+	d.opts.LeaderElection.Node = "node-2"
+	if err := d.checkSameNode(context.TODO()); err != nil {
+		t.Errorf("without a lease: %v", err)
+	}
+}
@@ -1,93 +1,65 @@
 package main
 
 import (
-	"log"
+	"context"
 	"os"
-	"strings"
 
 	"github.com/slack-go/slack"
 )
 
-type SlackMessage struct {
-	Message     string
-	Details     string
-	MessageType string
+// incoming webhook, WEBHOOK_FOR_SLACK
+type slackNotifier struct {
+	webhook string
 }
 
-const (
-	MsgDeploymentSuccess  = "deployment-success"
-	MsgDeploymentFailure  = "deployment-failure"
-	MsgInternalSysFailure = "internal-system-failure"
-	MsgNameSpaceError = "namepsace-issue";
-)
-
-func SlackNotifier(message SlackMessage) {
-
-	// webhookURL := os.Getenv("SLACK_WEBHOOK_URL")
-
-	go func() {
+func newSlackNotifier(webhook string) *slackNotifier {
+	return &slackNotifier{webhook: webhook}
+}
 
-		// url -> data attachement -> create attachment -> create a msg -> send
-		//get url
-		webhook := getUrl()
+func (s *slackNotifier) Name() string { return "slack" }
 
-		if webhook == "" {
-			return
-		}
+func (s *slackNotifier) Notify(ctx context.Context, message Notification) error {
 
-		//get color , emoji
-		color, emoji := getColor(message.MessageType)
+	// data attachement -> create attachment -> create a msg -> send
 
-		// crete an attachment via parsing of msg struct
-		attachment := buildMessage(message, color, emoji)
+	//get color , emoji
+	color, emoji := getColor(message.MessageType)
 
-		//create a message
-		webhookMsg := &slack.WebhookMessage{
-			Attachments: []slack.Attachment{attachment},
-		}
-		//send msg
-		err := slack.PostWebhook(webhook, webhookMsg)
-		if err != nil {
-			log.Printf("Failed to send Slack notification: %v", err)
-		}
+	// crete an attachment via parsing of msg struct
+	attachment := buildMessage(message, color, emoji)
 
-	}()
+	attachments := []slack.Attachment{attachment}
+	if message.Logs != "" {
+		attachments = append(attachments, slack.Attachment{
+			Color:      color,
+			Text:       "```" + message.Logs + "```",
+			MarkdownIn: []string{"text"},
+		})
+	}
 
+	//create a message
+	webhookMsg := &slack.WebhookMessage{
+		Attachments: attachments,
+	}
+	//send msg, postJSON keeps the status and Retry-After for the outbox
+	return postJSON(ctx, s.webhook, webhookMsg)
 }
 
 func getUrl() string {
-
-	url := os.Getenv("WEBHOOK_FOR_SLACK")
-
-	if url == "" {
-		log.Println("Webhook URL is not set")
-		return ""
-	}
-	return url
-
+	return os.Getenv("WEBHOOK_FOR_SLACK")
 }
 
-func getColor(errorMsg string) (color, emoji string) {
-
-	switch errorMsg {
-
-	case MsgDeploymentSuccess:
-		return "good", "✅"
-	case MsgDeploymentFailure:
-		return "danger", "❌"
-	case MsgInternalSysFailure:
-		return "warning", "⚠️"
-	default:
-		return "warning", "ℹ️"
+func buildMessage(msg Notification, color, emoji string) slack.Attachment {
 
+	feilds := []slack.AttachmentField{}
+	for _, field := range parseDetails(msg.Details) {
+		feilds = append(feilds, slack.AttachmentField{
+			Title: field.Title,
+			Value: field.Value,
+			Short: field.Short,
+		})
 	}
 
-}
-
-func buildMessage(msg SlackMessage, color, emoji string) slack.Attachment {
-
-	feilds := parseDetails(msg.Details)
-
 	return slack.Attachment{
 
 		Color:  color,
@@ -95,43 +67,3 @@ func buildMessage(msg SlackMessage, color, emoji string) slack.Attachment {
 		Fields: feilds,
 	}
 }
-
-func parseDetails(details string) []slack.AttachmentField {
-	if details == "" {
-		return []slack.AttachmentField{}
-	}
-
-	fields := []slack.AttachmentField{}
-	lines := strings.Split(details, "\n")
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) != 2 {
-			continue
-		}
-
-		title := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
-
-		title = strings.Title(strings.ToLower(title))
-
-		short := true
-		titleLower := strings.ToLower(title)
-
-		if titleLower == "error" || titleLower == "message" || len(value) > 50 {
-			short = false
-		}
-
-		fields = append(fields, slack.AttachmentField{
-			Title: title,
-			Value: value,
-			Short: short,
-		})
-	}
-	return fields
-}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -20,38 +24,156 @@ type Daemon struct {
 	serviceLocks map[string]*sync.Mutex
 	// protects service map from races
 	locksMutex sync.Mutex
-	jobs       chan DeployService
-	k8sClient  *kubernetes.Clientset
+	// a job landed in the queue, see queue.go
+	wake      chan struct{}
+	k8sClient kubernetes.Interface
+	// shared informers every rollout reads its status from
+	tracker *rolloutTracker
+	// notifications waiting for delivery, on disk
+	outbox *outbox
+	// every deployment attempt and the last good version per service
+	store *historyStore
+	// state of queued / running / recently finished jobs by id
+	jobStates *jobRegistry
+	// GET /metrics
+	metrics *engineMetrics
+	// GET /healthz, /readyz
+	health  healthState
+	started time.Time
+	// lease holder, always us without LEADER_ELECT
+	leader *leaderState
+	// SIGTERM: stop intake, wait for running jobs, the queue stays in the store
+	drain  *drainState
+	config *EngineConfig
+	opts   Options
 }
 
 type DeployService struct {
 	service   string
 	version   string
 	namespace string
+	// force skips the .dep vs last good comparison, used when the cluster
+	// drifted away from a version we already recorded as deployed
+	force bool
+	// what queued the job, TriggerWatch, TriggerStartup, ... (history only)
+	trigger string
+	// set by enqueue, GET /api/v1/jobs/{id}
+	id string
+	// times a worker took it off the queue, this one included
+	attempts int
 }
 
-// initlaise a new daemon
+// everything left zero falls back to the defaults below
+type Options struct {
+	Workers int
+	// pending jobs the durable queue holds before enqueue refuses new ones
+	QueueSize int
+	// folder holding the {service}_{namespace}.dep files
+	DepsPath string
+	// where the engine keeps its own files (failure reports, ...)
+	StateDir string
+	Config   *EngineConfig
+	// where notifications fan out to, none -> log only
+	Notifiers []Notifier
+	// slack app asking for approvals, nil -> protected namespaces can't deploy
+	Approvals *approvals
+	// status / callback endpoints, "" -> no http server
+	HTTPAddr string
+	// bearer token of the /api/v1 endpoints, "" -> api disabled
+	APIToken string
+	// deployment history + last good versions, nil -> {StateDir}/engine.db
+	Store *historyStore
+	// keep writing {service}_{namespace}.last next to the .dep files
+	LastFileMirror bool
+	// compete for a Lease, only the holder deploys, nil -> always deploy
+	LeaderElection *LeaderElectionConfig
+	// /healthz fails when queued jobs wait this long without a worker taking one
+	StallTimeout time.Duration
+	// safety tick for WaitForRollout on top of informer events, and when it gives up
+	PollInterval   time.Duration
+	RolloutTimeout time.Duration
+}
 
-func NewDaemon(worker int) *Daemon {
+func (o Options) withDefaults() Options {
+	if o.Workers <= 0 {
+		o.Workers = 100
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = 500
+	}
+	if o.StateDir == "" {
+		o.StateDir = ".engine"
+	}
+	if (o.Approvals != nil || o.APIToken != "") && o.HTTPAddr == "" {
+		// slack / CI have to reach us somewhere
+		o.HTTPAddr = ":8080"
+	}
+	if o.Config == nil {
+		o.Config = &EngineConfig{Services: map[string]ServiceConfig{}}
+	}
+	if o.StallTimeout <= 0 {
+		o.StallTimeout = 15 * time.Minute
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = 3 * time.Second
+	}
+	if o.RolloutTimeout <= 0 {
+		o.RolloutTimeout = 4 * time.Minute
+	}
+	return o
+}
 
-	// create a new k8s client
-	k8sClient, err := Newk8sclient()
+// initlaise a new daemon, workers are started separately with Start
+// so tests can drive DeployService/DeployTok8s directly against a fake client
+func NewDaemon(k8sClient kubernetes.Interface, opts Options) *Daemon {
 
-	if err != nil {
-		fmt.Printf("Error creating k8s client: %v\n", err)
-		os.Exit(1)
+	opts = opts.withDefaults()
+
+	if opts.Store == nil {
+		store, err := openStore(filepath.Join(opts.StateDir, "engine.db"))
+		if err != nil {
+			log.Fatal("Failed to open history store:", err)
+		}
+		opts.Store = store
 	}
 
 	d := &Daemon{
 		serviceLocks: make(map[string]*sync.Mutex),
-		jobs:         make(chan DeployService, 500),
+		wake:         make(chan struct{}, 1),
 		k8sClient:    k8sClient,
+		tracker:      newRolloutTracker(k8sClient),
+		outbox:       newOutbox(filepath.Join(opts.StateDir, "outbox"), opts.Notifiers),
+		store:        opts.Store,
+		jobStates:    newJobRegistry(),
+		started:      time.Now(),
+		leader:       &leaderState{enabled: opts.LeaderElection != nil},
+		drain:        newDrainState(),
+		config:       opts.Config,
+		opts:         opts,
+	}
+	d.jobStates.persist = func(job jobState) {
+		if err := d.store.updateJob(job); err != nil {
+			log.Printf("⚠️ Could not update job %s in the queue: %v", job.ID, err)
+		}
 	}
+	d.metrics = newEngineMetrics(d)
+	d.outbox.metrics = d.metrics
+	return d
+}
 
-	for i := 0; i < worker; i++ {
+func (d *Daemon) Start() {
+	for i := 0; i < d.opts.Workers; i++ {
 		go d.Worker()
 	}
-	return d
+	// also delivers whatever a previous run left in the outbox
+	d.outbox.start()
+}
+
+// delivers pending notifications, gives up (leaving them on disk) when ctx is done
+// the background lanes stop first, a call hanging there does not hold up the flush
+func (d *Daemon) FlushNotifications(ctx context.Context) error {
+	d.outbox.stop()
+	return d.outbox.flush(ctx)
 }
 
 func main() {
@@ -62,15 +184,137 @@ func main() {
 		log.Println("Warning: .env file not found, using system environment variables")
 	}
 
-	daemon := NewDaemon(100)
-	// this main go routine watches the file fills the channel
-	daemon.watchFiles()
+	// no subcommand is the old behaviour, run the daemon
+	command := "run"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	if command != "run" {
+		os.Exit(runCLI(command, os.Args[2:], os.Stdout))
+	}
 
+	runDaemon()
 }
 
-func (d *Daemon) Worker() {
-	for job := range d.jobs {
-		d.DeployService(job)
+func runDaemon() {
+
+	// create a new k8s client
+	k8sClient, err := Newk8sclient()
+
+	if err != nil {
+		fmt.Printf("Error creating k8s client: %v\n", err)
+		os.Exit(1)
+	}
+
+	config, err := loadConfig()
+
+	if err != nil {
+		fmt.Printf("Error loading engine config: %v\n", err)
+		os.Exit(1)
+	}
+
+	path, err := getPATH()
+
+	if err != nil {
+		return
+	}
+
+	stateDir := getStateDir()
+
+	store, err := openStore(filepath.Join(stateDir, "engine.db"))
+	if err != nil {
+		fmt.Printf("Error opening history store: %v\n", err)
+		os.Exit(1)
+	}
+	defer store.close()
+
+	// .last files of older versions become the starting point, once
+	if _, err := store.importLastFiles(path); err != nil {
+		log.Printf("⚠️ Could not import .last files: %v", err)
+	}
+
+	approvals := approvalsFromEnv()
+	for namespace, nsConfig := range config.Namespaces {
+		if nsConfig.Approval != nil && approvals == nil {
+			log.Printf("⚠️ Namespace %s requires approvals but SLACK_BOT_TOKEN / SLACK_CHANNEL / SLACK_SIGNING_SECRET are missing, its deploys will fail", namespace)
+		}
+	}
+
+	daemon := NewDaemon(k8sClient, Options{
+		Workers:   100,
+		QueueSize: 500,
+		DepsPath:  path,
+		StateDir:  stateDir,
+		Store:     store,
+		// .last files stay as a mirror unless turned off
+		LastFileMirror: os.Getenv("LAST_FILE_MIRROR") != "false",
+		Config:         config,
+		Notifiers:      loadNotifiers(),
+		Approvals:      approvals,
+		HTTPAddr:       httpAddr(),
+		APIToken:       os.Getenv("API_TOKEN"),
+		LeaderElection: leaderElectionFromEnv(),
+	})
+
+	// ctrl+c / SIGTERM cancels it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if daemon.opts.LeaderElection != nil {
+		if err := daemon.checkSameNode(ctx); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// probes, metrics, slack interactivity callbacks + http api, followers too
+	go daemon.serveHTTP()
+
+	// notifications of deploys that just finished must not be lost
+	flush := func() {
+		log.Printf("🛑 Shutting down, flushing notifications")
+		flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := daemon.FlushNotifications(flushCtx); err != nil {
+			log.Printf("⚠️ %v, they are sent on the next start", err)
+		}
+	}
+
+	lost := false
+	if daemon.opts.LeaderElection != nil {
+		// workers, watcher and drift only start once we hold the lease, the
+		// lease is only released after the drain so nobody else starts early
+		electionCtx, release := context.WithCancel(context.Background())
+		defer release()
+		result := make(chan bool, 1)
+		go func() { result <- daemon.runElection(electionCtx, daemon.lead) }()
+
+		select {
+		case lost = <-result:
+			// the outbox is shared, the new leader's lanes deliver what is left
+		case <-ctx.Done():
+			daemon.Shutdown(getShutdownGrace())
+			// still holding the lease, a follower never flushes: the outbox
+			// is the leader's, flushing it too would send everything twice
+			if daemon.leader.isLeader() {
+				flush()
+			}
+			release()
+			<-result
+		}
+	} else {
+		daemon.lead(ctx)
+		// main go routine waits for ctrl+c / SIGTERM
+		<-ctx.Done()
+		daemon.Shutdown(getShutdownGrace())
+		flush()
+	}
+
+	if lost {
+		// another replica may already be deploying, restart as a follower
+		log.Printf("❌ Lost the leader lease, exiting")
+		store.close()
+		os.Exit(1)
 	}
 }
 
@@ -97,6 +341,26 @@ func getPATH() (string, error) {
 	return path, nil
 }
 
+// /metrics is always served, HTTP_ADDR=off turns the server off
+func httpAddr() string {
+	switch addr := os.Getenv("HTTP_ADDR"); addr {
+	case "":
+		return ":8080"
+	case "off":
+		return ""
+	default:
+		return addr
+	}
+}
+
+// daemon and cli share it, the cli reads the daemon's history store
+func getStateDir() string {
+	if dir := os.Getenv("STATE_DIR"); dir != "" {
+		return dir
+	}
+	return ".engine"
+}
+
 // the main engine
 func (d *Daemon) watchFiles() {
 	// 1. Create the watcher
@@ -106,11 +370,7 @@ func (d *Daemon) watchFiles() {
 	}
 	defer watcher.Close()
 
-	path, err := getPATH()
-
-	if err != nil {
-		return
-	}
+	path := d.opts.DepsPath
 
 	err = watcher.Add(path)
 	if err != nil {
@@ -118,12 +378,34 @@ func (d *Daemon) watchFiles() {
 	}
 	log.Printf(" Watching path: %s", path)
 
+	d.health.beat()
+	d.health.watching.Store(true)
+	defer d.health.watching.Store(false)
+
+	// watcher is already registered so nothing written from here on is missed,
+	// now catch up on whatever changed while the daemon was down
+	d.reconcileDeps(d.drain.stopping, path)
+	d.health.reconciled.Store(true)
+
 	lastEventTime := make(map[string]time.Time)
 	var maplock sync.Mutex
 
+	// proves to /healthz that this loop is not stuck
+	beat := time.NewTicker(watcherBeatEvery)
+	defer beat.Stop()
+
 	for {
 		select {
 
+		// Shutdown, nothing new gets queued
+		case <-d.drain.stopping.Done():
+			log.Printf("👋 Stopped watching %s", path)
+			return
+
+		case <-beat.C:
+			d.health.beat()
+			d.retryBacklog()
+
 		case event, ok := <-watcher.Events:
 			if !ok {
 				return
@@ -133,6 +415,10 @@ func (d *Daemon) watchFiles() {
 			isWrite := event.Op&fsnotify.Write == fsnotify.Write
 			isCreate := event.Op&fsnotify.Create == fsnotify.Create
 
+			if !isDep || !(isWrite || isCreate) {
+				d.metrics.watchEvent(watchIgnored)
+			}
+
 			if isDep && (isWrite || isCreate) {
 
 				maplock.Lock()
@@ -145,6 +431,7 @@ func (d *Daemon) watchFiles() {
 					// Debounce: If less than 500ms, ignore.
 					// (Reduced from 1s to 500ms to feel more responsive to manual edits)
 					maplock.Unlock()
+					d.metrics.watchEvent(watchDebounced)
 					continue
 				}
 				lastEventTime[event.Name] = now
@@ -157,16 +444,31 @@ func (d *Daemon) watchFiles() {
 
 				if err != nil {
 					log.Printf("⚠️ Check filename format: %v", err)
+					d.metrics.watchEvent(watchIgnored)
 					continue
 				}
 
 				version := readFile(service)
 				if version == "" {
+					d.metrics.watchEvent(watchIgnored)
+					continue
+				}
+
+				// the api already queued this exact write
+				if d.jobStates.expectedWrite(service, version) {
+					d.metrics.watchEvent(watchAPI)
 					continue
 				}
 
-				// Send job
-				d.jobs <- DeployService{service: service, version: version, namespace: namespace}
+				// Send job, never waits for the queue
+				d.metrics.watchEvent(watchQueued)
+				job := DeployService{service: service, version: version, namespace: namespace, trigger: TriggerWatch}
+				if _, err := d.enqueue(job); err != nil {
+					log.Printf("⚠️ Could not queue %s, trying again in %s: %v", filepath.Base(service), watcherBeatEvery, err)
+					d.jobStates.holdBack(job)
+				} else {
+					d.jobStates.release(service)
+				}
 			}
 
 		case err, ok := <-watcher.Errors:
@@ -179,8 +481,37 @@ func (d *Daemon) watchFiles() {
 	}
 }
 
+// queues what the watcher could not, with whatever the .dep holds now
+// writes a full queue refused (watcher or api), tried again on every beat
+func (d *Daemon) retryBacklog() {
+	for _, job := range d.jobStates.heldBack() {
+		depFile := job.service
+		job.version = readFile(depFile)
+		if job.version == "" {
+			d.jobStates.release(depFile)
+			continue
+		}
+		if _, err := d.enqueue(job); err != nil {
+			// still full, the rest has to wait too
+			return
+		}
+		log.Printf("📥 Queued %s from the backlog", filepath.Base(depFile))
+		d.jobStates.release(depFile)
+	}
+}
+
 func (d *Daemon) DeployService(job DeployService) {
 
+	// every stage below takes it: a cancel request, a newer version or the
+	// end of the shutdown grace period stops the job through it
+	ctx, cancel := context.WithCancelCause(d.drain.aborting)
+	defer cancel(nil)
+	if !d.jobStates.run(job.id, cancel) {
+		log.Printf("⏹️  Job %s was cancelled while queued", job.id)
+		return
+	}
+	defer d.jobStates.stopped(job.id)
+
 	//get the lock for the service
 	lock := d.getServiceLocker(job.service)
 
@@ -188,13 +519,25 @@ func (d *Daemon) DeployService(job DeployService) {
 	lock.Lock()
 	defer lock.Unlock()
 
+	// cancelled while waiting for the lock
+	if ctx.Err() != nil {
+		d.jobStates.setState(job.id, stoppedOutcome(ctx), context.Cause(ctx))
+		return
+	}
+
 	// fmt.Printf("[DEPLOY] Processing: %s\n", job.service)
 
 	depFile := job.service
-	lastfile := strings.Replace(depFile, ".dep", ".last", 1)
+
+	serviceName, namespace, err := extractServiceName(depFile)
+	if err != nil {
+		log.Printf("❌ Invalid filename: %v", err)
+		d.jobStates.setState(job.id, OutcomeInvalid, err)
+		return
+	}
 
 	newVersion := readFile(job.service)
-	lastVersion := readFile(lastfile)
+	lastVersion := d.lastGood(depFile, serviceName, namespace)
 
 	// the reason we ingore the ns because for a new ns the process is different
 
@@ -204,49 +547,127 @@ func (d *Daemon) DeployService(job DeployService) {
 	// fmt.Printf("[COMPARE] New: %s/%s | Last: %s/%s\n",
 	// 	newNamespace, newVersion, lastNamespace, lastVersion)
 
-	if newVersion != lastVersion {
+	if newVersion != lastVersion || job.force {
 
-		serviceName, namespace, err := extractServiceName(depFile)
+		versionAtStart := newVersion
+
+		// every attempt gets a history row, whatever happens below
+		rec := &deploymentRecord{Service: serviceName, Namespace: namespace, Spec: newVersion, Trigger: job.trigger, JobID: job.id}
+
+		spec, err := parseDepSpec(newVersion)
 		if err != nil {
-			log.Printf("❌ Invalid filename: %v", err)
+			log.Printf("❌ Invalid .dep file %s: %v", depFile, err)
+			rec.Version = "invalid .dep"
+			d.finishAttempt(rec, OutcomeInvalid, err)
+			d.notifyResult(err, serviceName, DepSpec{Version: "invalid .dep"}, namespace, deployResult{})
 			return
 		}
-		versionAtStart := newVersion
-		err1 := d.DeployTok8s(serviceName, newVersion, namespace)
-		slackengine(err1, serviceName, newVersion, namespace)
+		rec.Version = spec.String()
+
+		approvedBy := ""
+		if policy := d.config.approval(namespace); policy != nil {
+			// holds the lock (and this worker) until someone decides
+			d.jobStates.setState(job.id, JobAwaitingApproval, nil)
+			rec.ApprovedBy, err = d.awaitApproval(ctx, serviceName, namespace, spec, policy)
+			if ctx.Err() != nil {
+				d.stopAttempt(ctx, rec, spec)
+				return
+			}
+			if err != nil {
+				log.Printf("❌ Not deploying %s to %s: %v", serviceName, namespace, err)
+				d.finishAttempt(rec, OutcomeRejected, err)
+				return
+			}
+			approvedBy = "\napproved by:" + rec.ApprovedBy
+		}
 
-		if err1 != nil {
-			fmt.Printf("[ERROR] Deployment failed: %v\n", err1)
+		d.beginAttempt(rec)
 
-			log.Printf("⏸️  Waiting 60 seconds before next attempt...")
-			time.Sleep(3 * time.Second)
+		d.notify(Notification{
+			Message: "Deployment Started",
+			Details: fmt.Sprintf(
+				"service:%s\nversion:%s\nnamespace:%s",
+				serviceName,
+				spec,
+				namespace,
+			) + approvedBy + spec.details(),
+			MessageType: MsgDeploymentStarted,
+			Thread:      threadKey(serviceName, namespace),
+		})
+
+		result, err1 := d.DeployTok8s(ctx, serviceName, spec, namespace)
+		rec.Kind, rec.OldImage, rec.NewImage = result.Kind, result.OldImage, result.NewImage
+		rec.Conflicts, rec.Report = result.Conflicts, result.Report
+
+		if err1 != nil && ctx.Err() != nil {
+			d.stopAttempt(ctx, rec, spec)
 			return
+		}
 
+		if err1 != nil && result.Rollback != nil {
+			// the new image made it into the cluster and broke the rollout,
+			// put the previous one back instead of leaving it half rolled
+			rec.RollbackImage = result.Rollback.Image
+			if rollbackErr := d.rollbackTok8s(ctx, err1, serviceName, spec, namespace, result); rollbackErr != nil {
+				rec.RollbackError = rollbackErr.Error()
+				if ctx.Err() != nil {
+					// stopped halfway through the rollback
+					d.stopAttempt(ctx, rec, spec)
+					return
+				}
+				d.failAttempt(job, rec, OutcomeRollbackFailed, spec, err1)
+			} else {
+				d.failAttempt(job, rec, OutcomeRolledBack, spec, err1)
+			}
 		} else {
+			d.notifyResult(err1, serviceName, spec, namespace, result)
+			if err1 != nil {
+				// retried or not, see retry.go
+				d.failAttempt(job, rec, OutcomeFailed, spec, err1)
+			} else {
+				d.finishAttempt(rec, OutcomeSucceeded, nil)
+			}
+		}
 
-			content := newVersion
-			os.WriteFile(lastfile, []byte(content), 0644)
-			log.Printf("✅ Updated .last file to %s", newVersion)
+		if err1 != nil {
+			fmt.Printf("[ERROR] Deployment failed: %v\n", err1)
+			// a retry comes back through the queue after its backoff, no worker waits for it
+			return
+
+		} else {
+			d.saveLastGood(depFile, serviceName, namespace, newVersion, rec)
 		}
 		currentVersion := readFile(depFile)
-		if currentVersion != versionAtStart {
+		if currentVersion != versionAtStart && d.jobStates.pendingFor(serviceName, namespace, job.id) {
+			// the watcher already queued the newer version
+			log.Printf("🔄 File changed during deployment (%s → %s), already queued", versionAtStart, currentVersion)
+		} else if currentVersion != versionAtStart {
 			log.Printf("🔄 File changed during deployment (%s → %s), re-enqueueing",
 				versionAtStart, currentVersion)
 
-			d.jobs <- DeployService{
+			_, err := d.enqueue(DeployService{
 				service:   job.service,
 				version:   currentVersion, //suing current version
 				namespace: namespace,
+				trigger:   TriggerRequeue,
+			})
+			if err != nil {
+				log.Printf("⚠️ Could not re-enqueue %s, the next reconcile picks it up: %v", depFile, err)
 			}
 		} else {
 			log.Printf("📝 File unchanged, no re-enqueue")
 		}
 	} else {
 		log.Printf("⏭️  Skipped: versions already match")
+		d.jobStates.setState(job.id, JobSkipped, nil)
 	}
 
 }
 
+func lastFilePath(depFile string) string {
+	return strings.TrimSuffix(depFile, ".dep") + ".last"
+}
+
 func readFile(filepath string) string {
 	content, err := os.ReadFile(filepath)
 	if err != nil {
@@ -259,43 +680,83 @@ func readFile(filepath string) string {
 	return text
 }
 
-func slackengine(err error, serviceName string, newVersion string, newNamespace string) {
+func (d *Daemon) notifyResult(err error, serviceName string, spec DepSpec, newNamespace string, result deployResult) {
 
 	if err != nil {
 
 		log.Printf("❌ Deployment failed: %v", err)
 
-		SlackNotifier(SlackMessage{
+		d.notify(Notification{
 			Message: "Deployment Failed",
 			Details: fmt.Sprintf(
 				"service:%s\nversion:%s\nnamespace:%s\nerror:%s",
 				serviceName,
-				newVersion,
+				spec,
 				newNamespace,
 				err.Error(),
-			),
+			) + spec.details() + result.details(),
 			MessageType: MsgDeploymentFailure,
+			Logs:        truncateForNotify(result.Diagnostics),
+			Thread:      threadKey(serviceName, newNamespace),
 		})
 
 	} else {
 
 		log.Printf("✅ Deployment succeeded")
 
-		SlackNotifier(SlackMessage{
+		d.notify(Notification{
 			Message: "Deployment Successful",
 			Details: fmt.Sprintf(
 				"service:%s\nversion:%s\nnamespace:%s",
 				serviceName,
-				newVersion,
+				spec,
 				newNamespace,
-			),
+			) + spec.details() + result.details(),
 			MessageType: MsgDeploymentSuccess,
+			Thread:      threadKey(serviceName, newNamespace),
 		})
 
 	}
 
 }
 
+// OutcomeInterrupted for a shutdown, OutcomeCancelled for everything else
+func stoppedOutcome(ctx context.Context) string {
+	if errors.Is(context.Cause(ctx), errInterrupted) {
+		return OutcomeInterrupted
+	}
+	return OutcomeCancelled
+}
+
+// the job's context ended, that is not a failure: no rollback (the rollout may
+// still finish on its own), whoever stopped it decides what comes next
+// a shutdown's restart redoes it anyway (.dep != last good)
+func (d *Daemon) stopAttempt(ctx context.Context, rec *deploymentRecord, spec DepSpec) {
+
+	cause := context.Cause(ctx)
+	outcome := stoppedOutcome(ctx)
+
+	log.Printf("⏹️  [%s/%s] deployment %s: %v", rec.Namespace, rec.Service, outcome, cause)
+	d.finishAttempt(rec, outcome, cause)
+
+	message, messageType := "Deployment Cancelled", MsgDeploymentCancelled
+	if outcome == OutcomeInterrupted {
+		message, messageType = "Deployment Interrupted", MsgDeploymentInterrupted
+	}
+	d.notify(Notification{
+		Message: message,
+		Details: fmt.Sprintf(
+			"service:%s\nversion:%s\nnamespace:%s\nreason:%s",
+			rec.Service,
+			spec,
+			rec.Namespace,
+			cause,
+		) + spec.details(),
+		MessageType: messageType,
+		Thread:      threadKey(rec.Service, rec.Namespace),
+	})
+}
+
 func extractServiceName(filePath string) (string, string, error) {
 
 	filename := filepath.Base(filePath)
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	k8smetrics "k8s.io/client-go/tools/metrics"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ METRICS @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ the emoji log lines were the only way to see what the daemon does,
+ GET /metrics (prometheus text format, no token) on HTTP_ADDR now has:
+
+ deploy_engine_queue_depth / _queue_capacity        pending rows of the job queue
+ deploy_engine_workers / _workers_busy              worker pool usage
+ deploy_engine_deployments_total                    attempts by service, namespace, outcome
+ deploy_engine_failures_total                       failed attempts by error class and what followed (retry.go)
+ deploy_engine_rollout_duration_seconds             WaitForRollout time by service, namespace, result
+ deploy_engine_kubernetes_api_errors_total          failed client-go requests by method and code
+ deploy_engine_watch_events_total                   fsnotify events: queued, debounced, ignored, api
+ deploy_engine_notification_failures_total          failed deliveries by notifier, dead letters apart
+ deploy_engine_is_leader / _leader{identity}        leader election (leader.go)
+
+ a stuck engine shows up as queue_depth > 0 with workers_busy == workers and
+ no new deployments_total for a while
+
+ every daemon has its own registry so tests can build as many as they like,
+ the client-go hook is process wide and shared by all of them
+*/
+
+type engineMetrics struct {
+	registry *prometheus.Registry
+
+	workersBusy          prometheus.Gauge
+	deployments          *prometheus.CounterVec
+	failures             *prometheus.CounterVec
+	rolloutDuration      *prometheus.HistogramVec
+	watchEvents          *prometheus.CounterVec
+	notificationFailures *prometheus.CounterVec
+	leader               *prometheus.GaugeVec
+}
+
+// client-go only takes one hook per process
+var kubernetesAPIErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "deploy_engine",
+	Name:      "kubernetes_api_errors_total",
+	Help:      "Kubernetes API requests that failed, by HTTP method and status code (<error> for transport errors).",
+}, []string{"method", "code"})
+
+type kubernetesResults struct{}
+
+func (kubernetesResults) Increment(ctx context.Context, code string, method string, host string) {
+	if !strings.HasPrefix(code, "2") {
+		kubernetesAPIErrors.WithLabelValues(method, code).Inc()
+	}
+}
+
+func init() {
+	k8smetrics.Register(k8smetrics.RegisterOpts{RequestResult: kubernetesResults{}})
+}
+
+func newEngineMetrics(d *Daemon) *engineMetrics {
+
+	m := &engineMetrics{
+		registry: prometheus.NewRegistry(),
+		workersBusy: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "deploy_engine",
+			Name:      "workers_busy",
+			Help:      "Workers currently running a job.",
+		}),
+		deployments: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "deploy_engine",
+			Name:      "deployments_total",
+			Help:      "Finished deployment attempts by service, namespace and outcome.",
+		}, []string{"service", "namespace", "outcome"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "deploy_engine",
+			Name:      "failures_total",
+			Help:      "Failed deployment attempts by error class and decision (retry, dead-letter, failed, superseded).",
+		}, []string{"class", "decision"}),
+		rolloutDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "deploy_engine",
+			Name:      "rollout_duration_seconds",
+			Help:      "Time WaitForRollout waited for a rollout (or its rollback) to become healthy or fail.",
+			Buckets:   []float64{5, 10, 20, 30, 60, 120, 240, 480, 900},
+		}, []string{"service", "namespace", "result"}),
+		watchEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "deploy_engine",
+			Name:      "watch_events_total",
+			Help:      "fsnotify events on the DEPS folder by what happened to them.",
+		}, []string{"result"}),
+		notificationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "deploy_engine",
+			Name:      "notification_failures_total",
+			Help:      "Failed notification deliveries by notifier, dead=true when the outbox gave up.",
+		}, []string{"notifier", "dead"}),
+		leader: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "deploy_engine",
+			Name:      "leader",
+			Help:      "1 for the replica holding the lease as this replica sees it (LEADER_ELECT only).",
+		}, []string{"identity"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		kubernetesAPIErrors,
+		m.workersBusy,
+		m.deployments,
+		m.failures,
+		m.rolloutDuration,
+		m.watchEvents,
+		m.notificationFailures,
+		m.leader,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "deploy_engine",
+			Name:      "is_leader",
+			Help:      "1 when this replica consumes jobs (always without leader election).",
+		}, func() float64 {
+			if d.leader.isLeader() {
+				return 1
+			}
+			return 0
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "deploy_engine",
+			Name:      "queue_depth",
+			Help:      "Jobs waiting in the queue for a worker.",
+		}, func() float64 {
+			pending, _ := d.store.countJobs(QueuePending)
+			return float64(pending)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "deploy_engine",
+			Name:      "queue_capacity",
+			Help:      "Size of the job queue, new jobs are refused once queue_depth reaches it.",
+		}, func() float64 { return float64(d.opts.QueueSize) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "deploy_engine",
+			Name:      "workers",
+			Help:      "Size of the worker pool.",
+		}, func() float64 { return float64(d.opts.Workers) }),
+	)
+	return m
+}
+
+func (m *engineMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// fsnotify event results
+const (
+	watchQueued    = "queued"
+	watchDebounced = "debounced"
+	watchIgnored   = "ignored"
+	// the api queued that write itself
+	watchAPI = "api"
+)
+
+// the outbox also runs without a daemon (tests), so these are nil safe
+
+func (m *engineMetrics) watchEvent(result string) {
+	if m != nil {
+		m.watchEvents.WithLabelValues(result).Inc()
+	}
+}
+
+func (m *engineMetrics) deployment(serviceName string, namespace string, outcome string) {
+	if m != nil {
+		m.deployments.WithLabelValues(serviceName, namespace, outcome).Inc()
+	}
+}
+
+func (m *engineMetrics) failure(class string, decision string) {
+	if m != nil {
+		m.failures.WithLabelValues(class, decision).Inc()
+	}
+}
+
+func (m *engineMetrics) rollout(serviceName string, namespace string, took time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	result := "healthy"
+	if err != nil {
+		result = "failed"
+	}
+	m.rolloutDuration.WithLabelValues(serviceName, namespace, result).Observe(took.Seconds())
+}
+
+func (m *engineMetrics) setLeader(identity string) {
+	if m != nil {
+		m.leader.Reset()
+		m.leader.WithLabelValues(identity).Set(1)
+	}
+}
+
+func (m *engineMetrics) notificationFailed(notifier string, dead bool) {
+	if m == nil {
+		return
+	}
+	label := "false"
+	if dead {
+		label = "true"
+	}
+	m.notificationFailures.WithLabelValues(notifier, label).Inc()
+}
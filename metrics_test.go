@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, d *Daemon) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	d.httpHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/metrics: %d", rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestMetricsAfterDeployment(t *testing.T) {
+	d, _ := newTestDaemon(t,
+		testNamespace("default"),
+		testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1),
+	)
+
+	depFile := filepath.Join(d.opts.DepsPath, "nginx-app_default.dep")
+	os.WriteFile(depFile, []byte("1.1.0"), 0644)
+	d.DeployService(DeployService{service: depFile, version: "1.1.0", namespace: "default"})
+
+	body := scrape(t, d)
+	for _, want := range []string{
+		`deploy_engine_deployments_total{namespace="default",outcome="succeeded",service="nginx-app"} 1`,
+		`deploy_engine_rollout_duration_seconds_count{namespace="default",result="healthy",service="nginx-app"} 1`,
+		`deploy_engine_queue_depth 0`,
+		`deploy_engine_queue_capacity 500`,
+		`deploy_engine_workers 100`,
+		`deploy_engine_workers_busy 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
+
+func TestMetricsCountNotificationFailures(t *testing.T) {
+	d, _ := newTestDaemon(t)
+
+	url, _ := captureServer(t, http.StatusBadRequest)
+	d.outbox = testOutbox(t, t.TempDir(), newWebhookNotifier(url))
+	d.outbox.metrics = d.metrics
+
+	d.notify(testNotification)
+	if err := flushWithin(t, d.outbox, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// a 400 is not retried, straight to the dead letters
+	if body := scrape(t, d); !strings.Contains(body, `deploy_engine_notification_failures_total{dead="true",notifier="webhook"} 1`) {
+		t.Errorf("failure not counted:\n%s", body)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ NOTIFIERS @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ notifications used to be hard wired to one slack webhook, half of the org
+ lives in teams / discord / email
+
+ every backend implements Notifier and is enabled by its own env, the daemon
+ fans each Notification out to all of them through the outbox (outbox.go),
+ one lane per backend so a slow SMTP server never holds up slack (or a worker)
+
+	WEBHOOK_FOR_SLACK     slack incoming webhook
+	SLACK_BOT_TOKEN + SLACK_CHANNEL   slack app, one threaded message per deployment
+	TEAMS_WEBHOOK_URL     teams incoming webhook / workflow url (adaptive card)
+	DISCORD_WEBHOOK_URL   discord webhook (embed)
+	NOTIFY_WEBHOOK_URL    generic json POST for anything else
+	SMTP_ADDR + SMTP_FROM + SMTP_TO   email (SMTP_USER / SMTP_PASSWORD optional)
+
+ a Notification is backend neutral: Message is the title, Details are
+ "key:value" lines, each backend renders them its own way
+*/
+
+type Notification struct {
+	Message     string
+	Details     string
+	MessageType string
+	// multi line text (pod logs, events) shown as a code block under the fields
+	Logs string
+	// "{namespace}/{service}", ties started / progress / outcome of one deployment
+	// together (the service lock allows only one deployment per key at a time)
+	Thread string `json:",omitempty"`
+}
+
+func threadKey(serviceName string, namespace string) string {
+	return namespace + "/" + serviceName
+}
+
+const (
+	MsgDeploymentSuccess    = "deployment-success"
+	MsgDeploymentFailure    = "deployment-failure"
+	MsgInternalSysFailure   = "internal-system-failure"
+	MsgNameSpaceError       = "namepsace-issue"
+	MsgDriftDetected        = "drift-detected"
+	MsgDeploymentRolledBack = "deployment-rolled-back"
+	MsgDeploymentRejected   = "deployment-rejected"
+	MsgApprovalExpired      = "approval-expired"
+	// the daemon stopped before the deployment finished / someone cancelled it
+	MsgDeploymentInterrupted = "deployment-interrupted"
+	MsgDeploymentCancelled   = "deployment-cancelled"
+	// every retry failed, see retry.go
+	MsgDeploymentDeadLetter = "deployment-dead-letter"
+	// the approval request itself, posted by approvals not by notify
+	MsgApprovalRequested = "approval-requested"
+	// only for backends that keep one message per deployment, see progressNotifier
+	MsgDeploymentStarted  = "deployment-started"
+	MsgDeploymentProgress = "deployment-progress"
+)
+
+type Notifier interface {
+	// short name for the logs, "slack", "teams", ...
+	Name() string
+	// delivers one notification, blocking until it is sent or ctx is done
+	Notify(ctx context.Context, msg Notification) error
+}
+
+// backends that update one message per deployment in place (slack app) also
+// get the started / progress notifications, a webhook posting each of them
+// would flood the channel
+type progressNotifier interface {
+	Notifier
+	notifiesProgress()
+}
+
+func wants(n Notifier, msg Notification) bool {
+	if msg.MessageType != MsgDeploymentStarted && msg.MessageType != MsgDeploymentProgress {
+		return true
+	}
+	_, ok := n.(progressNotifier)
+	return ok
+}
+
+// every notifier whose env is set
+func loadNotifiers() []Notifier {
+
+	notifiers := []Notifier{}
+
+	if url := getUrl(); url != "" {
+		notifiers = append(notifiers, newSlackNotifier(url))
+	}
+	if token, channel := os.Getenv("SLACK_BOT_TOKEN"), os.Getenv("SLACK_CHANNEL"); token != "" && channel != "" {
+		notifiers = append(notifiers, newSlackAppNotifier(token, channel, ""))
+	}
+	if url := os.Getenv("TEAMS_WEBHOOK_URL"); url != "" {
+		notifiers = append(notifiers, newTeamsNotifier(url))
+	}
+	if url := os.Getenv("DISCORD_WEBHOOK_URL"); url != "" {
+		notifiers = append(notifiers, newDiscordNotifier(url))
+	}
+	if url := os.Getenv("NOTIFY_WEBHOOK_URL"); url != "" {
+		notifiers = append(notifiers, newWebhookNotifier(url))
+	}
+	if email := emailFromEnv(); email != nil {
+		notifiers = append(notifiers, email)
+	}
+
+	names := []string{}
+	for _, n := range notifiers {
+		names = append(names, n.Name())
+	}
+	if len(names) == 0 {
+		log.Println("⚠️ No notifier configured, notifications only go to the log")
+	} else {
+		log.Printf("📣 Notifiers enabled: %s", strings.Join(names, ", "))
+	}
+
+	return notifiers
+}
+
+// queued in the outbox, delivered (and retried) by one lane per backend
+func (d *Daemon) notify(msg Notification) {
+	// api clients following a job see the same progress lines
+	if msg.MessageType == MsgDeploymentProgress {
+		d.jobStates.progress(msg.Thread, msg.Message)
+	}
+	d.outbox.enqueue(msg)
+}
+
+func getColor(errorMsg string) (color, emoji string) {
+
+	switch errorMsg {
+
+	case MsgDeploymentSuccess:
+		return "good", "✅"
+	case MsgDeploymentFailure:
+		return "danger", "❌"
+	case MsgInternalSysFailure:
+		return "warning", "⚠️"
+	case MsgDriftDetected:
+		return "warning", "🔀"
+	case MsgDeploymentRolledBack:
+		return "warning", "⏪"
+	case MsgDeploymentRejected:
+		return "danger", "🚫"
+	case MsgDeploymentDeadLetter:
+		return "danger", "☠️"
+	case MsgApprovalExpired:
+		return "warning", "⌛"
+	case MsgDeploymentInterrupted, MsgDeploymentCancelled:
+		return "warning", "⏹️"
+	case MsgApprovalRequested:
+		return "warning", "🔐"
+	case MsgDeploymentStarted:
+		return "#439FE0", "🚀"
+	case MsgDeploymentProgress:
+		return "#439FE0", "⏳"
+	default:
+		return "warning", "ℹ️"
+
+	}
+
+}
+
+type detailField struct {
+	Title string
+	Value string
+	// fits next to another field
+	Short bool
+}
+
+// "Previous Image" -> "previous_image"
+func (f detailField) key() string {
+	return strings.ReplaceAll(strings.ToLower(f.Title), " ", "_")
+}
+
+func parseDetails(details string) []detailField {
+	if details == "" {
+		return []detailField{}
+	}
+
+	fields := []detailField{}
+	lines := strings.Split(details, "\n")
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		title := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		title = strings.Title(strings.ToLower(title))
+
+		short := true
+		titleLower := strings.ToLower(title)
+
+		if titleLower == "error" || titleLower == "message" || len(value) > 50 {
+			short = false
+		}
+
+		fields = append(fields, detailField{
+			Title: title,
+			Value: value,
+			Short: short,
+		})
+	}
+	return fields
+}
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// POSTs payload as json, anything but 2xx is an error
+// ctx ends the request early, the client timeout still caps a live one
+func postJSON(ctx context.Context, url string, payload interface{}) error {
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		reply, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &deliveryError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       strings.TrimSpace(string(reply)),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+	return nil
+}
+
+// cuts s to n bytes for backends with hard field limits
+func clip(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n-3], "") + "..."
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNotification = Notification{
+	Message:     "Deployment Failed",
+	Details:     "service:nginx-app\nnamespace:default\nprevious image:test.ecr.local/app:1.0.0\nerror:crash loop",
+	MessageType: MsgDeploymentFailure,
+	Logs:        "panic: boom",
+}
+
+// httptest server that hands every request body to the returned channel
+func captureServer(t *testing.T, status int) (string, chan []byte) {
+	t.Helper()
+	bodies := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, bodies
+}
+
+func TestJSONNotifiers(t *testing.T) {
+	tests := []struct {
+		name     string
+		notifier func(url string) Notifier
+		want     []string
+	}{
+		{"slack", func(url string) Notifier { return newSlackNotifier(url) },
+			[]string{`"color":"danger"`, `"title":"Previous Image"`, "```panic: boom```"}},
+		{"teams", func(url string) Notifier { return newTeamsNotifier(url) },
+			[]string{`"AdaptiveCard"`, `"color":"Attention"`, `"title":"Service","value":"nginx-app"`, `"fontType":"Monospace"`}},
+		{"discord", func(url string) Notifier { return newDiscordNotifier(url) },
+			[]string{`"embeds"`, `"color":14687834`, `"name":"Error"`, `"inline":false`, "panic: boom"}},
+		{"webhook", func(url string) Notifier { return newWebhookNotifier(url) },
+			[]string{`"type":"deployment-failure"`, `"previous_image":"test.ecr.local/app:1.0.0"`, `"logs":"panic: boom"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, bodies := captureServer(t, http.StatusOK)
+
+			n := tt.notifier(url)
+			if n.Name() != tt.name {
+				t.Errorf("name: got %s", n.Name())
+			}
+			if err := n.Notify(context.TODO(), testNotification); err != nil {
+				t.Fatalf("notify: %v", err)
+			}
+
+			body := <-bodies
+			if !json.Valid(body) {
+				t.Fatalf("payload is not json: %s", body)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(body), want) {
+					t.Errorf("payload missing %s:\n%s", want, body)
+				}
+			}
+		})
+	}
+}
+
+func TestPostJSONRejectsNon2xx(t *testing.T) {
+	url, _ := captureServer(t, http.StatusBadRequest)
+
+	err := newDiscordNotifier(url).Notify(context.TODO(), testNotification)
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("expected 400 error, got %v", err)
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	t.Setenv("SMTP_ADDR", "smtp.example.com:587")
+	t.Setenv("SMTP_FROM", "engine@example.com")
+	t.Setenv("SMTP_TO", "oncall@example.com, team@example.com")
+
+	e := emailFromEnv()
+	if e == nil {
+		t.Fatal("email notifier not enabled")
+	}
+
+	var gotTo []string
+	var gotMsg string
+	e.send = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		gotTo, gotMsg = to, string(msg)
+		return nil
+	}
+
+	if err := e.Notify(context.TODO(), testNotification); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(gotTo) != 2 || gotTo[1] != "team@example.com" {
+		t.Errorf("recipients: %v", gotTo)
+	}
+	for _, want := range []string{"Subject: =?utf-8?q?", "nginx-app", "Error: crash loop", "panic: boom"} {
+		if !strings.Contains(gotMsg, want) {
+			t.Errorf("mail missing %q:\n%s", want, gotMsg)
+		}
+	}
+}
+
+func TestLoadNotifiers(t *testing.T) {
+	for _, env := range []string{"WEBHOOK_FOR_SLACK", "TEAMS_WEBHOOK_URL", "DISCORD_WEBHOOK_URL", "NOTIFY_WEBHOOK_URL", "SMTP_ADDR"} {
+		t.Setenv(env, "")
+	}
+	t.Setenv("TEAMS_WEBHOOK_URL", "http://teams.local/hook")
+	t.Setenv("NOTIFY_WEBHOOK_URL", "http://hooks.local/deploy")
+
+	names := []string{}
+	for _, n := range loadNotifiers() {
+		names = append(names, n.Name())
+	}
+	if strings.Join(names, ",") != "teams,webhook" {
+		t.Errorf("expected teams,webhook, got %v", names)
+	}
+}
+
+func TestDaemonNotifyFansOut(t *testing.T) {
+	teamsURL, teams := captureServer(t, http.StatusOK)
+	// a failing backend must not stop the others
+	brokenURL, _ := captureServer(t, http.StatusInternalServerError)
+	hookURL, hook := captureServer(t, http.StatusOK)
+
+	d, _ := newTestDaemon(t)
+	d.outbox = newOutbox(t.TempDir(), []Notifier{newDiscordNotifier(brokenURL), newTeamsNotifier(teamsURL), newWebhookNotifier(hookURL)})
+	d.outbox.start()
+
+	d.notify(testNotification)
+
+	for name, ch := range map[string]chan []byte{"teams": teams, "webhook": hook} {
+		select {
+		case <-ch:
+		case <-time.After(2 * time.Second):
+			t.Errorf("%s never got the notification", name)
+		}
+	}
+}
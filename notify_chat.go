@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ TEAMS / DISCORD / WEBHOOK @@@@@@@@@@@@@@@@@@@@@@@@
+// the json backends, they only differ in the payload they build
+
+// teams incoming webhook or workflow, posts an adaptive card
+type teamsNotifier struct {
+	url string
+}
+
+func newTeamsNotifier(url string) *teamsNotifier {
+	return &teamsNotifier{url: url}
+}
+
+func (t *teamsNotifier) Name() string { return "teams" }
+
+func (t *teamsNotifier) Notify(ctx context.Context, msg Notification) error {
+	return postJSON(ctx, t.url, teamsPayload(msg))
+}
+
+func teamsPayload(msg Notification) map[string]interface{} {
+
+	color, emoji := getColor(msg.MessageType)
+
+	// slack color names -> adaptive card colors
+	cardColor := map[string]string{"good": "Good", "danger": "Attention", "warning": "Warning"}[color]
+
+	facts := []map[string]string{}
+	for _, field := range parseDetails(msg.Details) {
+		facts = append(facts, map[string]string{"title": field.Title, "value": field.Value})
+	}
+
+	body := []map[string]interface{}{
+		{"type": "TextBlock", "text": emoji + " " + msg.Message, "weight": "Bolder", "size": "Medium", "color": cardColor, "wrap": true},
+		{"type": "FactSet", "facts": facts},
+	}
+	if msg.Logs != "" {
+		body = append(body, map[string]interface{}{"type": "TextBlock", "text": msg.Logs, "fontType": "Monospace", "wrap": true})
+	}
+
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]interface{}{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"body":    body,
+			},
+		}},
+	}
+}
+
+// discord webhook, posts one embed
+type discordNotifier struct {
+	url string
+}
+
+func newDiscordNotifier(url string) *discordNotifier {
+	return &discordNotifier{url: url}
+}
+
+func (d *discordNotifier) Name() string { return "discord" }
+
+func (d *discordNotifier) Notify(ctx context.Context, msg Notification) error {
+	return postJSON(ctx, d.url, discordPayload(msg))
+}
+
+func discordPayload(msg Notification) map[string]interface{} {
+
+	color, emoji := getColor(msg.MessageType)
+
+	// same colors slack uses for good / danger / warning
+	embedColor := map[string]int{"good": 0x2EB67D, "danger": 0xE01E5A, "warning": 0xECB22E}[color]
+
+	// discord rejects the whole embed when a limit is exceeded
+	fields := []map[string]interface{}{}
+	for _, field := range parseDetails(msg.Details) {
+		fields = append(fields, map[string]interface{}{
+			"name":   clip(field.Title, 256),
+			"value":  clip(field.Value, 1024),
+			"inline": field.Short,
+		})
+	}
+
+	embed := map[string]interface{}{
+		"title":  clip(emoji+" "+msg.Message, 256),
+		"color":  embedColor,
+		"fields": fields,
+	}
+	if msg.Logs != "" {
+		embed["description"] = "```" + clip(msg.Logs, 4000) + "```"
+	}
+
+	return map[string]interface{}{"embeds": []interface{}{embed}}
+}
+
+// generic json POST, for whatever else wants to listen
+type webhookNotifier struct {
+	url string
+}
+
+func newWebhookNotifier(url string) *webhookNotifier {
+	return &webhookNotifier{url: url}
+}
+
+func (w *webhookNotifier) Name() string { return "webhook" }
+
+func (w *webhookNotifier) Notify(ctx context.Context, msg Notification) error {
+	return postJSON(ctx, w.url, webhookPayload(msg))
+}
+
+/*
+	{
+	  "type": "deployment-failure",
+	  "message": "Deployment Failed",
+	  "details": {"service": "nginx-app", "namespace": "default", ...},
+	  "logs": "...",
+	  "time": "2024-05-01T10:00:00Z"
+	}
+*/
+func webhookPayload(msg Notification) map[string]interface{} {
+
+	// raw keys, no title casing, receivers match on them
+	details := map[string]string{}
+	for _, field := range parseDetails(msg.Details) {
+		details[field.key()] = field.Value
+	}
+
+	payload := map[string]interface{}{
+		"type":    msg.MessageType,
+		"message": msg.Message,
+		"details": details,
+		"time":    time.Now().UTC().Format(time.RFC3339),
+	}
+	if msg.Logs != "" {
+		payload["logs"] = msg.Logs
+	}
+	return payload
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ EMAIL @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+	SMTP_ADDR=smtp.example.com:587
+	SMTP_FROM=deploy-engine@example.com
+	SMTP_TO=oncall@example.com,team@example.com
+	SMTP_USER=...          # optional, PLAIN auth (net/smtp only sends it over TLS)
+	SMTP_PASSWORD=...
+
+ plain text mail, subject is the message + service, body the details and logs
+*/
+
+type emailNotifier struct {
+	addr string
+	from string
+	to   []string
+	auth smtp.Auth
+
+	// net/smtp.SendMail, swapped in tests
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// nil when SMTP_ADDR, SMTP_FROM or SMTP_TO is missing
+func emailFromEnv() *emailNotifier {
+
+	addr := os.Getenv("SMTP_ADDR")
+	from := os.Getenv("SMTP_FROM")
+
+	to := []string{}
+	for _, rcpt := range strings.Split(os.Getenv("SMTP_TO"), ",") {
+		if rcpt = strings.TrimSpace(rcpt); rcpt != "" {
+			to = append(to, rcpt)
+		}
+	}
+
+	if addr == "" || from == "" || len(to) == 0 {
+		return nil
+	}
+
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	return &emailNotifier{addr: addr, from: from, to: to, auth: auth, send: smtp.SendMail}
+}
+
+func (e *emailNotifier) Name() string { return "email" }
+
+// net/smtp takes no context, a hung server is left to finish in the
+// background once ctx is done
+func (e *emailNotifier) Notify(ctx context.Context, msg Notification) error {
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- e.send(e.addr, e.auth, e.from, e.to, e.build(msg))
+	}()
+
+	select {
+	case err := <-sent:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *emailNotifier) build(msg Notification) []byte {
+
+	_, emoji := getColor(msg.MessageType)
+
+	subject := emoji + " " + msg.Message
+	fields := parseDetails(msg.Details)
+	for _, field := range fields {
+		if field.key() == "service" {
+			subject += " - " + field.Value
+			break
+		}
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "From: %s\r\n", e.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+
+	fmt.Fprintf(&b, "%s\r\n\r\n", msg.Message)
+	for _, field := range fields {
+		fmt.Fprintf(&b, "%s: %s\r\n", field.Title, field.Value)
+	}
+	if msg.Logs != "" {
+		b.WriteString("\r\n")
+		b.WriteString(strings.ReplaceAll(msg.Logs, "\n", "\r\n"))
+		b.WriteString("\r\n")
+	}
+
+	return []byte(b.String())
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ NOTIFICATION OUTBOX @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ notify used to fire a goroutine per backend and forget about it, a 429 from
+ slack, a 502 from teams or a restart of the daemon and the message was gone
+
+ now every notification is written to disk first, one file per backend:
+	{STATE_DIR}/outbox/{time}_{seq}_{backend}.json
+
+ every backend has a lane (one goroutine) that delivers its files in order:
+ delivered               -> file removed
+ 429 / 5xx / network     -> retried with exponential backoff, Retry-After wins
+ other 4xx / too many    -> moved to outbox/dead/, someone has to look at it
+ a backend backing off holds its own lane only, slack being rate limited
+ never delays the email
+
+ files left over from a previous run are picked up on start, flush delivers
+ what is pending before shutdown and is the synchronous hook for tests
+
+ every delivery takes a context: the lanes run under the outbox's own, which
+ stop ends (shutdown), flush under the caller's deadline. a hung webhook or
+ slack call is abandoned when it ends, its entry stays as it was and goes out
+ on the next start
+*/
+
+type outboxEntry struct {
+	Notifier     string       `json:"notifier"`
+	Notification Notification `json:"notification"`
+	Attempts     int          `json:"attempts"`
+	NextAttempt  time.Time    `json:"nextAttempt"`
+	LastError    string       `json:"lastError,omitempty"`
+	Created      time.Time    `json:"created"`
+}
+
+type outbox struct {
+	dir       string
+	notifiers []Notifier
+	lanes     map[string]*outboxLane
+
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	maxAttempts int
+
+	seq atomic.Int64
+	// failed deliveries, nil without a daemon
+	metrics *engineMetrics
+
+	// the lanes' deliveries, cancelled by stop
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+type outboxLane struct {
+	notifier Notifier
+	// one delivery pass at a time, the lane goroutine and flush share it
+	mu   sync.Mutex
+	wake chan struct{}
+}
+
+func newOutbox(dir string, notifiers []Notifier) *outbox {
+
+	ctx, stop := context.WithCancel(context.Background())
+	o := &outbox{
+		ctx:         ctx,
+		stop:        stop,
+		dir:         dir,
+		notifiers:   notifiers,
+		lanes:       make(map[string]*outboxLane),
+		baseDelay:   time.Second,
+		maxDelay:    5 * time.Minute,
+		maxAttempts: 10,
+	}
+	for _, n := range notifiers {
+		o.lanes[n.Name()] = &outboxLane{notifier: n, wake: make(chan struct{}, 1)}
+	}
+	return o
+}
+
+// writes one entry per backend and wakes their lanes
+func (o *outbox) enqueue(msg Notification) {
+
+	for _, n := range o.notifiers {
+
+		if !wants(n, msg) {
+			continue
+		}
+
+		entry := outboxEntry{Notifier: n.Name(), Notification: msg, Created: time.Now()}
+		name := fmt.Sprintf("%d_%06d_%s.json", entry.Created.UnixNano(), o.seq.Add(1), n.Name())
+
+		if err := o.write(filepath.Join(o.dir, name), entry); err != nil {
+			// disk trouble, better a best effort send than nothing
+			log.Printf("⚠️ Outbox write failed, sending %s notification directly: %v", n.Name(), err)
+			go func(n Notifier) {
+				if err := n.Notify(o.ctx, msg); err != nil {
+					log.Printf("Failed to send %s notification: %v", n.Name(), err)
+				}
+			}(n)
+			continue
+		}
+
+		lane := o.lanes[n.Name()]
+		select {
+		case lane.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// starts one delivery goroutine per backend
+func (o *outbox) start() {
+	for _, lane := range o.lanes {
+		go o.runLane(lane)
+	}
+}
+
+func (o *outbox) runLane(lane *outboxLane) {
+
+	for {
+		next, pending := o.deliver(o.ctx, lane)
+
+		// nothing pending -> nil channel, only a new entry wakes us
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if pending > 0 {
+			timer = time.NewTimer(time.Until(next))
+			retry = timer.C
+		}
+
+		select {
+		case <-o.ctx.Done():
+			// stop, flush takes over what is left
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-lane.wake:
+		case <-retry:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// delivers everything pending before ctx is done, what is left stays on disk
+// for the next start
+func (o *outbox) flush(ctx context.Context) error {
+
+	var wg sync.WaitGroup
+	var left atomic.Int64
+
+	for _, lane := range o.lanes {
+		wg.Add(1)
+		go func(lane *outboxLane) {
+			defer wg.Done()
+			for {
+				next, pending := o.deliver(ctx, lane)
+				if pending == 0 {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					left.Add(int64(pending))
+					return
+				case <-time.After(time.Until(next)):
+				}
+			}
+		}(lane)
+	}
+	wg.Wait()
+
+	if n := left.Load(); n > 0 {
+		return fmt.Errorf("%d notifications still pending: %w", n, ctx.Err())
+	}
+	return nil
+}
+
+// one pass over the lane's files, oldest first, stops at the first one that
+// has to wait, returns when that is and how many are still pending
+func (o *outbox) deliver(ctx context.Context, lane *outboxLane) (time.Time, int) {
+
+	lane.mu.Lock()
+	defer lane.mu.Unlock()
+
+	files := o.files(lane.notifier.Name())
+
+	for i, path := range files {
+
+		entry, err := o.read(path)
+		if err != nil {
+			log.Printf("⚠️ Dropping unreadable outbox entry %s: %v", filepath.Base(path), err)
+			os.Remove(path)
+			continue
+		}
+
+		if time.Now().Before(entry.NextAttempt) {
+			return entry.NextAttempt, len(files) - i
+		}
+
+		err = lane.notifier.Notify(ctx, entry.Notification)
+		if err == nil {
+			os.Remove(path)
+			continue
+		}
+		if ctx.Err() != nil {
+			// we gave up on it, not the backend, no attempt counted
+			return time.Now(), len(files) - i
+		}
+
+		entry.Attempts++
+		entry.LastError = err.Error()
+
+		retry, wait := retryable(err)
+		dead := !retry || entry.Attempts >= o.maxAttempts
+		o.metrics.notificationFailed(entry.Notifier, dead)
+		if dead {
+			log.Printf("❌ Giving up on %s notification %q after %d attempts: %v", entry.Notifier, entry.Notification.Message, entry.Attempts, err)
+			o.bury(path, entry)
+			continue
+		}
+
+		if wait <= 0 {
+			wait = min(o.baseDelay<<(entry.Attempts-1), o.maxDelay)
+		}
+		entry.NextAttempt = time.Now().Add(wait)
+
+		log.Printf("⏳ %s notification failed (attempt %d), retrying in %s: %v", entry.Notifier, entry.Attempts, wait, err)
+
+		if err := o.write(path, entry); err != nil {
+			log.Printf("⚠️ Could not update outbox entry %s: %v", filepath.Base(path), err)
+		}
+		return entry.NextAttempt, len(files) - i
+	}
+
+	return time.Time{}, 0
+}
+
+// pending files of one backend, oldest first (names start with the time)
+func (o *outbox) files(notifier string) []string {
+
+	matches, _ := filepath.Glob(filepath.Join(o.dir, "*_"+notifier+".json"))
+	sort.Strings(matches)
+	return matches
+}
+
+// counts the entries still waiting for delivery, all backends
+func (o *outbox) pending() int {
+	total := 0
+	for name := range o.lanes {
+		total += len(o.files(name))
+	}
+	return total
+}
+
+func (o *outbox) read(path string) (outboxEntry, error) {
+	var entry outboxEntry
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return entry, err
+	}
+	return entry, json.Unmarshal(content, &entry)
+}
+
+// tmp + rename, a crash never leaves half an entry behind
+func (o *outbox) write(path string, entry outboxEntry) error {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (o *outbox) bury(path string, entry outboxEntry) {
+	dead := filepath.Join(o.dir, "dead", filepath.Base(path))
+	if err := o.write(dead, entry); err != nil {
+		log.Printf("⚠️ Could not move %s to the dead letter folder: %v", filepath.Base(path), err)
+	}
+	os.Remove(path)
+}
+
+// http answer a backend rejected the notification with
+type deliveryError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	// parsed Retry-After header, 0 when absent
+	RetryAfter time.Duration
+}
+
+func (e *deliveryError) Error() string {
+	if e.Body == "" {
+		return e.Status
+	}
+	return e.Status + ": " + e.Body
+}
+
+// should the outbox try again, and after how long (0 = its own backoff)
+func retryable(err error) (bool, time.Duration) {
+
+	var delivery *deliveryError
+	if errors.As(err, &delivery) {
+		if delivery.StatusCode == 429 || delivery.StatusCode >= 500 {
+			return true, delivery.RetryAfter
+		}
+		return false, 0
+	}
+
+	// slack web api
+	var rateLimited *slack.RateLimitedError
+	if errors.As(err, &rateLimited) {
+		return true, rateLimited.RetryAfter
+	}
+	var slackStatus slack.StatusCodeError
+	if errors.As(err, &slackStatus) {
+		return slackStatus.Retryable(), 0
+	}
+	var slackErr slack.SlackErrorResponse
+	if errors.As(err, &slackErr) {
+		// channel_not_found, invalid_auth, ... will not fix themselves
+		return slackErr.Err == "internal_error" || slackErr.Err == "fatal_error", 0
+	}
+
+	// smtp: 4xx are transient, 5xx permanent
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code < 500, 0
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true, 0
+	}
+
+	// unknown, most likely the network, keep trying until maxAttempts
+	return true, 0
+}
+
+// Retry-After is either seconds or an http date
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhook answering with the given statuses in order, 200 once they run out
+func flakyServer(t *testing.T, header http.Header, statuses ...int) (string, *atomic.Int64) {
+	t.Helper()
+	calls := &atomic.Int64{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		if n <= len(statuses) {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, calls
+}
+
+func testOutbox(t *testing.T, dir string, notifiers ...Notifier) *outbox {
+	o := newOutbox(dir, notifiers)
+	o.baseDelay = 10 * time.Millisecond
+	return o
+}
+
+func flushWithin(t *testing.T, o *outbox, timeout time.Duration) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return o.flush(ctx)
+}
+
+func TestOutboxRetriesServerErrors(t *testing.T) {
+	url, calls := flakyServer(t, nil, http.StatusBadGateway, http.StatusServiceUnavailable)
+	o := testOutbox(t, t.TempDir(), newSlackNotifier(url))
+
+	o.enqueue(testNotification)
+
+	if err := flushWithin(t, o, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 2 failures + 1 delivery, got %d calls", calls.Load())
+	}
+	if o.pending() != 0 {
+		t.Errorf("delivered entry still on disk")
+	}
+}
+
+func TestOutboxHonorsRetryAfter(t *testing.T) {
+	url, calls := flakyServer(t, http.Header{"Retry-After": {"1"}}, http.StatusTooManyRequests)
+	o := testOutbox(t, t.TempDir(), newSlackNotifier(url))
+
+	o.enqueue(testNotification)
+
+	start := time.Now()
+	if err := flushWithin(t, o, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// baseDelay is 10ms, only Retry-After explains a 1s wait
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("retried after %s, Retry-After asked for 1s", elapsed)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 calls, got %d", calls.Load())
+	}
+}
+
+func TestOutboxDeadLettersClientErrors(t *testing.T) {
+	url, calls := flakyServer(t, nil, http.StatusNotFound)
+	dir := t.TempDir()
+	o := testOutbox(t, dir, newSlackNotifier(url))
+
+	o.enqueue(testNotification)
+
+	if err := flushWithin(t, o, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("a 404 must not be retried, got %d calls", calls.Load())
+	}
+	dead, _ := filepath.Glob(filepath.Join(dir, "dead", "*_slack.json"))
+	if len(dead) != 1 {
+		t.Errorf("expected 1 dead letter, got %v", dead)
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	// first run: the webhook is down until shutdown
+	downURL, _ := flakyServer(t, nil, 500, 500, 500, 500, 500, 500, 500, 500, 500)
+	first := testOutbox(t, dir, newSlackNotifier(downURL))
+	first.enqueue(testNotification)
+
+	if err := flushWithin(t, first, 50*time.Millisecond); err == nil {
+		t.Fatal("expected flush to give up with the webhook down")
+	}
+	if first.pending() != 1 {
+		t.Fatalf("undelivered entry should stay on disk, pending=%d", first.pending())
+	}
+
+	// next start: same dir, webhook back
+	upURL, calls := flakyServer(t, nil)
+	second := testOutbox(t, dir, newSlackNotifier(upURL))
+
+	if err := flushWithin(t, second, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 1 || second.pending() != 0 {
+		t.Errorf("leftover not delivered: calls=%d pending=%d", calls.Load(), second.pending())
+	}
+}
+
+func TestOutboxLanesAreIndependent(t *testing.T) {
+	// slack rate limited for a long time, teams must still go out right away
+	slackURL, _ := flakyServer(t, http.Header{"Retry-After": {"60"}}, http.StatusTooManyRequests)
+	teamsURL, teamsCalls := flakyServer(t, nil)
+
+	o := testOutbox(t, t.TempDir(), newSlackNotifier(slackURL), newTeamsNotifier(teamsURL))
+	o.start()
+	o.enqueue(testNotification)
+
+	// the call is counted before the lane removes the delivered file
+	deadline := time.Now().Add(2 * time.Second)
+	for (teamsCalls.Load() == 0 || o.pending() != 1) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if teamsCalls.Load() != 1 {
+		t.Fatalf("teams not delivered while slack backs off")
+	}
+	if o.pending() != 1 {
+		t.Errorf("slack entry should still be pending, got %d", o.pending())
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		retry bool
+		wait  time.Duration
+	}{
+		{"rate limited", &deliveryError{StatusCode: 429, RetryAfter: 30 * time.Second}, true, 30 * time.Second},
+		{"server error", &deliveryError{StatusCode: 503}, true, 0},
+		{"bad request", &deliveryError{StatusCode: 400}, false, 0},
+		{"smtp transient", &textproto.Error{Code: 451, Msg: "try later"}, true, 0},
+		{"smtp permanent", &textproto.Error{Code: 550, Msg: "no such user"}, false, 0},
+		{"unknown", errors.New("connection reset"), true, 0},
+	}
+
+	for _, tt := range tests {
+		retry, wait := retryable(tt.err)
+		if retry != tt.retry || wait != tt.wait {
+			t.Errorf("%s: got %v/%s, want %v/%s", tt.name, retry, wait, tt.retry, tt.wait)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("120"); got != 2*time.Minute {
+		t.Errorf("seconds: got %s", got)
+	}
+	at := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(at); got < 50*time.Second || got > time.Minute {
+		t.Errorf("http date: got %s", got)
+	}
+	if got := parseRetryAfter("soon"); got != 0 {
+		t.Errorf("garbage: got %s", got)
+	}
+}
+
+// a webhook that never answers holds neither the lane nor the shutdown flush
+// past its deadline, the entry is left as it was for the next start
+func TestOutboxHungWebhookDoesNotBlockShutdown(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	d, _ := newTestDaemon(t)
+	d.outbox = testOutbox(t, t.TempDir(), newSlackNotifier(srv.URL))
+	d.outbox.start()
+	d.outbox.enqueue(testNotification)
+	// the lane is stuck in the call now
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := d.FlushNotifications(ctx); err == nil {
+		t.Fatal("expected the flush to give up")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("flush took %s, the notify client timeout decided it", took)
+	}
+
+	entry, err := d.outbox.read(d.outbox.files("slack")[0])
+	if err != nil || entry.Attempts != 0 {
+		t.Errorf("abandoned delivery counted as a failed attempt: %+v, %v", entry, err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/util/retry"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ PATCH + RETRY @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ Get -> Update of the whole object lost every race with the HPA (409) and
+ could clobber fields other managers own
+
+ now the change is made on a copy, only the diff is sent as a strategic merge
+ patch under our own field manager, with the resourceVersion we read as a
+ precondition so a concurrent write turns into a 409 instead of being lost.
+ deploys and rollbacks both need it: the template a deploy read is its
+ rollback point, and a rollback puts a whole template back, neither may
+ silently replace an edit made in between
+ 409 -> re-read, re-apply the change, retry with backoff (retry.RetryOnConflict)
+ an object that keeps changing (HPA, busy controllers) costs at most
+ DefaultBackoff's 5 tries, after that the attempt fails with the `conflict`
+ class and the queue retries it later (retry.go), no tight loop
+*/
+
+const fieldManager = "deployment-k8s-engine"
+
+// runs mutate on the latest object and patches the difference
+// returns how many conflicts we hit on the way
+func patchWorkload(ctx context.Context, target workload, mutate func(workload) error) (int, error) {
+
+	conflicts := 0
+	attempt := 0
+
+	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+
+		attempt++
+		if attempt > 1 {
+			// somebody else wrote in between, start again from their version
+			if err := target.refresh(ctx); err != nil {
+				return err
+			}
+		}
+
+		original := target.object().DeepCopyObject()
+
+		if err := mutate(target); err != nil {
+			return err
+		}
+
+		data, err := twoWayPatch(original, target.object())
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			// nothing changed, a re-apply of what is already there
+			return nil
+		}
+
+		err = target.patch(ctx, data)
+		if apierrors.IsConflict(err) {
+			conflicts++
+			log.Printf("⚔️  [%s] conflict #%d patching %s, retrying", target.meta().Name, conflicts, target.kind())
+		}
+		return err
+	})
+
+	return conflicts, err
+}
+
+// strategic merge patch from original to modified, nil when they are equal
+// the resourceVersion of original is added as a precondition
+func twoWayPatch(original runtime.Object, modified runtime.Object) ([]byte, error) {
+
+	originalJSON, err := json.Marshal(original)
+	if err != nil {
+		return nil, err
+	}
+	modifiedJSON, err := json.Marshal(modified)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := strategicpatch.CreateTwoWayMergePatch(originalJSON, modifiedJSON, original)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build patch: %w", err)
+	}
+
+	patch := map[string]interface{}{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+	if len(patch) == 0 {
+		return nil, nil
+	}
+
+	accessor, err := meta.Accessor(original)
+	if err != nil {
+		return nil, err
+	}
+
+	if version := accessor.GetResourceVersion(); version != "" {
+		metadata, _ := patch["metadata"].(map[string]interface{})
+		if metadata == nil {
+			metadata = map[string]interface{}{}
+			patch["metadata"] = metadata
+		}
+		metadata["resourceVersion"] = version
+	}
+
+	return json.Marshal(patch)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// the first patch loses a race (409), the retry goes through and is counted
+func TestDeployTok8sRetriesConflicts(t *testing.T) {
+	d, client := newTestDaemon(t,
+		testNamespace("default"),
+		testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 2),
+	)
+
+	patches := 0
+	client.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches++
+		if patches == 1 {
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Group: "apps", Resource: "deployments"}, "nginx-app", nil)
+		}
+		return false, nil, nil
+	})
+
+	result, err := d.DeployTok8s(context.TODO(), "nginx-app", DepSpec{Version: "1.1.0"}, "default")
+	if err != nil {
+		t.Fatalf("expected success after retry, got %v", err)
+	}
+	if result.Conflicts != 1 {
+		t.Errorf("expected 1 conflict, got %d", result.Conflicts)
+	}
+
+	dep, _ := client.AppsV1().Deployments("default").Get(context.TODO(), "nginx-app", metav1.GetOptions{})
+	if image := dep.Spec.Template.Spec.Containers[0].Image; image != "test.ecr.local/app:1.1.0" {
+		t.Errorf("image not updated, got %s", image)
+	}
+}
+
+// only the changed image goes over the wire, pinned to the version we read
+func TestTwoWayPatchOnlyHoldsTheDiff(t *testing.T) {
+	original := testDeployment("nginx-app", "default", "app:1.0.0", 2)
+	original.ResourceVersion = "42"
+
+	modified := original.DeepCopy()
+	modified.Spec.Template.Spec.Containers[0].Image = "app:1.1.0"
+
+	data, err := twoWayPatch(original, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"metadata":{"resourceVersion":"42"},"spec":{"template":{"spec":{"$setElementOrder/containers":[{"name":"nginx-app"}],"containers":[{"image":"app:1.1.0","name":"nginx-app"}]}}}}`
+	if string(data) != want {
+		t.Errorf("unexpected patch\n got: %s\nwant: %s", data, want)
+	}
+
+	if data, _ := twoWayPatch(original, original.DeepCopy()); data != nil {
+		t.Errorf("expected no patch for an unchanged object, got %s", data)
+	}
+}
+
+// a rollback puts a whole template back, pinned to what it read so an edit
+// made since the deploy is a 409 and gets re-read, not overwritten
+func TestRestoreTemplateIsPinned(t *testing.T) {
+	live := testDeployment("nginx-app", "default", "test.ecr.local/app:1.1.0", 1)
+	live.ResourceVersion = "7"
+	d, client := newTestDaemon(t, live)
+
+	var patches []string
+	client.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches = append(patches, string(action.(k8stesting.PatchAction).GetPatch()))
+		if len(patches) == 1 {
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Group: "apps", Resource: "deployments"}, "nginx-app", nil)
+		}
+		return false, nil, nil
+	})
+
+	previous := testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1).Spec.Template
+	d.restoreTemplate(context.TODO(), "nginx-app", "default", &rollbackPoint{Kind: KindDeployment, Image: "test.ecr.local/app:1.0.0", Template: previous})
+
+	if len(patches) != 2 {
+		t.Fatalf("expected the conflict to be retried, got %d patch(es)", len(patches))
+	}
+	if !strings.Contains(patches[0], `"resourceVersion":"7"`) {
+		t.Errorf("restore patch without the precondition: %s", patches[0])
+	}
+	dep, _ := client.AppsV1().Deployments("default").Get(context.TODO(), "nginx-app", metav1.GetOptions{})
+	if image := dep.Spec.Template.Spec.Containers[0].Image; image != "test.ecr.local/app:1.0.0" {
+		t.Errorf("template not restored, image %s", image)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ DURABLE QUEUE @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ the queue used to be a buffered channel of 500: a crash lost every queued
+ deployment, and once it was full enqueue blocked the fsnotify loop, which
+ then dropped events
+
+ now every job is a row of the jobs table (engine.db) before anything runs it:
+
+ enqueue    inserts the row as pending and wakes a worker, never blocks,
+            QueueSize pending rows -> errQueueFull (api 503 before it writes
+            the .dep, the watcher keeps the .dep in its backlog and tries
+            again on the next beat, so does an api write that lost the race
+            for the last slot)
+ workers    claim the oldest pending row that is due, a retry (retry.go)
+            waits for its not_before (pending -> running, attempts + 1)
+            in one UPDATE, a claiming worker wakes the next one, a slow poll
+            covers whatever a wake missed
+ jobs.go    every state change of a job lands on its row too:
+
+ queued / retrying                        -> pending
+ awaiting-approval / running              -> running
+ succeeded / skipped                      -> succeeded
+ failed / rolled-back / rollback-failed /
+ rejected / invalid                       -> failed
+ cancelled                                -> cancelled
+ dead-letter (retries used up)            -> dead-letter
+ interrupted (shutdown)                   -> pending, runs again on the next start
+
+ the detailed state stays in outcome. on start (leader.go) rows left running
+ by a crash go back to pending, pending rows are loaded into the job registry
+ under their ids and the workers take them in order. finished rows are kept
+ for a week so GET /api/v1/jobs/{id} still finds them after a restart
+*/
+
+const (
+	QueuePending   = "pending"
+	QueueRunning   = "running"
+	QueueSucceeded = "succeeded"
+	QueueFailed    = "failed"
+	QueueCancelled = "cancelled"
+	// kept apart from failed, those need someone to look at them
+	QueueDeadLetter = "dead-letter"
+)
+
+// finished rows older than that are dropped on start
+const queueRetention = 7 * 24 * time.Hour
+
+// workers look at the queue this often even without a wake
+const queuePollEvery = 5 * time.Second
+
+var errQueueFull = errors.New("job queue is full, retry later")
+
+// queue state of a job registry state
+func queueState(state string) string {
+	switch state {
+	case JobQueued, JobRetrying, OutcomeInterrupted:
+		return QueuePending
+	case JobAwaitingApproval, JobRunning:
+		return QueueRunning
+	case OutcomeSucceeded, JobSkipped:
+		return QueueSucceeded
+	case OutcomeCancelled:
+		return QueueCancelled
+	case JobDeadLetter:
+		return QueueDeadLetter
+	}
+	return QueueFailed
+}
+
+// a job as the queue keeps it
+type queuedJob struct {
+	job      DeployService
+	state    jobState
+	attempts int
+}
+
+const jobColumns = `SELECT id, dep_file, spec, service, namespace, force, trigger, state, outcome, attempts, error, deployment_id, created_at, updated_at, not_before`
+
+func scanJob(row interface{ Scan(...any) error }) (queuedJob, error) {
+
+	var q queuedJob
+	var force int
+	var state, outcome, created, updated string
+	var notBefore int64
+	err := row.Scan(&q.job.id, &q.job.service, &q.job.version, &q.state.Service, &q.job.namespace, &force, &q.job.trigger,
+		&state, &outcome, &q.attempts, &q.state.Error, &q.state.DeploymentID, &created, &updated, &notBefore)
+	if err != nil {
+		return queuedJob{}, err
+	}
+	q.job.force = force != 0
+	q.job.attempts = q.attempts
+
+	// rows parked before the queue existed have no service
+	if serviceName, _, err := extractServiceName(q.job.service); err == nil {
+		q.state.Service = serviceName
+	}
+	q.state.ID, q.state.Namespace, q.state.Trigger = q.job.id, q.job.namespace, q.job.trigger
+	q.state.Version, q.state.Force, q.state.Attempts = shortSpec(q.job.version), q.job.force, q.attempts
+	q.state.CreatedAt, q.state.UpdatedAt = parseTime(created), parseTime(updated)
+	if notBefore > 0 {
+		q.state.RetryAt = time.UnixMilli(notBefore)
+	}
+
+	// the detailed state, pending ones are queued again whatever stopped them
+	q.state.State = outcome
+	if (state == QueuePending && outcome != JobRetrying) || outcome == "" {
+		q.state.State = JobQueued
+	}
+	return q, nil
+}
+
+// a new pending row, errQueueFull once limit rows are pending
+// count and insert are one statement, two callers can't both take the last slot
+func (s *historyStore) insertJob(job DeployService, state jobState, limit int) error {
+	now := formatTime(time.Now())
+	res, err := s.db.Exec(`INSERT INTO jobs (id, dep_file, spec, service, namespace, force, trigger, state, outcome, created_at, updated_at)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+		WHERE (SELECT COUNT(*) FROM jobs WHERE state = ?) < ?`,
+		job.id, job.service, job.version, state.Service, job.namespace, job.force, job.trigger, QueuePending, state.State, now, now,
+		QueuePending, limit)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errQueueFull
+	}
+	return nil
+}
+
+// the oldest pending job that is due, now running, false when there is none
+func (s *historyStore) claimJob() (DeployService, bool, error) {
+
+	now := time.Now()
+	row := s.db.QueryRow(`UPDATE jobs SET state = ?, attempts = attempts + 1, updated_at = ?
+		WHERE seq = (SELECT seq FROM jobs WHERE state = ? AND not_before <= ? ORDER BY seq LIMIT 1)
+		RETURNING id, dep_file, spec, namespace, force, trigger, attempts`,
+		QueueRunning, formatTime(now), QueuePending, now.UnixMilli())
+
+	var job DeployService
+	var force int
+	err := row.Scan(&job.id, &job.service, &job.version, &job.namespace, &force, &job.trigger, &job.attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DeployService{}, false, nil
+	}
+	if err != nil {
+		return DeployService{}, false, err
+	}
+	job.force = force != 0
+	return job, true, nil
+}
+
+// mirrors a registry state change onto the job's row
+func (s *historyStore) updateJob(job jobState) error {
+	notBefore := int64(0)
+	if !job.RetryAt.IsZero() {
+		notBefore = job.RetryAt.UnixMilli()
+	}
+	_, err := s.db.Exec(`UPDATE jobs SET state = ?, outcome = ?, force = ?, error = ?, deployment_id = ?, updated_at = ?, not_before = ? WHERE id = ?`,
+		queueState(job.State), job.State, job.Force, job.Error, job.DeploymentID, formatTime(job.UpdatedAt), notBefore, job.ID)
+	return err
+}
+
+func (s *historyStore) jobByID(id string) (queuedJob, bool, error) {
+	q, err := scanJob(s.db.QueryRow(jobColumns+` FROM jobs WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return queuedJob{}, false, nil
+	}
+	return q, err == nil, err
+}
+
+func (s *historyStore) countJobs(state string) (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM jobs WHERE state = ?`, state).Scan(&n)
+	return n, err
+}
+
+// pending jobs a worker could claim right now, retries waiting for their
+// backoff left out
+func (s *historyStore) countDue() (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM jobs WHERE state = ? AND not_before <= ?`, QueuePending, time.Now().UnixMilli()).Scan(&n)
+	return n, err
+}
+
+// every pending job in queue order
+func (s *historyStore) pendingJobs() ([]queuedJob, error) {
+
+	rows, err := s.db.Query(jobColumns+` FROM jobs WHERE state = ? ORDER BY seq`, QueuePending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []queuedJob{}
+	for rows.Next() {
+		q, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, q)
+	}
+	return jobs, rows.Err()
+}
+
+// rows a dead daemon left running go back to pending, call once on start
+// before any worker runs, finished rows past the retention are dropped
+func (s *historyStore) recoverJobs() (int64, error) {
+
+	res, err := s.db.Exec(`UPDATE jobs SET state = ?, outcome = ?, updated_at = ? WHERE state = ?`,
+		QueuePending, OutcomeInterrupted, formatTime(time.Now()), QueueRunning)
+	if err != nil {
+		return 0, err
+	}
+	recovered, _ := res.RowsAffected()
+
+	_, err = s.db.Exec(`DELETE FROM jobs WHERE state NOT IN (?, ?) AND updated_at < ?`,
+		QueuePending, QueueRunning, formatTime(time.Now().Add(-queueRetention)))
+	return recovered, err
+}
+
+// a worker has something to claim, never blocks
+func (d *Daemon) wakeWorker() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+		// one wake is already waiting, that worker passes it on
+	}
+}
+
+func (d *Daemon) Worker() {
+
+	poll := time.NewTicker(queuePollEvery)
+	defer poll.Stop()
+
+	for {
+		select {
+		// Shutdown, pending jobs stay in the store for the next start
+		case <-d.drain.stopping.Done():
+			return
+		case <-d.wake:
+		case <-poll.C:
+		}
+		for d.runNext() {
+		}
+	}
+}
+
+// claims and runs one job, false when the queue is empty or we are draining
+func (d *Daemon) runNext() bool {
+
+	if !d.drain.startJob() {
+		return false
+	}
+	defer d.drain.jobDone()
+
+	job, ok, err := d.store.claimJob()
+	if err != nil {
+		log.Printf("⚠️ Could not take a job off the queue: %v", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	d.health.dequeued()
+	// there may be more, let the next worker look
+	d.wakeWorker()
+
+	d.jobStates.claimed(job.id, job.attempts)
+
+	d.metrics.workersBusy.Inc()
+	d.DeployService(job)
+	d.metrics.workersBusy.Dec()
+	return true
+}
+
+// what the last run left behind goes back into the registry, same ids,
+// the workers take it from there
+func (d *Daemon) resumeQueued() {
+
+	recovered, err := d.store.recoverJobs()
+	if err != nil {
+		log.Printf("⚠️ Could not recover the job queue: %v", err)
+	}
+	if recovered > 0 {
+		log.Printf("♻️  %d job(s) were running when the last daemon stopped, queued again", recovered)
+	}
+
+	jobs, err := d.store.pendingJobs()
+	if err != nil {
+		log.Printf("⚠️ Could not load queued jobs: %v", err)
+		return
+	}
+	if len(jobs) == 0 {
+		return
+	}
+	log.Printf("📥 Resuming %d queued job(s) from the last run", len(jobs))
+	for _, q := range jobs {
+		d.jobStates.add(q.state)
+	}
+	d.wakeWorker()
+}
+
+// memory first, then the queue (restart), then the history row of its attempt
+func (d *Daemon) lookupJob(id string) (jobState, bool, error) {
+
+	if job, ok := d.jobStates.get(id); ok {
+		return job, true, nil
+	}
+
+	q, ok, err := d.store.jobByID(id)
+	if err != nil {
+		return jobState{}, false, fmt.Errorf("job queue: %w", err)
+	}
+	if ok {
+		return q.state, true, nil
+	}
+
+	rec, ok, err := d.store.byJobID(id)
+	if err != nil || !ok {
+		return jobState{}, false, err
+	}
+	return jobState{
+		ID:           id,
+		Service:      rec.Service,
+		Namespace:    rec.Namespace,
+		Version:      rec.Version,
+		Trigger:      rec.Trigger,
+		State:        rec.Outcome,
+		DeploymentID: rec.ID,
+		Error:        rec.Error,
+		CreatedAt:    rec.StartedAt,
+		UpdatedAt:    rec.FinishedAt,
+	}, true, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// a job a crashed daemon was running is claimed again after the restart,
+// one it finished is still found by id
+func TestQueueSurvivesRestart(t *testing.T) {
+
+	d, _ := newTestDaemon(t)
+	crashed, _ := d.enqueue(DeployService{service: "nginx-app_default.dep", version: "1.1.0", namespace: "default", trigger: TriggerWatch})
+	done, _ := d.enqueue(DeployService{service: "redis_default.dep", version: "7.2.0", namespace: "default", trigger: TriggerAPI})
+
+	d.store.claimJob()
+	d.store.claimJob()
+	d.jobStates.setState(done, JobSkipped, nil)
+
+	// the process dies here, crashed is left running
+	next := NewDaemon(d.k8sClient, Options{DepsPath: d.opts.DepsPath, StateDir: t.TempDir(), Store: d.store})
+	next.resumeQueued()
+
+	job, ok, err := next.store.claimJob()
+	if err != nil || !ok || job.id != crashed || job.attempts != 2 || job.version != "1.1.0" {
+		t.Fatalf("claimed %+v %v %v", job, ok, err)
+	}
+	if _, ok, _ := next.store.claimJob(); ok {
+		t.Error("the finished job was queued again")
+	}
+
+	state, ok, err := next.lookupJob(done)
+	if err != nil || !ok || state.State != JobSkipped || state.Service != "redis" || state.Trigger != TriggerAPI {
+		t.Errorf("finished job after restart: %+v %v %v", state, ok, err)
+	}
+}
+
+func TestQueueFullRefusesWithoutBlocking(t *testing.T) {
+
+	d, _ := newTestDaemon(t)
+	d.opts.QueueSize = 1
+
+	if _, err := d.enqueue(DeployService{service: "nginx-app_default.dep", version: "1.1.0", namespace: "default"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.enqueue(DeployService{service: "redis_default.dep", version: "7.2.0", namespace: "default"}); !errors.Is(err, errQueueFull) {
+		t.Fatalf("expected a full queue, got %v", err)
+	}
+	// nothing of the refused job is left in the registry
+	if d.jobStates.pendingFor("redis", "default", "") {
+		t.Errorf("refused job still registered")
+	}
+
+	// a claimed job frees its place
+	d.store.claimJob()
+	if _, err := d.enqueue(DeployService{service: "redis_default.dep", version: "7.2.0", namespace: "default"}); err != nil {
+		t.Errorf("after a claim: %v", err)
+	}
+}
+
+// api and watcher enqueue at the same time, never more than QueueSize pending
+func TestQueueSizeHoldsUnderConcurrentEnqueue(t *testing.T) {
+
+	d, _ := newTestDaemon(t)
+	d.opts.QueueSize = 5
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.enqueue(DeployService{service: fmt.Sprintf("app%d_default.dep", i), version: "1.0.0", namespace: "default"})
+		}()
+	}
+	wg.Wait()
+
+	if pending, _ := d.store.countJobs(QueuePending); pending != 5 {
+		t.Errorf("pending = %d, expected 5", pending)
+	}
+}
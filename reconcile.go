@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ STARTUP RECONCILE @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ fsnotify only tells us about writes that happen while we are running,
+ anything edited while the daemon was down (or restarting) would sit there
+ until someone touches the file again
+
+ so on startup every {service}_{namespace}.dep is checked:
+ .dep != last good (store)     -> normal job, same as a file write
+ .dep == last good but live image
+ is not what .dep asks for     -> forced job, cluster drifted
+ otherwise                     -> nothing to do
+*/
+
+// ctx ends the pass early, a shutdown or a lost lease does not wait for the
+// API server
+func (d *Daemon) reconcileDeps(ctx context.Context, path string) {
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		log.Printf("⚠️ Startup reconcile could not read %s: %v", path, err)
+		return
+	}
+
+	queued := 0
+
+	for _, entry := range entries {
+
+		if ctx.Err() != nil {
+			log.Printf("⏹️  Startup reconcile stopped, %d job(s) queued", queued)
+			return
+		}
+
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".dep") {
+			continue
+		}
+
+		depFile := filepath.Join(path, entry.Name())
+
+		serviceName, namespace, err := extractServiceName(depFile)
+		if err != nil {
+			log.Printf("⚠️ Check filename format: %v", err)
+			continue
+		}
+
+		version := readFile(depFile)
+		if version == "" {
+			continue
+		}
+
+		lastVersion := d.lastGood(depFile, serviceName, namespace)
+
+		if version != lastVersion {
+			log.Printf("🔁 [%s/%s] .dep (%s) differs from the last deployed (%s), queueing", namespace, serviceName, version, lastVersion)
+			if _, err := d.enqueue(DeployService{service: depFile, version: version, namespace: namespace, trigger: TriggerStartup}); err != nil {
+				log.Printf("⚠️ [%s/%s] could not queue: %v", namespace, serviceName, err)
+				continue
+			}
+			queued++
+			continue
+		}
+
+		live, desired, err := d.compareLiveImage(ctx, serviceName, namespace, version)
+		if err != nil {
+			log.Printf("⚠️ [%s/%s] could not compare live image: %v", namespace, serviceName, err)
+			continue
+		}
+
+		if live != desired {
+			log.Printf("🔀 [%s/%s] live image %s, expected %s", namespace, serviceName, live, desired)
+			if _, err := d.enqueue(DeployService{service: depFile, version: version, namespace: namespace, force: true, trigger: TriggerStartup}); err != nil {
+				log.Printf("⚠️ [%s/%s] could not queue: %v", namespace, serviceName, err)
+				continue
+			}
+			queued++
+		}
+	}
+
+	log.Printf("🔎 Startup reconcile done, %d job(s) queued", queued)
+}
+
+// returns the image running in the cluster and the one the .dep asks for,
+// both empty when every container already matches
+func (d *Daemon) compareLiveImage(ctx context.Context, serviceName string, namespace string, content string) (string, string, error) {
+
+	spec, err := parseDepSpec(content)
+	if err != nil {
+		return "", "", err
+	}
+
+	kind, err := d.workloadKind(serviceName, namespace, spec)
+	if err != nil {
+		return "", "", err
+	}
+
+	target, err := getWorkload(ctx, d.k8sClient, kind, serviceName, namespace)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get %s: %w", kind, err)
+	}
+
+	return spec.drift(target.template().Spec)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// .dep files written while the daemon was down, checked against the store
+// and the cluster, nothing runs them (no workers)
+func TestReconcileDeps(t *testing.T) {
+
+	d, client := newTestDaemon(t,
+		testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1),
+		testDeployment("api", "default", "test.ecr.local/app:2.0.0", 1),
+		testDeployment("worker", "default", "test.ecr.local/app:3.0.0", 1),
+	)
+	d.store.setLastGood("nginx-app", "default", "1.0.0", "test.ecr.local/app:1.0.0", 0)
+	d.store.setLastGood("api", "default", "2.0.0", "test.ecr.local/app:2.0.0", 0)
+	d.store.setLastGood("worker", "default", "3.0.0", "test.ecr.local/app:3.0.0", 0)
+
+	// edited while we were down
+	os.WriteFile(filepath.Join(d.opts.DepsPath, "nginx-app_default.dep"), []byte("1.1.0"), 0644)
+	// already deployed
+	os.WriteFile(filepath.Join(d.opts.DepsPath, "api_default.dep"), []byte("2.0.0"), 0644)
+	// deployed, then somebody ran kubectl set image
+	os.WriteFile(filepath.Join(d.opts.DepsPath, "worker_default.dep"), []byte("3.0.0"), 0644)
+	dep, _ := client.AppsV1().Deployments("default").Get(context.TODO(), "worker", metav1.GetOptions{})
+	dep.Spec.Template.Spec.Containers[0].Image = "test.ecr.local/app:hotfix"
+	client.AppsV1().Deployments("default").Update(context.TODO(), dep, metav1.UpdateOptions{})
+
+	d.reconcileDeps(context.TODO(), d.opts.DepsPath)
+
+	jobs, err := d.store.pendingJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := map[string]queuedJob{}
+	for _, q := range jobs {
+		queued[q.state.Service] = q
+	}
+
+	if len(jobs) != 2 {
+		t.Errorf("expected 2 queued jobs, got %d", len(jobs))
+	}
+	if q, ok := queued["nginx-app"]; !ok || q.job.force || q.job.version != "1.1.0" || q.job.trigger != TriggerStartup {
+		t.Errorf("changed .dep not queued as a normal job: %+v", q.job)
+	}
+	if _, ok := queued["api"]; ok {
+		t.Errorf("matching .dep was queued")
+	}
+	if q, ok := queued["worker"]; !ok || !q.job.force {
+		t.Errorf("drifted image not queued as a forced job: %+v", q.job)
+	}
+}
+
+func TestCompareLiveImage(t *testing.T) {
+
+	d, _ := newTestDaemon(t, testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1))
+
+	if live, desired, err := d.compareLiveImage(context.TODO(), "nginx-app", "default", "1.0.0"); err != nil || live != desired {
+		t.Errorf("same image reported as drift: %q != %q (%v)", live, desired, err)
+	}
+
+	live, desired, err := d.compareLiveImage(context.TODO(), "nginx-app", "default", "1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live != "test.ecr.local/app:1.0.0" || desired != "test.ecr.local/app:1.1.0" {
+		t.Errorf("live %q, desired %q", live, desired)
+	}
+
+	if _, _, err := d.compareLiveImage(context.TODO(), "missing", "default", "1.0.0"); err == nil {
+		t.Errorf("expected an error for a missing deployment")
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ RETRIES @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ a failed deploy used to log "Waiting 60 seconds before next attempt", sleep
+ 3 seconds and never try again
+
+ now every failure gets a class:
+ api        5xx / 429 / timeouts / refused or reset connections to the API server
+ conflict   409s patchWorkload gave up on
+ timeout    rollout timeout, ProgressDeadlineExceeded
+ image      ImagePullBackOff / ErrImagePull (missing tag), InvalidImageName
+ crash      CrashLoopBackOff, containers exiting non zero
+ other      everything else (missing workload, bad kind, ...)
+
+ and the service's retry policy decides what happens to the job:
+ class not in retryOn            -> failed, as before
+ retryOn, attempts left          -> retrying: back into the queue (queue.go) under
+                                    the same id, claimable once not_before passed:
+                                    backoff, doubled per attempt up to maxBackoff,
+                                    +-20% jitter so an API outage does not come
+                                    back as one burst. no worker sleeps meanwhile
+ retryOn, maxAttempts reached    -> dead-letter + "Deployment Dead-Lettered"
+
+ the decision is made before the job's state is published: SSE subscribers
+ and `engine deploy` see "retrying" with retryAt, not a final "failed", and
+ keep following the job into its next attempt
+
+ every attempt keeps its own history row, notification and rollback. a newer
+ job of the same service wins over a retry, a protected namespace asks for
+ the approval again. the .dep of a dead-lettered job is still != last good,
+ the next write, reconcile or POST /api/v1/deployments starts over
+
+ ENGINE_CONFIG:
+   services:
+     nginx-app:
+       retry:
+         maxAttempts: 5                  # attempts in total, 1 turns retries off
+         backoff: 30s                    # before the 2nd attempt
+         maxBackoff: 10m
+         retryOn: [api, conflict, timeout]
+ defaults: RETRY_MAX_ATTEMPTS (3), RETRY_BACKOFF (30s), RETRY_MAX_BACKOFF (10m)
+*/
+
+const (
+	ErrorAPI      = "api"
+	ErrorConflict = "conflict"
+	ErrorTimeout  = "timeout"
+	ErrorImage    = "image"
+	ErrorCrash    = "crash"
+	ErrorOther    = "other"
+)
+
+var errorClasses = []string{ErrorAPI, ErrorConflict, ErrorTimeout, ErrorImage, ErrorCrash, ErrorOther}
+
+// an error that knows its class, for failures client-go can't tell apart
+type classedError struct {
+	class string
+	err   error
+}
+
+func (e *classedError) Error() string { return e.err.Error() }
+func (e *classedError) Unwrap() error { return e.err }
+
+func classed(class string, err error) error {
+	return &classedError{class: class, err: err}
+}
+
+// the first class found wins, wrapped errors included
+func classifyError(err error) string {
+
+	var c *classedError
+	if errors.As(err, &c) {
+		return c.class
+	}
+
+	switch {
+	case apierrors.IsConflict(err):
+		return ErrorConflict
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorTimeout
+	case apierrors.IsServerTimeout(err), apierrors.IsTimeout(err), apierrors.IsTooManyRequests(err),
+		apierrors.IsServiceUnavailable(err), apierrors.IsInternalError(err), apierrors.IsUnexpectedServerError(err):
+		return ErrorAPI
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrorAPI
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrorAPI
+	}
+	return ErrorOther
+}
+
+type RetryPolicy struct {
+	MaxAttempts int              `json:"maxAttempts"`
+	Backoff     *metav1.Duration `json:"backoff"`
+	MaxBackoff  *metav1.Duration `json:"maxBackoff"`
+	RetryOn     []string         `json:"retryOn"`
+}
+
+func (p *RetryPolicy) validate() error {
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("retry maxAttempts can not be negative")
+	}
+	for _, d := range []*metav1.Duration{p.Backoff, p.MaxBackoff} {
+		if d != nil && d.Duration <= 0 {
+			return fmt.Errorf("retry backoff must be positive")
+		}
+	}
+	for _, class := range p.RetryOn {
+		if !slices.Contains(errorClasses, class) {
+			return fmt.Errorf("unknown retryOn class %q, expected one of %v", class, errorClasses)
+		}
+	}
+	return nil
+}
+
+// a copy with everything unset taken from the RETRY_* env
+func (p *RetryPolicy) withDefaults() *RetryPolicy {
+
+	policy := RetryPolicy{}
+	if p != nil {
+		policy = *p
+	}
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = getRetryMaxAttempts()
+	}
+	if policy.Backoff == nil {
+		policy.Backoff = &metav1.Duration{Duration: getRetryDuration("RETRY_BACKOFF", 30*time.Second)}
+	}
+	if policy.MaxBackoff == nil {
+		policy.MaxBackoff = &metav1.Duration{Duration: getRetryDuration("RETRY_MAX_BACKOFF", 10*time.Minute)}
+	}
+	if policy.RetryOn == nil {
+		policy.RetryOn = []string{ErrorAPI, ErrorConflict, ErrorTimeout}
+	}
+	return &policy
+}
+
+func (p *RetryPolicy) retries(class string) bool {
+	return p.MaxAttempts > 1 && slices.Contains(p.RetryOn, class)
+}
+
+// wait before the attempt after `attempts`, backoff * 2^(attempts-1) capped
+// at maxBackoff, +-20% jitter
+func (p *RetryPolicy) backoff(attempts int) time.Duration {
+
+	delay := p.Backoff.Duration
+	for i := 1; i < attempts && delay < p.MaxBackoff.Duration; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxBackoff.Duration)
+
+	return time.Duration(float64(delay) * (0.8 + 0.4*rand.Float64()))
+}
+
+func getRetryMaxAttempts() int {
+	if raw := os.Getenv("RETRY_MAX_ATTEMPTS"); raw != "" {
+		attempts, err := strconv.Atoi(raw)
+		if err == nil && attempts > 0 {
+			return attempts
+		}
+		log.Printf("⚠️ Invalid RETRY_MAX_ATTEMPTS %q, using 3", raw)
+	}
+	return 3
+}
+
+func getRetryDuration(name string, fallback time.Duration) time.Duration {
+	if raw := os.Getenv(name); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err == nil && d > 0 {
+			return d
+		}
+		log.Printf("⚠️ Invalid %s %q, using %s", name, raw, fallback)
+	}
+	return fallback
+}
+
+// a failed attempt: recorded in the history, then the retry policy decides
+// what the job does next before its state is published, so nobody sees a
+// final "failed" for a job that is tried again
+func (d *Daemon) failAttempt(job DeployService, rec *deploymentRecord, outcome string, spec DepSpec, err error) {
+
+	d.recordAttempt(rec, outcome, err)
+
+	state, retryAt, class := d.afterFailure(job, rec.Service, rec.Namespace, outcome, err)
+
+	d.jobStates.update(rec.JobID, func(j *jobState) {
+		j.State, j.RetryAt, j.DeploymentID, j.Version, j.Error = state, retryAt, rec.ID, rec.Version, rec.Error
+		if state == JobRetrying {
+			j.Error = fmt.Sprintf("attempt %d: %s", job.attempts, rec.Error)
+		}
+	})
+
+	switch state {
+	case JobRetrying:
+		// back into the queue, the row keeps the id and its attempts
+		time.AfterFunc(time.Until(retryAt), d.wakeWorker)
+	case JobDeadLetter:
+		d.notifyDeadLetter(job, rec, spec, class, err)
+	}
+}
+
+// the job's next state after a failed attempt: outcome (give up), retrying
+// with the time of the next attempt, or dead-letter
+// jobs that did not come from the queue (tests) just keep the outcome
+func (d *Daemon) afterFailure(job DeployService, serviceName string, namespace string, outcome string, err error) (string, time.Time, string) {
+
+	class := classifyError(err)
+	if job.id == "" {
+		return outcome, time.Time{}, class
+	}
+
+	policy := d.config.service(serviceName, namespace).Retry
+
+	if !policy.retries(class) {
+		log.Printf("🛑 [%s/%s] %s error, not retrying", namespace, serviceName, class)
+		d.metrics.failure(class, "failed")
+		return outcome, time.Time{}, class
+	}
+
+	// the newer version is deployed next anyway
+	if d.jobStates.pendingFor(serviceName, namespace, job.id) {
+		log.Printf("⏭️  [%s/%s] newer job queued, not retrying job %s", namespace, serviceName, job.id)
+		d.metrics.failure(class, "superseded")
+		return outcome, time.Time{}, class
+	}
+
+	if job.attempts >= policy.MaxAttempts {
+		log.Printf("☠️  [%s/%s] job %s dead-lettered after %d attempts: %v", namespace, serviceName, job.id, job.attempts, err)
+		d.metrics.failure(class, "dead-letter")
+		return JobDeadLetter, time.Time{}, class
+	}
+
+	delay := policy.backoff(job.attempts)
+	log.Printf("🔁 [%s/%s] attempt %d/%d failed (%s error), retrying in %s", namespace, serviceName, job.attempts, policy.MaxAttempts, class, delay.Round(time.Second))
+	d.metrics.failure(class, "retry")
+	return JobRetrying, time.Now().Add(delay), class
+}
+
+// retries are used up, the job stops here and somebody has to look at it
+func (d *Daemon) notifyDeadLetter(job DeployService, rec *deploymentRecord, spec DepSpec, class string, err error) {
+	d.notify(Notification{
+		Message: "Deployment Dead-Lettered",
+		Details: fmt.Sprintf(
+			"service:%s\nversion:%s\nnamespace:%s\nattempts:%d\nerror class:%s\nlast error:%s\njob:%s",
+			rec.Service,
+			spec,
+			rec.Namespace,
+			job.attempts,
+			class,
+			err,
+			job.id,
+		) + spec.details(),
+		MessageType: MsgDeploymentDeadLetter,
+		Thread:      threadKey(rec.Service, rec.Namespace),
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestClassifyError(t *testing.T) {
+
+	deployments := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	cases := map[string]error{
+		ErrorConflict: apierrors.NewConflict(deployments, "nginx-app", errors.New("modified")),
+		ErrorAPI:      fmt.Errorf("Erroe while deploying in engine: %w", apierrors.NewServiceUnavailable("etcd down")),
+		ErrorTimeout:  classed(ErrorTimeout, errors.New("timeout waiting for deployment rollout after 4m0s")),
+		ErrorImage:    fmt.Errorf("rollout failed: %w (progress deadline)", classed(ErrorImage, errors.New("image pull failed: ImagePullBackOff"))),
+		ErrorOther:    apierrors.NewNotFound(deployments, "nginx-app"),
+	}
+	for want, err := range cases {
+		if got := classifyError(err); got != want {
+			t.Errorf("%v classified as %s, expected %s", err, got, want)
+		}
+	}
+	if got := classifyError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}); got != ErrorAPI {
+		t.Errorf("network error classified as %s", got)
+	}
+}
+
+func TestBackoffDoublesUpToMax(t *testing.T) {
+
+	policy := (&RetryPolicy{
+		Backoff:    &metav1.Duration{Duration: 10 * time.Second},
+		MaxBackoff: &metav1.Duration{Duration: 25 * time.Second},
+	}).withDefaults()
+
+	for attempts, base := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 3: 25 * time.Second, 10: 25 * time.Second} {
+		for range 20 {
+			if delay := policy.backoff(attempts); delay < base*8/10 || delay > base*12/10 {
+				t.Fatalf("backoff after %d attempt(s) = %s, expected %s +-20%%", attempts, delay, base)
+			}
+		}
+	}
+}
+
+// the API keeps answering 503: the job is retried from the queue and
+// dead-lettered once maxAttempts is used up
+func TestRetryThenDeadLetter(t *testing.T) {
+
+	d, client := newTestDaemon(t,
+		testNamespace("default"),
+		testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1),
+	)
+	client.PrependReactor("patch", "deployments", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewServiceUnavailable("apiserver overloaded")
+	})
+	d.config.Services["nginx-app"] = ServiceConfig{Retry: &RetryPolicy{
+		MaxAttempts: 2,
+		Backoff:     &metav1.Duration{Duration: 10 * time.Millisecond},
+	}}
+	d.opts.Workers = 1
+	d.Start()
+	defer d.Shutdown(0)
+
+	depFile := filepath.Join(d.opts.DepsPath, "nginx-app_default.dep")
+	os.WriteFile(depFile, []byte("1.1.0"), 0644)
+	id, err := d.enqueue(DeployService{service: depFile, version: "1.1.0", namespace: "default", trigger: TriggerWatch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, stop := d.jobStates.subscribe(id)
+	defer stop()
+
+	waitFor(t, "the job to be dead-lettered", func() bool {
+		job, _ := d.jobStates.get(id)
+		return job.State == JobDeadLetter
+	})
+
+	job, _ := d.jobStates.get(id)
+	if job.Attempts != 2 {
+		t.Errorf("attempts = %d", job.Attempts)
+	}
+	if attempts, _ := d.store.history(historyFilter{Service: "nginx-app", Namespace: "default"}); len(attempts) != 2 {
+		t.Errorf("expected 2 recorded attempts, got %d", len(attempts))
+	}
+	if q, _, _ := d.store.jobByID(id); q.state.State != JobDeadLetter {
+		t.Errorf("queue row state = %s", q.state.State)
+	}
+
+	// subscribers follow the job into its retry, no final "failed" in between
+	var states []string
+	for event := range events {
+		if event.Type == "state" {
+			states = append(states, event.Job.State)
+			if event.Job.State == JobRetrying && event.Job.RetryAt.IsZero() {
+				t.Errorf("retrying event without retryAt")
+			}
+		}
+	}
+	if !slices.Contains(states, JobRetrying) || slices.Contains(states, OutcomeFailed) || states[len(states)-1] != JobDeadLetter {
+		t.Errorf("job states seen by a subscriber: %v", states)
+	}
+	if dead, _ := d.store.countJobs(QueueDeadLetter); dead != 1 {
+		t.Errorf("dead-letter rows = %d", dead)
+	}
+}
+
+// a missing tag does not get better by waiting
+func TestTerminalErrorIsNotRetried(t *testing.T) {
+
+	d, _ := newTestDaemon(t)
+	d.jobStates.add(jobState{ID: "job-1", Service: "nginx-app", Namespace: "default", State: OutcomeFailed})
+
+	rec := &deploymentRecord{Service: "nginx-app", Namespace: "default", Version: "9.9.9", JobID: "job-1"}
+	d.failAttempt(DeployService{id: "job-1", attempts: 1}, rec, OutcomeFailed, DepSpec{Version: "9.9.9"},
+		classed(ErrorImage, errors.New("image pull failed: ErrImagePull - manifest unknown")))
+
+	if job, _ := d.jobStates.get("job-1"); job.State != OutcomeFailed || !job.RetryAt.IsZero() {
+		t.Errorf("terminal failure was queued again: %+v", job)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ ROLLBACK @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ a failed WaitForRollout (timeout, ImagePullBackOff, CrashLoopBackOff) used to
+ leave the deployment pointing at the broken image
+
+ now the pod template DeployTok8s replaced is written back and we wait for that
+ rollout too, the last good version in the store is not touched
+ rolled back    -> "Deployment Rolled Back" (warning)
+ rollback broke -> "Rollback Failed" (danger), someone has to look at it
+*/
+
+// returns the rollback error, nil once the previous template is healthy again
+func (d *Daemon) rollbackTok8s(ctx context.Context, deployErr error, serviceName string, spec DepSpec, namespace string, result deployResult) error {
+
+	previous := result.Rollback
+
+	log.Printf("❌ Deployment failed: %v", deployErr)
+	log.Printf("⏪ [%s/%s] rolling back to %s", namespace, serviceName, previous.Image)
+
+	err := d.restoreTemplate(ctx, serviceName, namespace, previous)
+
+	if err != nil {
+
+		log.Printf("❌ Rollback failed: %v", err)
+
+		d.notify(Notification{
+			Message: "Rollback Failed",
+			Details: fmt.Sprintf(
+				"service:%s\nversion:%s\nnamespace:%s\nprevious image:%s\nerror:%s\nrollback error:%s",
+				serviceName,
+				spec,
+				namespace,
+				previous.Image,
+				deployErr.Error(),
+				err.Error(),
+			) + spec.details() + result.details(),
+			MessageType: MsgDeploymentFailure,
+			Logs:        truncateForNotify(result.Diagnostics),
+			Thread:      threadKey(serviceName, namespace),
+		})
+		return err
+	}
+
+	log.Printf("⏪ [%s/%s] rolled back to %s", namespace, serviceName, previous.Image)
+
+	d.notify(Notification{
+		Message: "Deployment Rolled Back",
+		Details: fmt.Sprintf(
+			"service:%s\nfailed version:%s\nnamespace:%s\nrestored image:%s\nerror:%s",
+			serviceName,
+			spec,
+			namespace,
+			previous.Image,
+			deployErr.Error(),
+		) + spec.details() + result.details(),
+		MessageType: MsgDeploymentRolledBack,
+		Logs:        truncateForNotify(result.Diagnostics),
+		Thread:      threadKey(serviceName, namespace),
+	})
+	return nil
+}
+
+// puts the previous pod template back and waits until it is healthy again
+func (d *Daemon) restoreTemplate(ctx context.Context, serviceName string, namespace string, previous *rollbackPoint) error {
+
+	target, err := getWorkload(ctx, d.k8sClient, previous.Kind, serviceName, namespace)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", previous.Kind, err)
+	}
+
+	// pinned like every patch, an edit made since the deploy is re-read first
+	conflicts, err := patchWorkload(ctx, target, func(w workload) error {
+		*w.template() = *previous.Template.DeepCopy()
+		return nil
+	})
+	if err != nil {
+		if apierrors.IsConflict(err) {
+			return classed(ErrorConflict, fmt.Errorf("gave up restoring the template after %d conflicts: %w", conflicts, err))
+		}
+		return fmt.Errorf("failed to restore image: %w", err)
+	}
+	if conflicts > 0 {
+		log.Printf("⚔️  [%s/%s] template restored after %d conflict(s)", namespace, serviceName, conflicts)
+	}
+
+	return d.WaitForRollout(ctx, target, serviceName, namespace, d.rolloutTimeout(serviceName, namespace, target))
+}
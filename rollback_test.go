@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// a failing version gets rolled back to the previous image and the last good version stays put
+func TestDeployServiceRollsBackFailedRollout(t *testing.T) {
+	const goodImage = "test.ecr.local/app:1.0.0"
+
+	d, client := newTestDaemon(t,
+		testNamespace("default"),
+		unhealthy(testDeployment("nginx-app", "default", goodImage, 1)),
+		testPod("nginx-app-abc", "default", "nginx-app", corev1.ContainerState{
+			Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "tag not found"},
+		}),
+	)
+
+	// the cluster only reports healthy again once the good image is back
+	gvr := appsv1.SchemeGroupVersion.WithResource("deployments")
+	client.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		handled, obj, err := k8stesting.ObjectReaction(client.Tracker())(action)
+		if err != nil || !handled {
+			return handled, obj, err
+		}
+		dep := obj.(*appsv1.Deployment)
+		if dep.Spec.Template.Spec.Containers[0].Image == goodImage {
+			dep.Status = testDeployment(dep.Name, dep.Namespace, goodImage, 1).Status
+			err = client.Tracker().Update(gvr, dep, dep.Namespace)
+		}
+		return true, dep, err
+	})
+
+	depFile := filepath.Join(d.opts.DepsPath, "nginx-app_default.dep")
+	os.WriteFile(depFile, []byte("9.9.9"), 0644)
+	d.store.setLastGood("nginx-app", "default", "1.0.0", goodImage, 0)
+
+	d.DeployService(DeployService{service: depFile, version: "9.9.9", namespace: "default"})
+
+	dep, err := client.AppsV1().Deployments("default").Get(context.TODO(), "nginx-app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image := dep.Spec.Template.Spec.Containers[0].Image; image != goodImage {
+		t.Errorf("expected rollback to %s, got %s", goodImage, image)
+	}
+	if last, _ := d.store.lastGood("nginx-app", "default"); last != "1.0.0" {
+		t.Errorf("last good should stay the previous version, got %s", last)
+	}
+
+	records, err := d.store.history(historyFilter{Service: "nginx-app"})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("expected one history row, got %v %v", records, err)
+	}
+	if rec := records[0]; rec.Outcome != OutcomeRolledBack || rec.RollbackImage != goodImage || rec.Error == "" {
+		t.Errorf("rollback not recorded: %+v", rec)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ HTTP @@@@@@@@@@@@@@@@@@@@@@@@
+// one server on HTTP_ADDR for everything that has to reach the daemon
+//	POST /slack/interactions   approval buttons (approval.go)
+//	/api/v1/...                 deployments, jobs, services (api.go)
+//	GET /metrics                prometheus (metrics.go)
+//	GET /healthz, /readyz       probes (health.go)
+
+func (d *Daemon) httpHandler() http.Handler {
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", d.metrics.handler())
+	mux.Handle("GET /healthz", d.healthHandler(d.livenessChecks))
+	mux.Handle("GET /readyz", d.healthHandler(d.readinessChecks))
+
+	if d.opts.Approvals != nil {
+		mux.HandleFunc("POST /slack/interactions", d.handleSlackInteraction)
+	}
+	if d.opts.APIToken != "" {
+		d.registerAPI(mux)
+	}
+	return mux
+}
+
+func (d *Daemon) serveHTTP() {
+
+	if d.opts.HTTPAddr == "" {
+		return
+	}
+
+	log.Printf("🌐 Listening on %s", d.opts.HTTPAddr)
+	if err := http.ListenAndServe(d.opts.HTTPAddr, d.httpHandler()); err != nil {
+		log.Fatal("HTTP server failed:", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ GRACEFUL SHUTDOWN @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ a SIGTERM used to flush notifications and exit, whatever WaitForRollout was
+ waiting for was cut off: attempt left "running", no last good, no notification,
+ and every job still in the channel was gone
+
+ Shutdown(grace):
+ 1. intake closes: watcher + drift return, POST /api/v1/deployments answers 503,
+    jobs enqueued anyway (requeue, ...) only land in the durable queue
+ 2. workers finish the job they are on and stop claiming new ones
+ 3. grace over -> running rollouts / approvals are aborted, the attempt is
+    recorded as interrupted and "Deployment Interrupted" goes out. no rollback,
+    the new version may still become healthy and the last good is untouched
+
+ the queue is in the store (queue.go), the next leader runs what is still
+ pending with the same ids, interrupted jobs are pending again too. their .dep
+ is still != last good so the startup reconcile queues them as well, that job
+ supersedes the resumed one
+
+ SHUTDOWN_GRACE (default 20s) + the 10s notification flush has to fit into the
+ pod's terminationGracePeriodSeconds (30s by default)
+*/
+
+// cause of the running jobs' contexts once the grace period is over
+var errInterrupted = errors.New("interrupted by shutdown")
+
+// another replica may already deploy, no grace period then
+var errLeaseLost = fmt.Errorf("%w: lost the leader lease", errInterrupted)
+
+type drainState struct {
+	// done once Shutdown started, nothing new is taken
+	stopping   context.Context
+	stopIntake context.CancelFunc
+	// done once the grace period is over, every job's context derives from it
+	aborting     context.Context
+	abortRunning context.CancelCauseFunc
+
+	// guards inflight.Add against Shutdown's Wait
+	mu       sync.Mutex
+	inflight sync.WaitGroup
+}
+
+func newDrainState() *drainState {
+	s := &drainState{}
+	s.stopping, s.stopIntake = context.WithCancel(context.Background())
+	s.aborting, s.abortRunning = context.WithCancelCause(context.Background())
+	return s
+}
+
+func (s *drainState) draining() bool {
+	return s.stopping.Err() != nil
+}
+
+// false once draining, the job stays in the queue
+func (s *drainState) startJob() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining() {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
+}
+
+func (s *drainState) jobDone() {
+	s.inflight.Done()
+}
+
+// false when the jobs were still running after timeout
+func (s *drainState) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func getShutdownGrace() time.Duration {
+	if raw := os.Getenv("SHUTDOWN_GRACE"); raw != "" {
+		grace, err := time.ParseDuration(raw)
+		if err == nil {
+			return grace
+		}
+		log.Printf("⚠️ Invalid SHUTDOWN_GRACE %q, using 20s", raw)
+	}
+	return 20 * time.Second
+}
+
+// stops taking work, lets running deployments finish for grace, then
+// interrupts them, whatever is queued stays in the store
+func (d *Daemon) Shutdown(grace time.Duration) {
+
+	d.drain.mu.Lock()
+	d.drain.stopIntake()
+	d.drain.mu.Unlock()
+
+	log.Printf("🛑 Draining, waiting up to %s for running deployments", grace)
+
+	if !d.drain.wait(grace) {
+		log.Printf("⏹️  Grace period over, interrupting running deployments")
+		d.drain.abortRunning(errInterrupted)
+		// they only record the outcome and notify now
+		if !d.drain.wait(10 * time.Second) {
+			log.Printf("⚠️ Some deployments did not stop, their attempts stay running until the next start")
+		}
+	}
+
+	if pending, err := d.store.countJobs(QueuePending); err == nil && pending > 0 {
+		log.Printf("📥 %d job(s) left in the queue for the next start", pending)
+	}
+}
+
+// the lease is gone: nothing is claimed, watched or patched from here on and
+// running jobs are interrupted right away, unlike Shutdown there is no grace
+// period, the new leader resumes them from the queue
+func (d *Daemon) abandon(cause error) {
+
+	d.drain.mu.Lock()
+	d.drain.stopIntake()
+	d.drain.mu.Unlock()
+	d.drain.abortRunning(cause)
+
+	if !d.drain.wait(10 * time.Second) {
+		log.Printf("⚠️ Some deployments did not stop after losing the lease")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// a rollout still running after the grace period is interrupted, it and the
+// queued jobs stay in the durable queue and the next daemon runs them again
+func TestShutdownInterruptsAndResumes(t *testing.T) {
+
+	d, _ := newTestDaemon(t,
+		testNamespace("default"),
+		unhealthy(testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1)),
+		// pending but not failing, only the shutdown can end the wait
+		testPod("nginx-app-abc", "default", "nginx-app", corev1.ContainerState{
+			Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"},
+		}),
+	)
+	d.opts.Workers = 1
+	d.opts.RolloutTimeout = time.Minute
+	d.Start()
+
+	running := filepath.Join(d.opts.DepsPath, "nginx-app_default.dep")
+	os.WriteFile(running, []byte("1.1.0"), 0644)
+	runningID, _ := d.enqueue(DeployService{service: running, version: "1.1.0", namespace: "default", trigger: TriggerWatch})
+	waitFor(t, "the rollout to start", func() bool {
+		job, _ := d.jobStates.get(runningID)
+		return job.State == JobRunning
+	})
+
+	// the only worker is busy, this one stays in the queue
+	queued := filepath.Join(d.opts.DepsPath, "redis_default.dep")
+	os.WriteFile(queued, []byte("7.2.0"), 0644)
+	queuedID, _ := d.enqueue(DeployService{service: queued, version: "7.2.0", namespace: "default", trigger: TriggerWatch})
+
+	d.Shutdown(50 * time.Millisecond)
+
+	rec, ok, err := d.store.byJobID(runningID)
+	if err != nil || !ok || rec.Outcome != OutcomeInterrupted {
+		t.Fatalf("running attempt not interrupted: %+v %v %v", rec, ok, err)
+	}
+	if last, _ := d.store.lastGood("nginx-app", "default"); last != "" {
+		t.Errorf("an interrupted rollout must not become the last good, got %s", last)
+	}
+	if job, _ := d.jobStates.get(queuedID); job.State != JobQueued {
+		t.Errorf("queued job state = %s", job.State)
+	}
+
+	// no worker claims what is queued while draining
+	d.enqueue(DeployService{service: filepath.Join(d.opts.DepsPath, "postgres_default.dep"), version: "15.1", namespace: "default", trigger: TriggerRequeue})
+	time.Sleep(50 * time.Millisecond)
+	if pending, _ := d.store.countJobs(QueuePending); pending != 3 {
+		t.Fatalf("expected the interrupted, queued and requeued jobs pending, got %d", pending)
+	}
+
+	next := NewDaemon(d.k8sClient, Options{DepsPath: d.opts.DepsPath, StateDir: t.TempDir(), Store: d.store})
+	next.resumeQueued()
+	if job, ok := next.jobStates.get(runningID); !ok || job.State != JobQueued || job.Attempts != 1 {
+		t.Errorf("resumed interrupted job = %+v", job)
+	}
+
+	// queue order, same ids
+	for _, want := range []string{runningID, queuedID} {
+		if job, ok, _ := next.store.claimJob(); !ok || job.id != want {
+			t.Errorf("claimed %+v, expected job %s", job, want)
+		}
+	}
+	if job, _, _ := next.store.claimJob(); job.version != "15.1" || job.trigger != TriggerRequeue {
+		t.Errorf("resumed requeue = %+v", job)
+	}
+	if _, ok, _ := next.store.claimJob(); ok {
+		t.Error("a job was claimed twice")
+	}
+}
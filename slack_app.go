@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ SLACK APP @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ the webhook posts one attachment per outcome, with dozens of releases a day
+ the channel turns into a wall of them
+
+ with a bot token (SLACK_BOT_TOKEN, scope chat:write) and SLACK_CHANNEL:
+ started   -> "🚀 Deployment Started" message (Block Kit)
+ progress  -> the same message updated in place (updated / ready / unavailable)
+ outcome   -> the message header flips to ✅ / ❌ / ⏪ and the full details
+              (error, pod logs, report) go into its thread
+
+ so one release is one line in the channel, the noise lives in the thread
+ messages without a started one (drift, invalid .dep, after a restart) are
+ posted on their own
+
+ the thread -> message ts map is in memory only, the outbox lane delivers in
+ order so started is always posted before its progress and outcome
+*/
+
+type slackAppNotifier struct {
+	api     *slack.Client
+	channel string
+
+	mu      sync.Mutex
+	threads map[string]*slackThread
+}
+
+// the started message of a running deployment
+type slackThread struct {
+	ts      string
+	started Notification
+}
+
+// apiURL is for tests, "" is slack.com
+func newSlackAppNotifier(token string, channel string, apiURL string) *slackAppNotifier {
+
+	options := []slack.Option{}
+	if apiURL != "" {
+		options = append(options, slack.OptionAPIURL(apiURL))
+	}
+
+	return &slackAppNotifier{
+		api:     slack.New(token, options...),
+		channel: channel,
+		threads: make(map[string]*slackThread),
+	}
+}
+
+func (s *slackAppNotifier) Name() string { return "slack-app" }
+
+func (s *slackAppNotifier) notifiesProgress() {}
+
+func (s *slackAppNotifier) Notify(ctx context.Context, msg Notification) error {
+
+	// only the outbox lane calls us, the lock is for the map not for ordering
+	s.mu.Lock()
+	thread := s.threads[msg.Thread]
+	s.mu.Unlock()
+
+	switch {
+
+	case msg.MessageType == MsgDeploymentStarted:
+		_, ts, err := s.api.PostMessageContext(ctx, s.channel, s.options(slackBlocks(msg, ""))...)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.threads[msg.Thread] = &slackThread{ts: ts, started: msg}
+		s.mu.Unlock()
+		return nil
+
+	case msg.MessageType == MsgDeploymentProgress:
+		if thread == nil {
+			// nothing to update, a progress line on its own is noise
+			return nil
+		}
+		_, _, _, err := s.api.UpdateMessageContext(ctx, s.channel, thread.ts, s.options(slackBlocks(thread.started, "⏳ "+msg.Message))...)
+		return err
+
+	case thread != nil:
+		// parent shows the outcome, the details go into the thread
+		parent := thread.started
+		parent.Message, parent.MessageType = msg.Message, msg.MessageType
+
+		finished := fmt.Sprintf("finished %s", time.Now().Format("15:04:05"))
+		if _, _, _, err := s.api.UpdateMessageContext(ctx, s.channel, thread.ts, s.options(slackBlocks(parent, finished))...); err != nil {
+			return err
+		}
+
+		options := append(s.options(slackBlocks(msg, "")), slack.MsgOptionTS(thread.ts))
+		if _, _, err := s.api.PostMessageContext(ctx, s.channel, options...); err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		delete(s.threads, msg.Thread)
+		s.mu.Unlock()
+		return nil
+
+	default:
+		_, _, err := s.api.PostMessageContext(ctx, s.channel, s.options(slackBlocks(msg, ""))...)
+		return err
+	}
+}
+
+func (s *slackAppNotifier) options(blocks []slack.Block, fallback string) []slack.MsgOption {
+	return []slack.MsgOption{
+		slack.MsgOptionBlocks(blocks...),
+		// shown in push notifications and by clients without Block Kit
+		slack.MsgOptionText(fallback, false),
+	}
+}
+
+// header, details as fields, logs as a code block and an optional context line
+// returns the blocks and the plain text fallback
+func slackBlocks(msg Notification, context string) ([]slack.Block, string) {
+
+	_, emoji := getColor(msg.MessageType)
+	title := clip(emoji+" "+msg.Message, 150)
+
+	blocks := []slack.Block{
+		slack.NewHeaderBlock(slack.NewTextBlockObject(slack.PlainTextType, title, true, false)),
+	}
+
+	// a section holds at most 10 fields
+	fields := []*slack.TextBlockObject{}
+	for _, field := range parseDetails(msg.Details) {
+		text := fmt.Sprintf("*%s*\n%s", field.Title, clip(field.Value, 1900))
+		fields = append(fields, slack.NewTextBlockObject(slack.MarkdownType, text, false, false))
+		if len(fields) == 10 {
+			blocks = append(blocks, slack.NewSectionBlock(nil, fields, nil))
+			fields = []*slack.TextBlockObject{}
+		}
+	}
+	if len(fields) > 0 {
+		blocks = append(blocks, slack.NewSectionBlock(nil, fields, nil))
+	}
+
+	if msg.Logs != "" {
+		logs := slack.NewTextBlockObject(slack.MarkdownType, "```"+clip(msg.Logs, 2900)+"```", false, false)
+		blocks = append(blocks, slack.NewSectionBlock(logs, nil, nil))
+	}
+
+	if context != "" {
+		line := slack.NewTextBlockObject(slack.MarkdownType, clip(context, 2900), false, false)
+		blocks = append(blocks, slack.NewContextBlock("", line))
+	}
+
+	return blocks, title
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type slackCall struct {
+	method   string
+	ts       string
+	threadTS string
+	blocks   string
+}
+
+// fake slack web api, answers chat.postMessage / chat.update and records them
+func fakeSlackAPI(t *testing.T) (string, func() []slackCall) {
+	t.Helper()
+
+	var mu sync.Mutex
+	calls := []slackCall{}
+	posted := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("token") == "" && r.Header.Get("Authorization") == "" {
+			t.Errorf("%s without a token", r.URL.Path)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		call := slackCall{
+			method:   strings.TrimPrefix(r.URL.Path, "/"),
+			ts:       r.Form.Get("ts"),
+			threadTS: r.Form.Get("thread_ts"),
+			blocks:   r.Form.Get("blocks"),
+		}
+		calls = append(calls, call)
+
+		ts := call.ts
+		if call.method == "chat.postMessage" {
+			posted++
+			ts = fmt.Sprintf("1700000000.00000%d", posted)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"ok":true,"channel":"C123","ts":%q}`, ts)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.URL + "/", func() []slackCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]slackCall{}, calls...)
+	}
+}
+
+func TestSlackAppThreadsOneDeployment(t *testing.T) {
+	url, calls := fakeSlackAPI(t)
+	n := newSlackAppNotifier("xoxb-test", "C123", url)
+
+	thread := threadKey("nginx-app", "default")
+	steps := []Notification{
+		{Message: "Deployment Started", Details: "service:nginx-app\nversion:1.1.0\nnamespace:default", MessageType: MsgDeploymentStarted, Thread: thread},
+		{Message: "Updated: 1/2 | Ready: 1/2 | Available: 1 | Unavail: 1", MessageType: MsgDeploymentProgress, Thread: thread},
+		{Message: "Deployment Failed", Details: "service:nginx-app\nerror:crash loop", MessageType: MsgDeploymentFailure, Logs: "panic: boom", Thread: thread},
+	}
+	for _, msg := range steps {
+		if err := n.Notify(context.TODO(), msg); err != nil {
+			t.Fatalf("%s: %v", msg.MessageType, err)
+		}
+	}
+
+	got := calls()
+	if len(got) != 4 {
+		t.Fatalf("expected post, update, update, threaded post, got %+v", got)
+	}
+
+	started, progress, outcome, reply := got[0], got[1], got[2], got[3]
+	parentTS := "1700000000.000001"
+
+	if started.method != "chat.postMessage" || !strings.Contains(started.blocks, "Deployment Started") {
+		t.Errorf("started: %+v", started)
+	}
+	if progress.method != "chat.update" || progress.ts != parentTS || !strings.Contains(progress.blocks, "Ready: 1/2") {
+		t.Errorf("progress should update the started message in place: %+v", progress)
+	}
+	if outcome.method != "chat.update" || outcome.ts != parentTS || !strings.Contains(outcome.blocks, "❌ Deployment Failed") {
+		t.Errorf("outcome should flip the started message: %+v", outcome)
+	}
+	if reply.method != "chat.postMessage" || reply.threadTS != parentTS || !strings.Contains(reply.blocks, "panic: boom") {
+		t.Errorf("details should go into the thread: %+v", reply)
+	}
+
+	// thread is done, the next deployment starts a new message
+	if len(n.threads) != 0 {
+		t.Errorf("thread not released: %v", n.threads)
+	}
+}
+
+func TestSlackAppWithoutStartedMessage(t *testing.T) {
+	url, calls := fakeSlackAPI(t)
+	n := newSlackAppNotifier("xoxb-test", "C123", url)
+
+	// progress of an unknown deployment is dropped, drift is posted on its own
+	n.Notify(context.TODO(), Notification{Message: "Updated: 0/1", MessageType: MsgDeploymentProgress, Thread: "default/ghost"})
+	n.Notify(context.TODO(), Notification{Message: "Drift Detected", Details: "service:nginx-app", MessageType: MsgDriftDetected})
+
+	got := calls()
+	if len(got) != 1 || got[0].method != "chat.postMessage" || got[0].threadTS != "" {
+		t.Errorf("expected one standalone post, got %+v", got)
+	}
+}
+
+func TestProgressOnlyReachesProgressNotifiers(t *testing.T) {
+	webhookURL, bodies := captureServer(t, http.StatusOK)
+	slackURL, calls := fakeSlackAPI(t)
+
+	o := testOutbox(t, t.TempDir(), newWebhookNotifier(webhookURL), newSlackAppNotifier("xoxb-test", "C123", slackURL))
+	o.enqueue(Notification{Message: "Deployment Started", MessageType: MsgDeploymentStarted, Thread: "default/nginx-app"})
+
+	if err := flushWithin(t, o, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 0 {
+		t.Errorf("webhook got a started notification")
+	}
+	if len(calls()) != 1 {
+		t.Errorf("slack app should have posted the started message")
+	}
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ HISTORY STORE @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ state used to be one .last file per .dep, written with the error ignored:
+ no history, no record of failures, a deleted .last meant a redeploy
+
+ now everything lives in {STATE_DIR}/engine.db (sqlite, pure go, WAL so the
+ cli can read while the daemon writes)
+
+ deployments  one row per attempt: service, namespace, old/new image, trigger,
+              start/end, outcome, error, rollback info, ...
+ services     last good .dep content per service, what .last used to be
+ meta         one-off flags (the .last import), the current leader
+ jobs         the job queue, pending until a worker claims it, see queue.go
+
+ .last files are still written as a mirror unless LAST_FILE_MIRROR=false,
+ on first start every existing .last is imported into services
+*/
+
+const (
+	OutcomeRunning        = "running"
+	OutcomeSucceeded      = "succeeded"
+	OutcomeFailed         = "failed"
+	OutcomeRolledBack     = "rolled-back"
+	OutcomeRollbackFailed = "rollback-failed"
+	OutcomeRejected       = "rejected"
+	OutcomeInvalid        = "invalid"
+	// the daemon died / shut down while it was running
+	OutcomeInterrupted = "interrupted"
+	// stopped on purpose: cancel request, newer version
+	OutcomeCancelled = "cancelled"
+)
+
+// what queued the job
+const (
+	TriggerWatch   = "watch"   // .dep written while running
+	TriggerStartup = "startup" // startup reconcile
+	TriggerDrift   = "drift"   // drift heal
+	TriggerRequeue = "requeue" // .dep changed during the deploy
+	TriggerAPI     = "api"     // POST /api/v1/deployments
+)
+
+type deploymentRecord struct {
+	ID        int64  `json:"id"`
+	Service   string `json:"service"`
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind,omitempty"`
+	// raw .dep content and its short form
+	Spec    string `json:"spec"`
+	Version string `json:"version"`
+
+	OldImage string `json:"oldImage,omitempty"`
+	NewImage string `json:"newImage,omitempty"`
+	Trigger  string `json:"trigger,omitempty"`
+
+	StartedAt time.Time `json:"startedAt"`
+	// zero while running
+	FinishedAt time.Time `json:"finishedAt,omitzero"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+
+	RollbackImage string `json:"rollbackImage,omitempty"`
+	RollbackError string `json:"rollbackError,omitempty"`
+	ApprovedBy    string `json:"approvedBy,omitempty"`
+	Report        string `json:"report,omitempty"`
+	Conflicts     int    `json:"conflicts,omitempty"`
+	// queue job that made the attempt, see jobs.go
+	JobID string `json:"jobId,omitempty"`
+}
+
+type historyStore struct {
+	db *sql.DB
+}
+
+// each entry moves the schema one version up (PRAGMA user_version)
+var storeMigrations = []string{
+	`CREATE TABLE deployments (
+		id             INTEGER PRIMARY KEY AUTOINCREMENT,
+		service        TEXT NOT NULL,
+		namespace      TEXT NOT NULL,
+		kind           TEXT NOT NULL DEFAULT '',
+		spec           TEXT NOT NULL DEFAULT '',
+		version        TEXT NOT NULL DEFAULT '',
+		old_image      TEXT NOT NULL DEFAULT '',
+		new_image      TEXT NOT NULL DEFAULT '',
+		trigger        TEXT NOT NULL DEFAULT '',
+		started_at     TEXT NOT NULL,
+		finished_at    TEXT NOT NULL DEFAULT '',
+		outcome        TEXT NOT NULL,
+		error          TEXT NOT NULL DEFAULT '',
+		rollback_image TEXT NOT NULL DEFAULT '',
+		rollback_error TEXT NOT NULL DEFAULT '',
+		approved_by    TEXT NOT NULL DEFAULT '',
+		report         TEXT NOT NULL DEFAULT '',
+		conflicts      INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX deployments_service ON deployments (service, namespace, id);
+	CREATE TABLE services (
+		service       TEXT NOT NULL,
+		namespace     TEXT NOT NULL,
+		spec          TEXT NOT NULL,
+		image         TEXT NOT NULL DEFAULT '',
+		deployment_id INTEGER,
+		updated_at    TEXT NOT NULL,
+		PRIMARY KEY (service, namespace)
+	);
+	CREATE TABLE meta (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`,
+	`ALTER TABLE deployments ADD COLUMN job_id TEXT NOT NULL DEFAULT '';
+	CREATE INDEX deployments_job ON deployments (job_id);`,
+	`CREATE TABLE parked_jobs (
+		id        TEXT PRIMARY KEY,
+		dep_file  TEXT NOT NULL,
+		spec      TEXT NOT NULL,
+		namespace TEXT NOT NULL,
+		force     INTEGER NOT NULL DEFAULT 0,
+		trigger   TEXT NOT NULL DEFAULT '',
+		parked_at TEXT NOT NULL
+	);`,
+	// the durable queue replaces parked_jobs, see queue.go
+	`CREATE TABLE jobs (
+		seq           INTEGER PRIMARY KEY AUTOINCREMENT,
+		id            TEXT NOT NULL UNIQUE,
+		dep_file      TEXT NOT NULL,
+		spec          TEXT NOT NULL,
+		service       TEXT NOT NULL,
+		namespace     TEXT NOT NULL,
+		force         INTEGER NOT NULL DEFAULT 0,
+		trigger       TEXT NOT NULL DEFAULT '',
+		state         TEXT NOT NULL,
+		outcome       TEXT NOT NULL DEFAULT '',
+		attempts      INTEGER NOT NULL DEFAULT 0,
+		error         TEXT NOT NULL DEFAULT '',
+		deployment_id INTEGER NOT NULL DEFAULT 0,
+		created_at    TEXT NOT NULL,
+		updated_at    TEXT NOT NULL
+	);
+	CREATE INDEX jobs_state ON jobs (state, seq);
+	INSERT INTO jobs (id, dep_file, spec, service, namespace, force, trigger, state, created_at, updated_at)
+		SELECT id, dep_file, spec, '', namespace, force, trigger, 'pending', parked_at, parked_at
+		FROM parked_jobs ORDER BY parked_at, rowid;
+	DROP TABLE parked_jobs;`,
+	// unix millis, a retry is not claimed before its backoff passed, see retry.go
+	`ALTER TABLE jobs ADD COLUMN not_before INTEGER NOT NULL DEFAULT 0;`,
+}
+
+func openStore(path string) (*historyStore, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	// busy_timeout: the cli and the daemon share the file
+	dsn := "file:" + path + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store %s: %w", path, err)
+	}
+
+	s := &historyStore{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate store %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *historyStore) close() error {
+	return s.db.Close()
+}
+
+func (s *historyStore) migrate() error {
+
+	var version int
+	if err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(storeMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(storeMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		// PRAGMA does not take parameters
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rows still running belong to a daemon that died, call once on start
+func (s *historyStore) markInterrupted() (int64, error) {
+
+	res, err := s.db.Exec(`UPDATE deployments SET outcome = ?, finished_at = ?, error = 'daemon stopped during the deployment'
+		WHERE outcome = ?`, OutcomeInterrupted, formatTime(time.Now()), OutcomeRunning)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// inserts a running attempt, fills rec.ID and rec.StartedAt
+func (s *historyStore) begin(rec *deploymentRecord) error {
+
+	rec.StartedAt = time.Now()
+	rec.Outcome = OutcomeRunning
+
+	res, err := s.db.Exec(`INSERT INTO deployments (service, namespace, spec, version, trigger, started_at, outcome, approved_by, job_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.Service, rec.Namespace, rec.Spec, rec.Version, rec.Trigger, formatTime(rec.StartedAt), rec.Outcome, rec.ApprovedBy, rec.JobID)
+	if err != nil {
+		return err
+	}
+	rec.ID, err = res.LastInsertId()
+	return err
+}
+
+// writes the outcome (and whatever else was learned) of an attempt
+func (s *historyStore) finish(rec *deploymentRecord) error {
+
+	if rec.FinishedAt.IsZero() {
+		rec.FinishedAt = time.Now()
+	}
+
+	_, err := s.db.Exec(`UPDATE deployments SET kind = ?, old_image = ?, new_image = ?, finished_at = ?, outcome = ?,
+		error = ?, rollback_image = ?, rollback_error = ?, approved_by = ?, report = ?, conflicts = ? WHERE id = ?`,
+		rec.Kind, rec.OldImage, rec.NewImage, formatTime(rec.FinishedAt), rec.Outcome,
+		rec.Error, rec.RollbackImage, rec.RollbackError, rec.ApprovedBy, rec.Report, rec.Conflicts, rec.ID)
+	return err
+}
+
+// .dep content of the last successful deploy, "" when there is none
+func (s *historyStore) lastGood(serviceName string, namespace string) (string, error) {
+
+	var spec string
+	err := s.db.QueryRow(`SELECT spec FROM services WHERE service = ? AND namespace = ?`, serviceName, namespace).Scan(&spec)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return spec, err
+}
+
+func (s *historyStore) setLastGood(serviceName string, namespace string, spec string, image string, deploymentID int64) error {
+
+	_, err := s.db.Exec(`INSERT INTO services (service, namespace, spec, image, deployment_id, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (service, namespace) DO UPDATE SET spec = excluded.spec, image = excluded.image,
+		deployment_id = excluded.deployment_id, updated_at = excluded.updated_at`,
+		serviceName, namespace, spec, image, nullID(deploymentID), formatTime(time.Now()))
+	return err
+}
+
+// same order as the Scan in queryRecords
+const recordColumns = `SELECT id, service, namespace, kind, spec, version, old_image, new_image, trigger, started_at, finished_at,
+	outcome, error, rollback_image, rollback_error, approved_by, report, conflicts, job_id`
+
+// what is deployed right now according to the engine
+type serviceState struct {
+	Service   string
+	Namespace string
+	Spec      string
+	Image     string
+	UpdatedAt time.Time
+}
+
+func (s *historyStore) services() ([]serviceState, error) {
+
+	rows, err := s.db.Query(`SELECT service, namespace, spec, image, updated_at FROM services ORDER BY namespace, service`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := []serviceState{}
+	for rows.Next() {
+		var state serviceState
+		var updated string
+		if err := rows.Scan(&state.Service, &state.Namespace, &state.Spec, &state.Image, &updated); err != nil {
+			return nil, err
+		}
+		state.UpdatedAt = parseTime(updated)
+		states = append(states, state)
+	}
+	return states, rows.Err()
+}
+
+type historyFilter struct {
+	Service   string
+	Namespace string
+	// 0 -> 50
+	Limit int
+}
+
+// newest first
+func (s *historyStore) history(filter historyFilter) ([]deploymentRecord, error) {
+
+	where := []string{}
+	args := []interface{}{}
+	if filter.Service != "" {
+		where = append(where, "service = ?")
+		args = append(args, filter.Service)
+	}
+	if filter.Namespace != "" {
+		where = append(where, "namespace = ?")
+		args = append(args, filter.Namespace)
+	}
+
+	query := recordColumns + ` FROM deployments`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	return s.queryRecords(query, args...)
+}
+
+// attempt made by a queue job, for jobs that are no longer in memory
+func (s *historyStore) byJobID(jobID string) (deploymentRecord, bool, error) {
+	records, err := s.queryRecords(recordColumns+` FROM deployments WHERE job_id = ? ORDER BY id DESC LIMIT 1`, jobID)
+	if err != nil || len(records) == 0 {
+		return deploymentRecord{}, false, err
+	}
+	return records[0], true, nil
+}
+
+// newest attempt of every service, for `engine status`
+func (s *historyStore) latestAttempts() ([]deploymentRecord, error) {
+	return s.queryRecords(recordColumns + ` FROM deployments
+		WHERE id IN (SELECT MAX(id) FROM deployments GROUP BY service, namespace) ORDER BY namespace, service`)
+}
+
+func (s *historyStore) queryRecords(query string, args ...interface{}) ([]deploymentRecord, error) {
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []deploymentRecord{}
+	for rows.Next() {
+		var rec deploymentRecord
+		var started, finished string
+		if err := rows.Scan(&rec.ID, &rec.Service, &rec.Namespace, &rec.Kind, &rec.Spec, &rec.Version, &rec.OldImage, &rec.NewImage,
+			&rec.Trigger, &started, &finished, &rec.Outcome, &rec.Error, &rec.RollbackImage, &rec.RollbackError,
+			&rec.ApprovedBy, &rec.Report, &rec.Conflicts, &rec.JobID); err != nil {
+			return nil, err
+		}
+		rec.StartedAt, rec.FinishedAt = parseTime(started), parseTime(finished)
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// one time: every {service}_{namespace}.last in depsPath becomes the last good
+// spec of its service, later starts skip this
+func (s *historyStore) importLastFiles(depsPath string) (int, error) {
+
+	done, err := s.meta(metaLastFilesImported)
+	if err != nil || done != "" {
+		return 0, err
+	}
+
+	matches, err := filepath.Glob(filepath.Join(depsPath, "*.last"))
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for _, lastFile := range matches {
+
+		serviceName, namespace, err := extractServiceName(lastFile)
+		if err != nil {
+			continue
+		}
+		content := readFile(lastFile)
+		if content == "" {
+			continue
+		}
+
+		existing, err := s.lastGood(serviceName, namespace)
+		if err != nil {
+			return imported, err
+		}
+		if existing != "" {
+			continue
+		}
+
+		if err := s.setLastGood(serviceName, namespace, content, "", 0); err != nil {
+			return imported, err
+		}
+		imported++
+	}
+
+	err = s.setMeta(metaLastFilesImported, formatTime(time.Now()))
+	if err == nil && imported > 0 {
+		log.Printf("📥 Imported %d .last file(s) into the history store", imported)
+	}
+	return imported, err
+}
+
+// meta keys
+const (
+	metaLastFilesImported = "last_files_imported"
+	metaLeader            = "leader"
+	metaLeaderNode        = "leader_node"
+)
+
+func (s *historyStore) setMeta(key string, value string) error {
+	_, err := s.db.Exec(`INSERT INTO meta (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+	return err
+}
+
+// "" when unset
+func (s *historyStore) meta(key string) (string, error) {
+	var value string
+	err := s.db.QueryRow(`SELECT value FROM meta WHERE key = ?`, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return value, err
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseTime(value string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, value)
+	return t
+}
+
+func nullID(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ HISTORY (DAEMON) @@@@@@@@@@@@@@@@@@@@@@@@
+// best effort: a broken db is logged, it never stops a deploy
+
+// last good .dep content, falls back to the .last file if the store fails
+func (d *Daemon) lastGood(depFile string, serviceName string, namespace string) string {
+
+	spec, err := d.store.lastGood(serviceName, namespace)
+	if err != nil {
+		log.Printf("⚠️ History store read failed, using %s: %v", filepath.Base(lastFilePath(depFile)), err)
+		return readFile(lastFilePath(depFile))
+	}
+	return spec
+}
+
+func (d *Daemon) saveLastGood(depFile string, serviceName string, namespace string, content string, rec *deploymentRecord) {
+
+	if err := d.store.setLastGood(serviceName, namespace, content, rec.NewImage, rec.ID); err != nil {
+		log.Printf("⚠️ Could not record %s/%s as deployed: %v", namespace, serviceName, err)
+	} else {
+		log.Printf("✅ Recorded %s as the last good version", content)
+	}
+
+	if !d.opts.LastFileMirror {
+		return
+	}
+	if err := os.WriteFile(lastFilePath(depFile), []byte(content), 0644); err != nil {
+		log.Printf("⚠️ Could not write %s: %v", filepath.Base(lastFilePath(depFile)), err)
+	}
+}
+
+func (d *Daemon) beginAttempt(rec *deploymentRecord) {
+	if err := d.store.begin(rec); err != nil {
+		log.Printf("⚠️ Could not record deployment start: %v", err)
+	}
+	d.jobStates.update(rec.JobID, func(job *jobState) {
+		job.State, job.DeploymentID, job.Version = JobRunning, rec.ID, rec.Version
+	})
+}
+
+func (d *Daemon) finishAttempt(rec *deploymentRecord, outcome string, err error) {
+	d.recordAttempt(rec, outcome, err)
+	d.jobStates.update(rec.JobID, func(job *jobState) {
+		job.State, job.DeploymentID, job.Version, job.Error = outcome, rec.ID, rec.Version, rec.Error
+	})
+}
+
+// history row + metrics only, the job's state is up to the caller
+func (d *Daemon) recordAttempt(rec *deploymentRecord, outcome string, err error) {
+
+	// rejected / invalid never started, they still get their row
+	if rec.ID == 0 {
+		d.beginAttempt(rec)
+	}
+
+	rec.Outcome = outcome
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if err := d.store.finish(rec); err != nil {
+		log.Printf("⚠️ Could not record deployment outcome: %v", err)
+	}
+	d.metrics.deployment(rec.Service, rec.Namespace, outcome)
+}
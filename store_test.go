@@ -0,0 +1,180 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testStore(t *testing.T) *historyStore {
+	t.Helper()
+	s, err := openStore(filepath.Join(t.TempDir(), "engine.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.close() })
+	return s
+}
+
+func TestStoreRecordsAttempts(t *testing.T) {
+	s := testStore(t)
+
+	first := &deploymentRecord{Service: "nginx-app", Namespace: "default", Spec: "1.0.0", Version: "1.0.0", Trigger: TriggerWatch}
+	if err := s.begin(first); err != nil {
+		t.Fatal(err)
+	}
+	first.Outcome, first.OldImage, first.NewImage = OutcomeSucceeded, "app:0.9.0", "app:1.0.0"
+	if err := s.finish(first); err != nil {
+		t.Fatal(err)
+	}
+
+	second := &deploymentRecord{Service: "nginx-app", Namespace: "default", Spec: "1.1.0", Version: "1.1.0", Trigger: TriggerDrift}
+	s.begin(second)
+	second.Outcome, second.Error = OutcomeFailed, "crash loop"
+	s.finish(second)
+
+	other := &deploymentRecord{Service: "api", Namespace: "prod", Spec: "2.0.0"}
+	s.begin(other)
+
+	records, err := s.history(historyFilter{Service: "nginx-app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].ID != second.ID || records[1].ID != first.ID {
+		t.Fatalf("expected the two nginx-app attempts newest first, got %+v", records)
+	}
+	if got := records[1]; got.OldImage != "app:0.9.0" || got.NewImage != "app:1.0.0" || got.Trigger != TriggerWatch || got.FinishedAt.IsZero() {
+		t.Errorf("first attempt not stored: %+v", got)
+	}
+	if got := records[0]; got.Outcome != OutcomeFailed || got.Error != "crash loop" {
+		t.Errorf("failure not stored: %+v", got)
+	}
+
+	if records, _ := s.history(historyFilter{Limit: 1}); len(records) != 1 || records[0].Service != "api" {
+		t.Errorf("limit / order: %+v", records)
+	}
+
+	// the daemon died while api was deploying
+	if n, err := s.markInterrupted(); err != nil || n != 1 {
+		t.Fatalf("expected one interrupted row, got %d %v", n, err)
+	}
+	if records, _ := s.history(historyFilter{Namespace: "prod"}); records[0].Outcome != OutcomeInterrupted {
+		t.Errorf("running row not interrupted: %+v", records[0])
+	}
+}
+
+func TestStoreLastGood(t *testing.T) {
+	s := testStore(t)
+
+	if spec, err := s.lastGood("nginx-app", "default"); spec != "" || err != nil {
+		t.Fatalf("expected nothing for a new service, got %q %v", spec, err)
+	}
+
+	s.setLastGood("nginx-app", "default", "1.0.0", "app:1.0.0", 0)
+	s.setLastGood("nginx-app", "default", "1.1.0", "app:1.1.0", 0)
+	s.setLastGood("nginx-app", "prod", "0.1.0", "app:0.1.0", 0)
+
+	if spec, _ := s.lastGood("nginx-app", "default"); spec != "1.1.0" {
+		t.Errorf("expected 1.1.0, got %q", spec)
+	}
+	if spec, _ := s.lastGood("nginx-app", "prod"); spec != "0.1.0" {
+		t.Errorf("namespaces mixed up, got %q", spec)
+	}
+}
+
+func TestStoreSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "engine.db")
+
+	s, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setLastGood("nginx-app", "default", "1.0.0", "", 0)
+	s.close()
+
+	// migrations already applied, nothing is lost
+	s, err = openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if spec, _ := s.lastGood("nginx-app", "default"); spec != "1.0.0" {
+		t.Errorf("lost after reopen: %q", spec)
+	}
+}
+
+func TestImportLastFiles(t *testing.T) {
+	s := testStore(t)
+	deps := t.TempDir()
+
+	os.WriteFile(filepath.Join(deps, "nginx-app_default.last"), []byte("1.0.0"), 0644)
+	os.WriteFile(filepath.Join(deps, "api_prod.last"), []byte("2.0.0"), 0644)
+	os.WriteFile(filepath.Join(deps, "empty_default.last"), []byte(""), 0644)
+
+	n, err := s.importLastFiles(deps)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 imported, got %d %v", n, err)
+	}
+	if spec, _ := s.lastGood("api", "prod"); spec != "2.0.0" {
+		t.Errorf("api not imported: %q", spec)
+	}
+
+	// only once, a stale .last must not overwrite what the store learned since
+	s.setLastGood("nginx-app", "default", "1.2.0", "", 0)
+	if n, _ := s.importLastFiles(deps); n != 0 {
+		t.Errorf("imported again: %d", n)
+	}
+	if spec, _ := s.lastGood("nginx-app", "default"); spec != "1.2.0" {
+		t.Errorf("overwritten by the .last file: %q", spec)
+	}
+}
+
+func TestDeployServiceRecordsHistory(t *testing.T) {
+	d, _ := newTestDaemon(t,
+		testNamespace("default"),
+		testDeployment("nginx-app", "default", "test.ecr.local/app:1.0.0", 1),
+	)
+	d.opts.LastFileMirror = true
+
+	depFile := filepath.Join(d.opts.DepsPath, "nginx-app_default.dep")
+	os.WriteFile(depFile, []byte("1.1.0"), 0644)
+
+	d.DeployService(DeployService{service: depFile, version: "1.1.0", namespace: "default", trigger: TriggerStartup})
+
+	records, err := d.store.history(historyFilter{})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("expected one history row, got %+v %v", records, err)
+	}
+	rec := records[0]
+	if rec.Outcome != OutcomeSucceeded || rec.Trigger != TriggerStartup || rec.Kind != "Deployment" {
+		t.Errorf("unexpected record: %+v", rec)
+	}
+	if rec.OldImage != "test.ecr.local/app:1.0.0" || rec.NewImage != "test.ecr.local/app:1.1.0" {
+		t.Errorf("images not recorded: %s -> %s", rec.OldImage, rec.NewImage)
+	}
+
+	if spec := d.lastGood(depFile, "nginx-app", "default"); spec != "1.1.0" {
+		t.Errorf("last good not updated: %q", spec)
+	}
+	if last := readFile(lastFilePath(depFile)); last != "1.1.0" {
+		t.Errorf(".last mirror not written: %q", last)
+	}
+
+	// same version again -> nothing to do, no new row
+	d.DeployService(DeployService{service: depFile, version: "1.1.0", namespace: "default"})
+	if records, _ := d.store.history(historyFilter{}); len(records) != 1 {
+		t.Errorf("no-op recorded as an attempt: %d rows", len(records))
+	}
+}
+
+func TestLastGoodFallsBackToLastFile(t *testing.T) {
+	d, _ := newTestDaemon(t)
+
+	depFile := filepath.Join(d.opts.DepsPath, "nginx-app_default.dep")
+	os.WriteFile(lastFilePath(depFile), []byte("1.0.0"), 0644)
+
+	d.store.close()
+	if spec := d.lastGood(depFile, "nginx-app", "default"); spec != "1.0.0" {
+		t.Errorf("expected the .last content, got %q", spec)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ ROLLOUT TRACKER @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ WaitForRollout used to Get the deployment every 3s and checkPodErrors listed
+ every pod in the namespace, with 100 workers that alone ate our QPS budget
+
+ now all workers share one set of informers (one watch per resource type for
+ the whole daemon) and read status from the local cache
+ informer event in a namespace -> wakes every rollout waiting in it
+ the ticker in WaitForRollout is only a safety net, it reads the cache too
+
+ informers are started lazily per kind, the first StatefulSet rollout starts
+ the StatefulSet informer, a daemon that only deploys Deployments never
+ watches StatefulSets
+*/
+
+type rolloutTracker struct {
+	factory informers.SharedInformerFactory
+	stop    chan struct{}
+
+	// serializes informer start + cache sync
+	startMu sync.Mutex
+	started map[string]bool
+	handled map[cache.SharedIndexInformer]bool
+
+	// namespace -> channels of the rollouts waiting in it
+	waitersMu sync.Mutex
+	waiters   map[string]map[chan struct{}]struct{}
+}
+
+func newRolloutTracker(client kubernetes.Interface) *rolloutTracker {
+	return &rolloutTracker{
+		factory: informers.NewSharedInformerFactory(client, 10*time.Minute),
+		stop:    make(chan struct{}),
+		started: make(map[string]bool),
+		handled: make(map[cache.SharedIndexInformer]bool),
+		waiters: make(map[string]map[chan struct{}]struct{}),
+	}
+}
+
+// starts (once) the informers a rollout of this kind needs and waits for them to sync
+// pods are always included, "" only starts pods
+// ctx only bounds the sync wait, the informers keep running for everyone
+func (t *rolloutTracker) ensure(ctx context.Context, kind string) error {
+
+	t.startMu.Lock()
+	defer t.startMu.Unlock()
+
+	if t.started[kind] {
+		return nil
+	}
+
+	needed := []cache.SharedIndexInformer{t.factory.Core().V1().Pods().Informer()}
+
+	switch kind {
+	case KindDeployment:
+		needed = append(needed,
+			t.factory.Apps().V1().Deployments().Informer(),
+			t.factory.Apps().V1().ReplicaSets().Informer())
+	case KindStatefulSet:
+		needed = append(needed, t.factory.Apps().V1().StatefulSets().Informer())
+	case KindDaemonSet:
+		needed = append(needed, t.factory.Apps().V1().DaemonSets().Informer())
+	}
+
+	synced := []cache.InformerSynced{}
+	for _, informer := range needed {
+		if !t.handled[informer] {
+			informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+				AddFunc:    t.wake,
+				UpdateFunc: func(_, obj interface{}) { t.wake(obj) },
+				DeleteFunc: t.wake,
+			})
+			t.handled[informer] = true
+		}
+		synced = append(synced, informer.HasSynced)
+	}
+
+	t.factory.Start(t.stop)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		return fmt.Errorf("timed out waiting for %s informers to sync", kind)
+	}
+
+	t.started[kind] = true
+	return nil
+}
+
+// returns a channel that fires whenever something changes in namespace
+func (t *rolloutTracker) subscribe(namespace string) (chan struct{}, func()) {
+
+	ch := make(chan struct{}, 1)
+
+	t.waitersMu.Lock()
+	if t.waiters[namespace] == nil {
+		t.waiters[namespace] = make(map[chan struct{}]struct{})
+	}
+	t.waiters[namespace][ch] = struct{}{}
+	t.waitersMu.Unlock()
+
+	release := func() {
+		t.waitersMu.Lock()
+		delete(t.waiters[namespace], ch)
+		if len(t.waiters[namespace]) == 0 {
+			delete(t.waiters, namespace)
+		}
+		t.waitersMu.Unlock()
+	}
+	return ch, release
+}
+
+func (t *rolloutTracker) wake(obj interface{}) {
+
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+
+	t.waitersMu.Lock()
+	defer t.waitersMu.Unlock()
+
+	for ch := range t.waiters[accessor.GetNamespace()] {
+		// buffered 1, a pending wake up is as good as two
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *rolloutTracker) pods(namespace string, selector *metav1.LabelSelector) ([]*corev1.Pod, error) {
+
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector: %v", err)
+	}
+	return t.factory.Core().V1().Pods().Lister().Pods(namespace).List(s)
+}
+
+// narrows the workload selector down to the pods of the newest revision, so
+// pods of the old (or the broken, when rolling back) revision are not blamed
+func (t *rolloutTracker) rolloutSelector(target workload) *metav1.LabelSelector {
+
+	selector := target.selector()
+	if selector == nil {
+		return nil
+	}
+	narrowed := selector.DeepCopy()
+	if narrowed.MatchLabels == nil {
+		narrowed.MatchLabels = map[string]string{}
+	}
+
+	switch w := target.(type) {
+
+	case *deploymentWorkload:
+		hash := t.newReplicaSetHash(w.obj)
+		if hash == "" {
+			return selector
+		}
+		narrowed.MatchLabels[appsv1.DefaultDeploymentUniqueLabelKey] = hash
+
+	case *statefulSetWorkload:
+		if w.obj.Status.UpdateRevision == "" {
+			return selector
+		}
+		narrowed.MatchLabels[appsv1.ControllerRevisionHashLabelKey] = w.obj.Status.UpdateRevision
+
+	default:
+		return selector
+	}
+	return narrowed
+}
+
+// pod-template-hash of the ReplicaSet the deployment controller is rolling out
+func (t *rolloutTracker) newReplicaSetHash(deployment *appsv1.Deployment) string {
+
+	const revisionKey = "deployment.kubernetes.io/revision"
+
+	revision := deployment.Annotations[revisionKey]
+	if revision == "" {
+		return ""
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return ""
+	}
+
+	replicaSets, err := t.factory.Apps().V1().ReplicaSets().Lister().ReplicaSets(deployment.Namespace).List(selector)
+	if err != nil {
+		return ""
+	}
+
+	for _, rs := range replicaSets {
+		owner := metav1.GetControllerOf(rs)
+		if owner == nil || owner.UID != deployment.UID {
+			continue
+		}
+		if rs.Annotations[revisionKey] == revision {
+			return rs.Labels[appsv1.DefaultDeploymentUniqueLabelKey]
+		}
+	}
+	return ""
+}
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ API CALL COUNTER @@@@@@@@@@@@@@@@@@@@@@@@
+// every request the clientset sends goes through here, DeployTok8s logs how
+// many it needed so the polling vs informer difference is visible
+
+var apiRequests atomic.Int64
+
+type apiCallKey struct{}
+
+// ctx carrying a per deployment request counter
+func withAPICounter(ctx context.Context) (context.Context, *atomic.Int64) {
+	counter := &atomic.Int64{}
+	return context.WithValue(ctx, apiCallKey{}, counter), counter
+}
+
+type countingTransport struct {
+	next http.RoundTripper
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	apiRequests.Add(1)
+	if counter, ok := req.Context().Value(apiCallKey{}).(*atomic.Int64); ok {
+		counter.Add(1)
+	}
+	return c.next.RoundTrip(req)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// with the safety tick out of the picture only an informer event can finish the wait
+func TestWaitForRolloutWakesOnInformerEvent(t *testing.T) {
+	d, client := newTestDaemon(t, unhealthy(testDeployment("nginx-app", "default", "app:1.0.0", 1)))
+	d.opts.PollInterval = time.Hour
+
+	target, err := getWorkload(context.TODO(), client, KindDeployment, "nginx-app", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// informers up before the status changes, the fake watch does not replay
+	if err := d.tracker.ensure(context.TODO(), KindDeployment); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		healthy := testDeployment("nginx-app", "default", "app:1.0.0", 1)
+		client.AppsV1().Deployments("default").UpdateStatus(context.TODO(), healthy, metav1.UpdateOptions{})
+	}()
+
+	start := time.Now()
+	if err := d.WaitForRollout(context.TODO(), target, "nginx-app", "default", 5*time.Second); err != nil {
+		t.Fatalf("expected rollout to finish, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("rollout took %v, informer event was not picked up", time.Since(start))
+	}
+}
+
+// pods of the old ReplicaSet are not blamed for the new rollout
+func TestRolloutSelectorUsesNewReplicaSet(t *testing.T) {
+	dep := testDeployment("nginx-app", "default", "app:1.1.0", 1)
+	dep.UID = types.UID("dep-uid")
+	dep.Annotations = map[string]string{"deployment.kubernetes.io/revision": "2"}
+
+	replicaSet := func(name, hash, revision string) *appsv1.ReplicaSet {
+		return &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Labels:      map[string]string{"app": "nginx-app", appsv1.DefaultDeploymentUniqueLabelKey: hash},
+			Annotations: map[string]string{"deployment.kubernetes.io/revision": revision},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(dep, appsv1.SchemeGroupVersion.WithKind("Deployment")),
+			},
+		}}
+	}
+
+	oldPod := testPod("nginx-app-old", "default", "nginx-app", corev1.ContainerState{
+		Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"},
+	})
+	oldPod.Labels[appsv1.DefaultDeploymentUniqueLabelKey] = "aaa"
+
+	d, client := newTestDaemon(t, dep, replicaSet("nginx-app-aaa", "aaa", "1"), replicaSet("nginx-app-bbb", "bbb", "2"), oldPod)
+
+	if err := d.tracker.ensure(context.TODO(), KindDeployment); err != nil {
+		t.Fatal(err)
+	}
+	target, _ := getWorkload(context.TODO(), client, KindDeployment, "nginx-app", "default")
+
+	selector := d.tracker.rolloutSelector(target)
+	if hash := selector.MatchLabels[appsv1.DefaultDeploymentUniqueLabelKey]; hash != "bbb" {
+		t.Fatalf("expected the revision 2 hash, got %q", hash)
+	}
+
+	if err := d.checkPodErrors(context.TODO(), "default", selector); err != nil {
+		t.Errorf("crashing pod of the old ReplicaSet should be ignored, got %v", err)
+	}
+}
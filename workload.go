@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+//@@@@@@@@@@@@@@@@@@@@@@@@@@@@ WORKLOADS @@@@@@@@@@@@@@@@@@@@@@@@
+/*
+ DeployTok8s used to only know Deployments, now the target kind is picked per
+ service (.dep `kind:` first, then `kind` in ENGINE_CONFIG, then Deployment)
+
+ every kind hides behind the same small interface so DeployTok8s,
+ WaitForRollout and the rollback dont care what they are talking to
+
+ health follows `kubectl rollout status`, nothing counts before the controller
+ has seen our spec (status.observedGeneration >= metadata.generation)
+ Deployment  -> updated == replicas, no old replicas left, updated all available
+                Progressing=False/ProgressDeadlineExceeded fails right away
+ StatefulSet -> ready == replicas, updateRevision == currentRevision
+                (or updated >= replicas - partition for a partitioned rollout)
+ DaemonSet   -> updatedNumberScheduled/numberAvailable == desiredNumberScheduled
+ CronJob     -> nothing rolls out, the next run just uses the new template
+*/
+
+const (
+	KindDeployment  = "Deployment"
+	KindStatefulSet = "StatefulSet"
+	KindDaemonSet   = "DaemonSet"
+	KindCronJob     = "CronJob"
+)
+
+type workload interface {
+	kind() string
+	meta() *metav1.ObjectMeta
+	// pod template the images live in
+	template() *corev1.PodTemplateSpec
+	selector() *metav1.LabelSelector
+	setReplicas(replicas int32) error
+	// the typed object, used to build the strategic merge patch
+	object() runtime.Object
+	// sends a strategic merge patch and keeps the object the api returns
+	patch(ctx context.Context, data []byte) error
+	// re-reads the object so rolloutStatus sees fresh status
+	refresh(ctx context.Context) error
+	// same but from the shared informer cache, no api call
+	fromCache(t *rolloutTracker) error
+	// done once every pod runs the new template, progress is for the logs
+	// failing means some pods are unavailable and worth inspecting
+	// err is a rollout the controller itself gave up on
+	rolloutStatus() (done bool, failing bool, progress string, err error)
+}
+
+// accepts "statefulset", "StatefulSet", "sts" ...
+func normalizeKind(kind string) (string, error) {
+	switch strings.ToLower(kind) {
+	case "", "deployment", "deploy":
+		return KindDeployment, nil
+	case "statefulset", "sts":
+		return KindStatefulSet, nil
+	case "daemonset", "ds":
+		return KindDaemonSet, nil
+	case "cronjob", "cj":
+		return KindCronJob, nil
+	}
+	return "", fmt.Errorf("unsupported workload kind %q", kind)
+}
+
+// .dep kind wins over the config file
+func (d *Daemon) workloadKind(serviceName string, namespace string, spec DepSpec) (string, error) {
+	if spec.Kind != "" {
+		return normalizeKind(spec.Kind)
+	}
+	return normalizeKind(d.config.service(serviceName, namespace).Kind)
+}
+
+func getWorkload(ctx context.Context, client kubernetes.Interface, kind string, name string, namespace string) (workload, error) {
+
+	switch kind {
+	case KindDeployment:
+		w := &deploymentWorkload{client: client, name: name, namespace: namespace}
+		return w, w.refresh(ctx)
+	case KindStatefulSet:
+		w := &statefulSetWorkload{client: client, name: name, namespace: namespace}
+		return w, w.refresh(ctx)
+	case KindDaemonSet:
+		w := &daemonSetWorkload{client: client, name: name, namespace: namespace}
+		return w, w.refresh(ctx)
+	case KindCronJob:
+		w := &cronJobWorkload{client: client, name: name, namespace: namespace}
+		return w, w.refresh(ctx)
+	}
+	return nil, fmt.Errorf("unsupported workload kind %q", kind)
+}
+
+// ---------------- Deployment ----------------
+
+type deploymentWorkload struct {
+	client          kubernetes.Interface
+	name, namespace string
+	obj             *appsv1.Deployment
+}
+
+func (w *deploymentWorkload) kind() string                      { return KindDeployment }
+func (w *deploymentWorkload) meta() *metav1.ObjectMeta          { return &w.obj.ObjectMeta }
+func (w *deploymentWorkload) template() *corev1.PodTemplateSpec { return &w.obj.Spec.Template }
+func (w *deploymentWorkload) selector() *metav1.LabelSelector   { return w.obj.Spec.Selector }
+func (w *deploymentWorkload) setReplicas(replicas int32) error {
+	w.obj.Spec.Replicas = &replicas
+	return nil
+}
+
+func (w *deploymentWorkload) refresh(ctx context.Context) error {
+	obj, err := w.client.AppsV1().Deployments(w.namespace).Get(ctx, w.name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	w.obj = obj
+	return nil
+}
+
+func (w *deploymentWorkload) fromCache(t *rolloutTracker) error {
+	obj, err := t.factory.Apps().V1().Deployments().Lister().Deployments(w.namespace).Get(w.name)
+	if err != nil {
+		return err
+	}
+	// cache objects are shared, never hand out the original
+	w.obj = obj.DeepCopy()
+	return nil
+}
+
+func (w *deploymentWorkload) object() runtime.Object { return w.obj }
+
+func (w *deploymentWorkload) patch(ctx context.Context, data []byte) error {
+	obj, err := w.client.AppsV1().Deployments(w.namespace).Patch(ctx, w.name, types.StrategicMergePatchType, data,
+		metav1.PatchOptions{FieldManager: fieldManager})
+	if err != nil {
+		return err
+	}
+	w.obj = obj
+	return nil
+}
+
+func (w *deploymentWorkload) rolloutStatus() (bool, bool, string, error) {
+	status := w.obj.Status
+	desired := int32(1)
+	if w.obj.Spec.Replicas != nil {
+		desired = *w.obj.Spec.Replicas
+	}
+
+	progress := fmt.Sprintf("Updated: %d/%d | Ready: %d/%d | Available: %d | Unavail: %d",
+		status.UpdatedReplicas, desired, status.ReadyReplicas, desired, status.AvailableReplicas, status.UnavailableReplicas)
+
+	// status from before our patch, it says nothing about the new spec
+	if w.obj.Generation > status.ObservedGeneration {
+		return false, false, "waiting for the spec update to be observed", nil
+	}
+
+	for _, cond := range status.Conditions {
+		if cond.Type == appsv1.DeploymentProgressing && cond.Reason == "ProgressDeadlineExceeded" {
+			return false, true, progress, classed(ErrorTimeout, fmt.Errorf("deployment %q exceeded its progress deadline: %s", w.name, cond.Message))
+		}
+	}
+
+	failing := status.UnavailableReplicas > 0
+
+	switch {
+	case status.UpdatedReplicas < desired:
+		return false, failing, progress, nil
+	case status.Replicas > status.UpdatedReplicas:
+		// old replicas pending termination
+		return false, failing, progress, nil
+	case status.AvailableReplicas < status.UpdatedReplicas:
+		return false, failing, progress, nil
+	}
+	return true, false, progress, nil
+}
+
+// ---------------- StatefulSet ----------------
+
+type statefulSetWorkload struct {
+	client          kubernetes.Interface
+	name, namespace string
+	obj             *appsv1.StatefulSet
+}
+
+func (w *statefulSetWorkload) kind() string                      { return KindStatefulSet }
+func (w *statefulSetWorkload) meta() *metav1.ObjectMeta          { return &w.obj.ObjectMeta }
+func (w *statefulSetWorkload) template() *corev1.PodTemplateSpec { return &w.obj.Spec.Template }
+func (w *statefulSetWorkload) selector() *metav1.LabelSelector   { return w.obj.Spec.Selector }
+func (w *statefulSetWorkload) setReplicas(replicas int32) error {
+	w.obj.Spec.Replicas = &replicas
+	return nil
+}
+
+func (w *statefulSetWorkload) refresh(ctx context.Context) error {
+	obj, err := w.client.AppsV1().StatefulSets(w.namespace).Get(ctx, w.name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	w.obj = obj
+	return nil
+}
+
+func (w *statefulSetWorkload) fromCache(t *rolloutTracker) error {
+	obj, err := t.factory.Apps().V1().StatefulSets().Lister().StatefulSets(w.namespace).Get(w.name)
+	if err != nil {
+		return err
+	}
+	// cache objects are shared, never hand out the original
+	w.obj = obj.DeepCopy()
+	return nil
+}
+
+func (w *statefulSetWorkload) object() runtime.Object { return w.obj }
+
+func (w *statefulSetWorkload) patch(ctx context.Context, data []byte) error {
+	obj, err := w.client.AppsV1().StatefulSets(w.namespace).Patch(ctx, w.name, types.StrategicMergePatchType, data,
+		metav1.PatchOptions{FieldManager: fieldManager})
+	if err != nil {
+		return err
+	}
+	w.obj = obj
+	return nil
+}
+
+func (w *statefulSetWorkload) rolloutStatus() (bool, bool, string, error) {
+	status := w.obj.Status
+	desired := int32(1)
+	if w.obj.Spec.Replicas != nil {
+		desired = *w.obj.Spec.Replicas
+	}
+
+	progress := fmt.Sprintf("Updated: %d/%d | Ready: %d/%d | Revision: %s → %s",
+		status.UpdatedReplicas, desired, status.ReadyReplicas, desired, status.CurrentRevision, status.UpdateRevision)
+
+	// OnDelete never rolls pods by itself, the new template is all we can check
+	if w.obj.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+		return true, false, progress, nil
+	}
+
+	if w.obj.Generation > status.ObservedGeneration {
+		return false, false, "waiting for the spec update to be observed", nil
+	}
+
+	failing := status.ReadyReplicas < desired
+	if failing {
+		return false, failing, progress, nil
+	}
+
+	// partitioned rollout, only the ordinals >= partition get the new revision
+	rolling := w.obj.Spec.UpdateStrategy.RollingUpdate
+	if rolling != nil && rolling.Partition != nil && *rolling.Partition > 0 {
+		return status.UpdatedReplicas >= desired-*rolling.Partition, false, progress, nil
+	}
+
+	// pods are replaced one by one, currentRevision catches up once the last one is done
+	done := status.UpdateRevision != "" && status.UpdateRevision == status.CurrentRevision
+	return done, false, progress, nil
+}
+
+// ---------------- DaemonSet ----------------
+
+type daemonSetWorkload struct {
+	client          kubernetes.Interface
+	name, namespace string
+	obj             *appsv1.DaemonSet
+}
+
+func (w *daemonSetWorkload) kind() string                      { return KindDaemonSet }
+func (w *daemonSetWorkload) meta() *metav1.ObjectMeta          { return &w.obj.ObjectMeta }
+func (w *daemonSetWorkload) template() *corev1.PodTemplateSpec { return &w.obj.Spec.Template }
+func (w *daemonSetWorkload) selector() *metav1.LabelSelector   { return w.obj.Spec.Selector }
+
+func (w *daemonSetWorkload) setReplicas(replicas int32) error {
+	return fmt.Errorf("replicas can not be set on a DaemonSet")
+}
+
+func (w *daemonSetWorkload) refresh(ctx context.Context) error {
+	obj, err := w.client.AppsV1().DaemonSets(w.namespace).Get(ctx, w.name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	w.obj = obj
+	return nil
+}
+
+func (w *daemonSetWorkload) fromCache(t *rolloutTracker) error {
+	obj, err := t.factory.Apps().V1().DaemonSets().Lister().DaemonSets(w.namespace).Get(w.name)
+	if err != nil {
+		return err
+	}
+	// cache objects are shared, never hand out the original
+	w.obj = obj.DeepCopy()
+	return nil
+}
+
+func (w *daemonSetWorkload) object() runtime.Object { return w.obj }
+
+func (w *daemonSetWorkload) patch(ctx context.Context, data []byte) error {
+	obj, err := w.client.AppsV1().DaemonSets(w.namespace).Patch(ctx, w.name, types.StrategicMergePatchType, data,
+		metav1.PatchOptions{FieldManager: fieldManager})
+	if err != nil {
+		return err
+	}
+	w.obj = obj
+	return nil
+}
+
+func (w *daemonSetWorkload) rolloutStatus() (bool, bool, string, error) {
+	status := w.obj.Status
+	desired := status.DesiredNumberScheduled
+
+	progress := fmt.Sprintf("Updated: %d/%d | Available: %d/%d | Unavail: %d",
+		status.UpdatedNumberScheduled, desired, status.NumberAvailable, desired, status.NumberUnavailable)
+
+	if w.obj.Spec.UpdateStrategy.Type == appsv1.OnDeleteDaemonSetStrategyType {
+		return true, false, progress, nil
+	}
+
+	if w.obj.Generation > status.ObservedGeneration {
+		return false, false, "waiting for the spec update to be observed", nil
+	}
+
+	done := status.UpdatedNumberScheduled >= desired && status.NumberAvailable >= desired
+	return done, status.NumberUnavailable > 0, progress, nil
+}
+
+// ---------------- CronJob ----------------
+
+type cronJobWorkload struct {
+	client          kubernetes.Interface
+	name, namespace string
+	obj             *batchv1.CronJob
+}
+
+func (w *cronJobWorkload) kind() string             { return KindCronJob }
+func (w *cronJobWorkload) meta() *metav1.ObjectMeta { return &w.obj.ObjectMeta }
+
+func (w *cronJobWorkload) template() *corev1.PodTemplateSpec {
+	return &w.obj.Spec.JobTemplate.Spec.Template
+}
+
+func (w *cronJobWorkload) selector() *metav1.LabelSelector {
+	return &metav1.LabelSelector{MatchLabels: w.obj.Spec.JobTemplate.Spec.Template.Labels}
+}
+
+func (w *cronJobWorkload) setReplicas(replicas int32) error {
+	return fmt.Errorf("replicas can not be set on a CronJob")
+}
+
+func (w *cronJobWorkload) refresh(ctx context.Context) error {
+	obj, err := w.client.BatchV1().CronJobs(w.namespace).Get(ctx, w.name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	w.obj = obj
+	return nil
+}
+
+// nothing to track for a CronJob, the object from the patch is enough
+func (w *cronJobWorkload) fromCache(t *rolloutTracker) error { return nil }
+
+func (w *cronJobWorkload) object() runtime.Object { return w.obj }
+
+func (w *cronJobWorkload) patch(ctx context.Context, data []byte) error {
+	obj, err := w.client.BatchV1().CronJobs(w.namespace).Patch(ctx, w.name, types.StrategicMergePatchType, data,
+		metav1.PatchOptions{FieldManager: fieldManager})
+	if err != nil {
+		return err
+	}
+	w.obj = obj
+	return nil
+}
+
+// there is no rollout, the next scheduled job picks up the new template
+func (w *cronJobWorkload) rolloutStatus() (bool, bool, string, error) {
+	return true, false, fmt.Sprintf("Schedule: %s | Active: %d", w.obj.Spec.Schedule, len(w.obj.Status.Active)), nil
+}
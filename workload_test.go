@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testPodTemplate(app, image string) corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": app}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: app, Image: image}}},
+	}
+}
+
+func TestStatefulSetRolloutStatus(t *testing.T) {
+	replicas := int32(3)
+	sts := &statefulSetWorkload{obj: &appsv1.StatefulSet{
+		Spec: appsv1.StatefulSetSpec{Replicas: &replicas},
+		Status: appsv1.StatefulSetStatus{
+			UpdatedReplicas: 3, ReadyReplicas: 3,
+			CurrentRevision: "db-1", UpdateRevision: "db-2",
+		},
+	}}
+
+	if done, _, _, _ := sts.rolloutStatus(); done {
+		t.Error("revisions differ, rollout should not be done")
+	}
+
+	sts.obj.Status.CurrentRevision = "db-2"
+	if done, _, _, _ := sts.rolloutStatus(); !done {
+		t.Error("revisions match and all ready, rollout should be done")
+	}
+}
+
+func TestDaemonSetRolloutStatus(t *testing.T) {
+	ds := &daemonSetWorkload{obj: &appsv1.DaemonSet{
+		Status: appsv1.DaemonSetStatus{
+			DesiredNumberScheduled: 4, UpdatedNumberScheduled: 4, NumberReady: 3, NumberAvailable: 3, NumberUnavailable: 1,
+		},
+	}}
+
+	if done, failing, _, _ := ds.rolloutStatus(); done || !failing {
+		t.Errorf("one node unavailable: done=%v failing=%v", done, failing)
+	}
+
+	ds.obj.Status.NumberReady = 4
+	ds.obj.Status.NumberAvailable = 4
+	ds.obj.Status.NumberUnavailable = 0
+	if done, _, _, _ := ds.rolloutStatus(); !done {
+		t.Error("all nodes updated and ready, rollout should be done")
+	}
+}
+
+// kind comes from ENGINE_CONFIG when the .dep is a plain version
+func TestDeployTok8sStatefulSetFromConfig(t *testing.T) {
+	replicas := int32(1)
+	d, client := newTestDaemon(t,
+		testNamespace("data"),
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "postgres", Namespace: "data"},
+			Spec: appsv1.StatefulSetSpec{
+				Replicas: &replicas,
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "postgres"}},
+				Template: testPodTemplate("postgres", "test.ecr.local/app:15.0"),
+			},
+			Status: appsv1.StatefulSetStatus{
+				UpdatedReplicas: 1, ReadyReplicas: 1, CurrentRevision: "pg-1", UpdateRevision: "pg-1",
+			},
+		},
+	)
+	d.config.Services["postgres"] = ServiceConfig{Kind: "statefulset"}
+
+	if _, err := d.DeployTok8s(context.TODO(), "postgres", DepSpec{Version: "15.1"}, "data"); err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+
+	sts, _ := client.AppsV1().StatefulSets("data").Get(context.TODO(), "postgres", metav1.GetOptions{})
+	if image := sts.Spec.Template.Spec.Containers[0].Image; image != "test.ecr.local/app:15.1" {
+		t.Errorf("image not updated, got %s", image)
+	}
+}
+
+// kind from the .dep itself, CronJobs have nothing to wait for
+func TestDeployTok8sCronJob(t *testing.T) {
+	d, client := newTestDaemon(t,
+		testNamespace("batch"),
+		&batchv1.CronJob{
+			ObjectMeta: metav1.ObjectMeta{Name: "report", Namespace: "batch"},
+			Spec: batchv1.CronJobSpec{
+				Schedule: "0 * * * *",
+				JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{
+					Template: testPodTemplate("report", "test.ecr.local/app:1.0"),
+				}},
+			},
+		},
+	)
+
+	if _, err := d.DeployTok8s(context.TODO(), "report", DepSpec{Version: "1.1", Kind: "CronJob"}, "batch"); err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+
+	cj, _ := client.BatchV1().CronJobs("batch").Get(context.TODO(), "report", metav1.GetOptions{})
+	if image := cj.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Image; image != "test.ecr.local/app:1.1" {
+		t.Errorf("image not updated, got %s", image)
+	}
+}
+
+func TestDeploymentRolloutStatus(t *testing.T) {
+	dep := testDeployment("nginx-app", "default", "app:1.1.0", 2)
+	w := &deploymentWorkload{name: "nginx-app", obj: dep}
+
+	// healthy numbers but from before the controller saw generation 2
+	dep.Generation = 2
+	dep.Status.ObservedGeneration = 1
+	if done, _, _, _ := w.rolloutStatus(); done {
+		t.Error("stale status must not count as done")
+	}
+
+	dep.Status.ObservedGeneration = 2
+	if done, _, _, err := w.rolloutStatus(); !done || err != nil {
+		t.Errorf("observed and healthy: done=%v err=%v", done, err)
+	}
+
+	// old replicas still around
+	dep.Status.Replicas = 3
+	if done, _, _, _ := w.rolloutStatus(); done {
+		t.Error("old replicas pending termination, rollout should not be done")
+	}
+
+	dep.Status.Conditions = []appsv1.DeploymentCondition{{
+		Type: appsv1.DeploymentProgressing, Status: corev1.ConditionFalse,
+		Reason: "ProgressDeadlineExceeded", Message: "ReplicaSet has timed out progressing.",
+	}}
+	if _, _, _, err := w.rolloutStatus(); err == nil {
+		t.Error("expected ProgressDeadlineExceeded to fail the rollout")
+	}
+}
+
+func TestRolloutTimeout(t *testing.T) {
+	d, _ := newTestDaemon(t)
+	d.opts.RolloutTimeout = 4 * time.Minute
+
+	deadline := int32(600)
+	dep := testDeployment("nginx-app", "default", "app:1.0.0", 1)
+	dep.Spec.ProgressDeadlineSeconds = &deadline
+	w := &deploymentWorkload{obj: dep}
+
+	if got := d.rolloutTimeout("nginx-app", "default", w); got != 10*time.Minute+30*time.Second {
+		t.Errorf("expected the progress deadline to extend the wait, got %v", got)
+	}
+
+	d.config.Services["nginx-app_default"] = ServiceConfig{RolloutTimeout: &metav1.Duration{Duration: time.Minute}}
+	if got := d.rolloutTimeout("nginx-app", "default", w); got != time.Minute {
+		t.Errorf("expected the per service override, got %v", got)
+	}
+}